@@ -0,0 +1,332 @@
+/*
+ * Administrative subcommands and the admin socket
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+ * The subcommands here do what staff can do through the web interface,
+ * directly against the configured database, so that they may be run from
+ * cron and scripts. They are audited as "cli:<user>" with source "cli".
+ *
+ * Running servers must then learn of what changed. PostgreSQL notifies every
+ * instance when the store commits a change, as usual. SQLite cannot, so the
+ * server listens on the admin socket, if admin.socket is set, for lines of
+ * the form "<verb> [args...]" with the verbs of notify.go, handles each as if
+ * it were a notification, and replies with "OK" or "E :<error>".
+ */
+
+const adminSocketTimeout = 10 * time.Second
+
+var errAdminSocket = errors.New("admin socket")
+
+/*
+ * Set up everything the subcommands need, as the server would.
+ */
+func setupAdmin() (context.Context, string, error) {
+	err := setupInstanceID()
+	if err != nil {
+		return nil, "", err
+	}
+	err = setupDatabase()
+	if err != nil {
+		return nil, "", err
+	}
+	ctx := withAuditSource(context.Background(), "cli", "")
+	err = setupSchema(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	err = loadStateAndSchedule()
+	if err != nil {
+		return nil, "", err
+	}
+	err = setupCourses(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	actor := "cli"
+	if u, err := user.Current(); err == nil {
+		actor += ":" + u.Username
+	}
+	return ctx, actor, nil
+}
+
+/*
+ * Tell the running server, if there is one, what we changed.
+ */
+func signalServer(verb string, args ...string) error {
+	if db.Type() == "postgres" {
+		/* The store has notified every instance already */
+		return nil
+	}
+	if config().Admin.Socket == "" {
+		slog.Warn("admin.socket is not set, so a running server will not notice this change until it is restarted")
+		return nil
+	}
+
+	conn, err := net.DialTimeout("unix", config().Admin.Socket, adminSocketTimeout)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+		slog.Info("no server is running")
+		return nil
+	} else if err != nil {
+		return wrapError(errAdminSocket, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(adminSocketTimeout))
+
+	_, err = io.WriteString(conn, strings.Join(append([]string{verb}, args...), " ")+"\n")
+	if err != nil {
+		return wrapError(errAdminSocket, err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return wrapError(errAdminSocket, err)
+	}
+	reply = strings.TrimSuffix(reply, "\n")
+	if msg, ok := strings.CutPrefix(reply, "E :"); ok {
+		return wrapAny(errAdminSocket, msg)
+	}
+	return nil
+}
+
+/*
+ * Serve the admin socket forever. This should be run in its own goroutine
+ * after setup is complete.
+ */
+func runAdminSocket() {
+	l, err := listenUnix(config().Admin.Socket, 0o600, "", "")
+	/* After a handoff, the old process keeps the socket until it exits */
+	for errors.Is(err, errUnixSocketInUse) {
+		time.Sleep(time.Second)
+		l, err = listenUnix(config().Admin.Socket, 0o600, "", "")
+	}
+	if err != nil {
+		slog.Error("admin socket", "error", err)
+		return
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			slog.Error("admin socket", "error", err)
+			return
+		}
+		go handleAdminConn(conn)
+	}
+}
+
+func handleAdminConn(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(adminSocketTimeout))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	line = strings.TrimSuffix(line, "\n")
+	slog.Info("admin socket", "command", line)
+
+	err = handleNotification(context.Background(), "admin "+line)
+	if err != nil {
+		_, _ = io.WriteString(conn, "E :"+err.Error()+"\n")
+		return
+	}
+	_, _ = io.WriteString(conn, "OK\n")
+}
+
+func cmdImportCourses(args []string) error {
+	if len(args) != 1 {
+		return errBadNumberOfArguments
+	}
+	ctx, actor, err := setupAdmin()
+	if err != nil {
+		return err
+	}
+	if !studentAccessDisabled() {
+		return errDisableStudentAccessFirst
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = importCourses(ctx, actor, f, filepath.Base(args[0]))
+	if err != nil {
+		return err
+	}
+	return signalServer("C")
+}
+
+func cmdImportStudents(args []string) error {
+	if len(args) != 1 {
+		return errBadNumberOfArguments
+	}
+	ctx, actor, err := setupAdmin()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	/* The server reads expected students when it needs them */
+	return importStudents(ctx, actor, f, filepath.Base(args[0]))
+}
+
+func cmdSetState(args []string) error {
+	if len(args) != 2 {
+		return errBadNumberOfArguments
+	}
+	newState, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return wrapError(errInvalidState, err)
+	}
+	ctx, actor, err := setupAdmin()
+	if err != nil {
+		return err
+	}
+	err = setState(ctx, actor, args[0], uint32(newState))
+	if err != nil {
+		return wrapError(errCannotSetState, err)
+	}
+	return signalServer("S", args[0])
+}
+
+/*
+ * The schedule is given as on the staff page, such as 2024-09-01T12:00, in
+ * the school's time zone.
+ */
+func cmdSetSchedule(args []string) error {
+	if len(args) != 2 {
+		return errBadNumberOfArguments
+	}
+	newSchedule, err := time.ParseInLocation("2006-01-02T15:04", args[1], loc)
+	if err != nil {
+		return wrapError(errInvalidSchedule, err)
+	}
+	ctx, actor, err := setupAdmin()
+	if err != nil {
+		return err
+	}
+	err = setSchedule(ctx, actor, args[0], &newSchedule)
+	if err != nil {
+		return wrapError(errCannotSetSchedule, err)
+	}
+	return signalServer("S", args[0])
+}
+
+/*
+ * Write the export named by the first argument to the file named by the
+ * second, or to standard output.
+ */
+func cmdExport(args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return errBadNumberOfArguments
+	}
+	/* Tables are written as CSV, unless the file is named *.xlsx */
+	var table func(context.Context) (tableT, error)
+	var write func(context.Context, io.Writer) error
+	switch args[0] {
+	case "choices":
+		table = choicesTable
+	case "students":
+		table = studentsTable
+	case "incomplete":
+		table = func(ctx context.Context) (tableT, error) {
+			students, err := getIncompleteStudents(ctx, "")
+			return incompleteTable(students), err
+		}
+	case "rostercheck":
+		table = func(ctx context.Context) (tableT, error) {
+			problems, err := getRosterProblems(ctx)
+			return rosterProblemsTable(problems), err
+		}
+	case "rosters":
+		write = writeRostersXLSX
+	case "workbook":
+		write = writeWorkbookXLSX
+	default:
+		return wrapAny(errUnknownSubcommand, "export "+args[0])
+	}
+	if table != nil {
+		name := args[0]
+		xlsx := len(args) == 2 && strings.EqualFold(filepath.Ext(args[1]), ".xlsx")
+		write = func(ctx context.Context, w io.Writer) error {
+			t, err := table(ctx)
+			if err != nil {
+				return err
+			}
+			if xlsx {
+				return writeXLSX(w, []xlsxSheetT{t.sheet(name)})
+			}
+			return writeTableCSV(w, t)
+		}
+	}
+	ctx, _, err := setupAdmin()
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 1 {
+		return write(ctx, os.Stdout)
+	}
+	f, err := os.Create(args[1])
+	if err != nil {
+		return err
+	}
+	err = write(ctx, f)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func cmdReconcile(args []string) error {
+	if len(args) != 0 {
+		return errBadNumberOfArguments
+	}
+	ctx, actor, err := setupAdmin()
+	if err != nil {
+		return err
+	}
+	report, err := reconcileCounts(ctx, actor)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d courses, %d discrepancies fixed\n", report.Courses, len(report.Discrepancies))
+	for _, d := range report.Discrepancies {
+		fmt.Printf(
+			"%d\t%s\tchoices %s, column %s\n",
+			d.CourseID, d.Title, d.Choices, d.Column,
+		)
+	}
+	if len(report.Discrepancies) == 0 {
+		return nil
+	}
+	/* Our own counts are of no interest; the server's may be wrong too */
+	return signalServer("C")
+}
@@ -0,0 +1,305 @@
+/*
+ * Append-only audit log
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Every selection and administrative action is recorded in the audit table,
+ * including rejected attempts. Entries that record a change are written in
+ * the same transaction as the change wherever possible, so that the log
+ * cannot disagree with the data. Entries are never updated or deleted.
+ */
+
+const (
+	auditChoose         = "choose"
+	auditUnchoose       = "unchoose"
+	auditConfirm        = "confirm"
+	auditUnconfirm      = "unconfirm"
+	auditImportCourses  = "import-courses"
+	auditImportStudents = "import-students"
+	auditSetState       = "set-state"
+	auditSetSchedule    = "set-schedule"
+	auditReconcile      = "reconcile"
+	auditReloadConfig   = "reload-config"
+)
+
+const (
+	auditOK       = "ok"
+	auditRejected = "rejected"
+	auditNoop     = "noop"
+)
+
+type auditEntryT struct {
+	ID       int64
+	Time     time.Time
+	Actor    string
+	Target   string
+	CourseID int /* 0 if not applicable */
+	Action   string
+	Source   string
+	IP       string
+	Outcome  string
+	Detail   string
+}
+
+type auditSourceT struct {
+	Source string
+	IP     string
+}
+
+type auditSourceKeyT struct{}
+
+/*
+ * Record where the actions performed under this context come from, such as
+ * "ws" or "http" and the client's address.
+ */
+func withAuditSource(ctx context.Context, source, ip string) context.Context {
+	return context.WithValue(ctx, auditSourceKeyT{}, auditSourceT{
+		Source: source,
+		IP:     ip,
+	})
+}
+
+func getAuditSource(ctx context.Context) auditSourceT {
+	source, ok := ctx.Value(auditSourceKeyT{}).(auditSourceT)
+	if !ok {
+		return auditSourceT{Source: "system", IP: ""}
+	}
+	return source
+}
+
+/*
+ * The address of the client. Behind a reverse proxy, every request comes
+ * from the proxy, so for peers in listen.trusted_proxies we believe what
+ * they say in X-Forwarded-For, of which the first address from the right
+ * that is not a trusted proxy is the client, or else in X-Real-IP.
+ * Peers on a UNIX domain socket have no address, and are trusted if
+ * listen.trusted_proxies includes "unix".
+ */
+func remoteIP(req *http.Request) string {
+	peer, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		peer = req.RemoteAddr
+	}
+	if !trustedProxy(peer) {
+		return peer
+	}
+	if forwarded := req.Header.Values("X-Forwarded-For"); len(forwarded) != 0 {
+		addrs := strings.Split(strings.Join(forwarded, ","), ",")
+		client := peer
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(addrs[i]))
+			if err != nil {
+				break
+			}
+			client = addr.Unmap().String()
+			if !trustedProxy(client) {
+				break
+			}
+		}
+		return client
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSpace(req.Header.Get("X-Real-IP"))); err == nil {
+		return addr.Unmap().String()
+	}
+	return peer
+}
+
+func trustedProxy(peer string) bool {
+	addr, err := netip.ParseAddr(peer)
+	if err != nil {
+		return config().Listen.TrustUnixProxy
+	}
+	addr = addr.Unmap()
+	for _, prefix := range config().Listen.TrustedProxyPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+const insertAudit = "INSERT INTO audit (time, actor, target, courseid, action, source, ip, outcome, detail) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+
+/*
+ * The arguments for insertAudit. The time, source and IP are filled in here.
+ */
+func auditArgs(ctx context.Context, entry auditEntryT) []any {
+	source := getAuditSource(ctx)
+	var courseID *int
+	if entry.CourseID != 0 {
+		courseID = &entry.CourseID
+	}
+	return []any{
+		time.Now().UnixMicro(),
+		entry.Actor,
+		entry.Target,
+		courseID,
+		entry.Action,
+		source.Source,
+		source.IP,
+		entry.Outcome,
+		entry.Detail,
+	}
+}
+
+/*
+ * A shorthand for the common case of a user acting on their own choices.
+ */
+func selfEntry(
+	userID string,
+	action string,
+	courseID int,
+	outcome string,
+	detail string,
+) auditEntryT {
+	return auditEntryT{
+		Actor:    userID,
+		Target:   userID,
+		CourseID: courseID,
+		Action:   action,
+		Outcome:  outcome,
+		Detail:   detail,
+	} //exhaustruct:ignore
+}
+
+/*
+ * Record an attempt that changed nothing, so it needs no transaction.
+ */
+func auditSelf(
+	ctx context.Context,
+	userID string,
+	action string,
+	courseID int,
+	outcome string,
+	detail string,
+) error {
+	return db.Audit(ctx, selfEntry(userID, action, courseID, outcome, detail))
+}
+
+type auditFilterT struct {
+	User    string /* matches actor or target, by ID or name */
+	Action  string
+	Course  int
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+func auditFilterFromRequest(req *http.Request) (filter auditFilterT, err error) {
+	filter.User = strings.TrimSpace(req.FormValue("user"))
+	filter.Action = req.FormValue("action")
+	filter.Outcome = req.FormValue("outcome")
+	if s := req.FormValue("course"); s != "" {
+		filter.Course, err = strconv.Atoi(s)
+		if err != nil {
+			return filter, wrapError(errInvalidForm, err)
+		}
+	}
+	if s := req.FormValue("since"); s != "" {
+		filter.Since, err = time.ParseInLocation("2006-01-02T15:04", s, loc)
+		if err != nil {
+			return filter, wrapError(errInvalidForm, err)
+		}
+	}
+	if s := req.FormValue("until"); s != "" {
+		filter.Until, err = time.ParseInLocation("2006-01-02T15:04", s, loc)
+		if err != nil {
+			return filter, wrapError(errInvalidForm, err)
+		}
+	}
+	return filter, nil
+}
+
+/*
+ * Build the query for searching the audit log, newest first. The backends
+ * differ in how they match case-insensitively, so like is the operator for
+ * that.
+ */
+func buildAuditQuery(filter auditFilterT, like string) (string, []any) {
+	conds := []string{"1 = 1"}
+	args := []any{}
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if filter.User != "" {
+		p := arg(filter.User)
+		l := arg("%" + filter.User + "%")
+		conds = append(conds, "(a.actor = "+p+" OR a.target = "+p+
+			" OR ua.name "+like+" "+l+" OR ut.name "+like+" "+l+
+			" OR ua.email "+like+" "+l+" OR ut.email "+like+" "+l+")")
+	}
+	if filter.Action != "" {
+		conds = append(conds, "a.action = "+arg(filter.Action))
+	}
+	if filter.Outcome != "" {
+		conds = append(conds, "a.outcome = "+arg(filter.Outcome))
+	}
+	if filter.Course != 0 {
+		conds = append(conds, "a.courseid = "+arg(filter.Course))
+	}
+	if !filter.Since.IsZero() {
+		conds = append(conds, "a.time >= "+arg(filter.Since.UnixMicro()))
+	}
+	if !filter.Until.IsZero() {
+		conds = append(conds, "a.time < "+arg(filter.Until.UnixMicro()))
+	}
+	query := "SELECT a.id, a.time, a.actor, a.target, COALESCE(a.courseid, 0), a.action, a.source, a.ip, a.outcome, a.detail, COALESCE(ua.name, ''), COALESCE(ut.name, '') FROM audit a LEFT JOIN users ua ON ua.id = a.actor LEFT JOIN users ut ON ut.id = a.target WHERE " +
+		strings.Join(conds, " AND ") +
+		" ORDER BY a.id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT " + arg(filter.Limit)
+	}
+	return query, args
+}
+
+/*
+ * Scan a row of the query built by buildAuditQuery, recording the names of
+ * the users involved in names.
+ */
+func scanAuditEntry(row scannerT, names map[string]string) (auditEntryT, error) {
+	var entry auditEntryT
+	var t int64
+	var actorName, targetName string
+	err := row.Scan(
+		&entry.ID,
+		&t,
+		&entry.Actor,
+		&entry.Target,
+		&entry.CourseID,
+		&entry.Action,
+		&entry.Source,
+		&entry.IP,
+		&entry.Outcome,
+		&entry.Detail,
+		&actorName,
+		&targetName,
+	)
+	if err != nil {
+		return entry, wrapError(errUnexpectedDBError, err)
+	}
+	entry.Time = time.UnixMicro(t).In(loc)
+	if actorName != "" {
+		names[entry.Actor] = actorName
+	}
+	if targetName != "" {
+		names[entry.Target] = targetName
+	}
+	return entry, nil
+}
@@ -0,0 +1,59 @@
+/*
+ * Tests of the audit log
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	old := config()
+	c := *old
+	c.Auth.Students.Pattern = `^[sS]([0-9]+)$`
+	c.Listen.TrustedProxies = "127.0.0.1 10.0.0.0/8 unix"
+	if err := validateConfig(&c); err != nil {
+		t.Fatal(err)
+	}
+	currentConfig.Store(&c)
+	t.Cleanup(func() {
+		currentConfig.Store(old)
+	})
+
+	for _, tc := range []struct {
+		desc       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{"direct", "203.0.113.5:1234", nil, "", "203.0.113.5"},
+		{"untrusted peer", "203.0.113.5:1234", []string{"198.51.100.7"}, "198.51.100.7", "203.0.113.5"},
+		{"trusted peer", "127.0.0.1:1234", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"chain of proxies", "127.0.0.1:1234", []string{"198.51.100.7, 10.1.2.3"}, "", "198.51.100.7"},
+		{"spoofed by the client", "127.0.0.1:1234", []string{"192.0.2.1", "198.51.100.7"}, "", "198.51.100.7"},
+		{"all trusted", "127.0.0.1:1234", []string{"10.1.2.3"}, "", "10.1.2.3"},
+		{"garbage", "127.0.0.1:1234", []string{"unknown"}, "", "127.0.0.1"},
+		{"real IP", "127.0.0.1:1234", nil, "198.51.100.7", "198.51.100.7"},
+		{"no header", "127.0.0.1:1234", nil, "", "127.0.0.1"},
+		{"unix socket", "@", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"IPv4 in IPv6", "[::ffff:127.0.0.1]:1234", []string{"198.51.100.7"}, "", "198.51.100.7"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		for _, value := range tc.forwarded {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		if tc.realIP != "" {
+			req.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if got := remoteIP(req); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.desc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+/*
+ * Batched propagation of selected counts
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+/*
+ * Choosing or unchoosing a course marks the course as dirty. A single
+ * broadcaster goroutine collects dirty course IDs and, once per tick, hands
+ * them to every connection's pending set and wakes the connection up through
+ * its usem. The connection then sends one M message containing the current
+ * counts of every course in its pending set. This means that the number of
+ * goroutines involved scales with the number of connections rather than
+ * connections times courses, and that a burst of choices within one tick
+ * costs each connection one message.
+ */
+
+type pendingCoursesT struct {
+	lock sync.Mutex
+	ids  map[int]struct{}
+	usem usemT
+}
+
+func newPendingCourses() *pendingCoursesT {
+	pending := &pendingCoursesT{
+		ids: make(map[int]struct{}),
+	} //exhaustruct:ignore
+	pending.usem.init()
+	return pending
+}
+
+func (pending *pendingCoursesT) add(ids []int) {
+	func() {
+		pending.lock.Lock()
+		defer pending.lock.Unlock()
+		for _, id := range ids {
+			pending.ids[id] = struct{}{}
+		}
+	}()
+	pending.usem.set()
+}
+
+/*
+ * Take and clear the set of course IDs. The result is sorted so that
+ * messages are deterministic.
+ */
+func (pending *pendingCoursesT) take() []int {
+	pending.lock.Lock()
+	defer pending.lock.Unlock()
+	ids := make([]int, 0, len(pending.ids))
+	for id := range pending.ids {
+		ids = append(ids, id)
+	}
+	clear(pending.ids)
+	slices.Sort(ids)
+	return ids
+}
+
+var pendingPool sync.Map /* string, *pendingCoursesT */
+
+var dirtyCourses = struct {
+	lock sync.Mutex
+	ids  map[int]struct{}
+}{ids: make(map[int]struct{})} //exhaustruct:ignore
+
+func markCourseDirty(courseID int) {
+	dirtyCourses.lock.Lock()
+	defer dirtyCourses.lock.Unlock()
+	dirtyCourses.ids[courseID] = struct{}{}
+}
+
+func takeDirtyCourses() []int {
+	dirtyCourses.lock.Lock()
+	defer dirtyCourses.lock.Unlock()
+	if len(dirtyCourses.ids) == 0 {
+		return nil
+	}
+	ids := make([]int, 0, len(dirtyCourses.ids))
+	for id := range dirtyCourses.ids {
+		ids = append(ids, id)
+	}
+	clear(dirtyCourses.ids)
+	return ids
+}
+
+/*
+ * This should be run in its own goroutine after the configuration has been
+ * loaded.
+ */
+func runBroadcaster() {
+	ticker := time.NewTicker(
+		time.Duration(config().Perf.BroadcastInterval) * time.Millisecond,
+	)
+	defer ticker.Stop()
+	for range ticker.C {
+		func() {
+			defer func() {
+				if e := recover(); e != nil {
+					slog.Error("panic", "arg", e)
+				}
+			}()
+			ids := takeDirtyCourses()
+			if ids == nil {
+				return
+			}
+			pendingPool.Range(func(_, value interface{}) bool {
+				pending, ok := value.(*pendingCoursesT)
+				if !ok {
+					slog.Error(errType.Error())
+					return false
+				}
+				pending.add(ids)
+				return true
+			})
+		}()
+	}
+}
+
+/*
+ * Send the current selected counts of the given courses.
+ */
+func sendSelectedUpdates(
+	ctx context.Context,
+	conn *websocket.Conn,
+	courseIDs []int,
+) error {
+	list := make([]*courseT, 0, len(courseIDs))
+	seats := make([]seatsT, 0, len(courseIDs))
+	for _, courseID := range courseIDs {
+		_course, ok := courses.Load(courseID)
+		if !ok {
+			/*
+			 * Courses may be replaced between marking and
+			 * sending; skip the ones that no longer exist.
+			 */
+			continue
+		}
+		course, ok := _course.(*courseT)
+		if !ok {
+			return errType
+		}
+		if course == nil {
+			continue
+		}
+		list = append(list, course)
+		seats = append(seats, course.loadSeats())
+	}
+	return writeSeats(ctx, conn, list, seats)
+}
+
+/*
+ * Send the given seats taken in the given courses in one message, of the form
+ * "M <id> <count> [<id> <count> ...]", followed by the seats taken by female
+ * and by male students in those that are limited by legal sex, if any, in
+ * one message of the form "Q <id> <female> <male> [<id> <female> <male> ...]",
+ * and then the seats taken under each quota of those that have quotas, if
+ * any, in one message of the form
+ * "P <id> <yeargroup> <count> [<id> <yeargroup> <count> ...]".
+ */
+func writeSeats(
+	ctx context.Context,
+	conn *websocket.Conn,
+	list []*courseT,
+	seats []seatsT,
+) error {
+	if len(list) == 0 {
+		return nil
+	}
+	var m, q, p strings.Builder
+	m.WriteString("M")
+	q.WriteString("Q")
+	p.WriteString("P")
+	for i, course := range list {
+		m.WriteString(" ")
+		m.WriteString(strconv.Itoa(course.ID))
+		m.WriteString(" ")
+		m.WriteString(strconv.FormatUint(uint64(seats[i].Total), 10))
+		for _, yearGroup := range course.QuotaYearGroups() {
+			p.WriteString(" ")
+			p.WriteString(strconv.Itoa(course.ID))
+			p.WriteString(" ")
+			p.WriteString(yearGroup)
+			p.WriteString(" ")
+			p.WriteString(strconv.FormatUint(uint64(seats[i].Quotas[yearGroup]), 10))
+		}
+		if !course.sexLimited() {
+			continue
+		}
+		q.WriteString(" ")
+		q.WriteString(strconv.Itoa(course.ID))
+		q.WriteString(" ")
+		q.WriteString(strconv.FormatUint(uint64(seats[i].F), 10))
+		q.WriteString(" ")
+		q.WriteString(strconv.FormatUint(uint64(seats[i].M), 10))
+	}
+	err := writeText(ctx, conn, m.String())
+	if err != nil {
+		return fmt.Errorf(
+			"error sending to websocket for course selected update: %w",
+			err,
+		)
+	}
+	for _, sb := range []*strings.Builder{&q, &p} {
+		if sb.Len() == 1 {
+			continue
+		}
+		err = writeText(ctx, conn, sb.String())
+		if err != nil {
+			return fmt.Errorf(
+				"error sending to websocket for course selected update: %w",
+				err,
+			)
+		}
+	}
+	return nil
+}
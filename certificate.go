@@ -0,0 +1,116 @@
+/*
+ * TLS certificate reloading
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * The certificate is loaded at startup and again on SIGHUP, or when the
+ * certificate or key file changes, so that renewals need no restart. If the
+ * new files cannot be loaded, we keep serving the old certificate.
+ */
+
+const certificateCheckInterval = time.Minute
+
+var certificate atomic.Pointer[tls.Certificate]
+
+var certificateReload struct {
+	lock sync.Mutex
+	/* What the files looked like when we last tried to load them */
+	stamp string
+}
+
+/*
+ * Describe the current certificate and key files, so that we can tell when
+ * they change. os.Stat follows symbolic links, which is how certbot
+ * replaces certificates.
+ */
+func certificateStamp() (string, error) {
+	certInfo, err := os.Stat(config().Listen.TLS.Cert)
+	if err != nil {
+		return "", err
+	}
+	keyInfo, err := os.Stat(config().Listen.TLS.Key)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(
+		"%d %d %d %d",
+		certInfo.ModTime().UnixNano(), certInfo.Size(),
+		keyInfo.ModTime().UnixNano(), keyInfo.Size(),
+	), nil
+}
+
+func loadCertificate() error {
+	certificateReload.lock.Lock()
+	defer certificateReload.lock.Unlock()
+
+	stamp, err := certificateStamp()
+	if err != nil {
+		return err
+	}
+	certificateReload.stamp = stamp
+
+	cer, err := tls.LoadX509KeyPair(
+		config().Listen.TLS.Cert,
+		config().Listen.TLS.Key,
+	)
+	if err != nil {
+		return err
+	}
+	certificate.Store(&cer)
+	if cer.Leaf != nil {
+		slog.Info(
+			"loaded certificate",
+			"subject", cer.Leaf.Subject.String(),
+			"expires", cer.Leaf.NotAfter,
+		)
+	}
+	return nil
+}
+
+func getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return certificate.Load(), nil
+}
+
+func reloadCertificate() {
+	err := loadCertificate()
+	if err != nil {
+		slog.Error("reload certificate, keeping the old one", "error", err)
+	}
+}
+
+/*
+ * Reload the certificate whenever its files change. This should be run in
+ * its own goroutine.
+ */
+func watchCertificate() {
+	for {
+		time.Sleep(certificateCheckInterval)
+
+		stamp, err := certificateStamp()
+		if err != nil {
+			/* Probably in the middle of being replaced */
+			continue
+		}
+		certificateReload.lock.Lock()
+		changed := stamp != certificateReload.stamp
+		certificateReload.lock.Unlock()
+		if changed {
+			reloadCertificate()
+		}
+	}
+}
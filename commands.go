@@ -0,0 +1,26 @@
+/*
+ * Subcommands
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+/*
+ * Running cca without arguments starts the server. Otherwise, the first
+ * argument after the flags names one of these subcommands, which receives the
+ * remaining arguments. Subcommands run after the configuration is loaded, but
+ * must set up anything else they need themselves.
+ */
+var subcommands = map[string]func(args []string) error{
+	"migrate":         cmdMigrate,
+	"loadtest":        cmdLoadtest,
+	"config":          cmdConfig,
+	"import-courses":  cmdImportCourses,
+	"import-students": cmdImportStudents,
+	"set-state":       cmdSetState,
+	"set-schedule":    cmdSetSchedule,
+	"export":          cmdExport,
+	"reconcile":       cmdReconcile,
+}
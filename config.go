@@ -8,295 +8,430 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
+	"log/slog"
+	"net/netip"
 	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"codeberg.org/emersion/go-scfg"
 )
 
 /*
- * We use two structs. The first has all of its values as pointers, and scfg
- * unmarshals the configuration to it. Then we take each value, dereference
- * it, and throw it into a normal config struct without pointers, reporting
- * missing values.
- * We should probably use reflection instead. This is stupid.
+ * The configuration is read into configT by walking its fields. Each field
+ * is tagged with the name of its directive in scfg, and optionally with:
+ *
+ *   required:"true"  the value must be given;
+ *   default:"..."    the value to use if it is not;
+ *   min:"..."        the smallest value allowed, for integers;
+ *   max:"..."        the largest value allowed, for integers;
+ *   secret:"true"    the value is redacted by "cca config check".
+ *
+ * A value that is neither required nor has a default is left as the zero
+ * value if missing. Any value other than a block may be overridden by an
+ * environment variable named after its path, such as CCA_DB_CONN for
+ * db.conn, which is useful for secrets. Fields without an scfg tag are not
+ * read at all, but worked out from the others by validateConfig.
+ *
+ * Directives that have been removed are listed in deprecatedConfigValues for
+ * a release or so, and are ignored with a warning rather than rejected, so
+ * that existing configuration files still load.
  */
-
-var configWithPointers struct {
-	URL    *string `scfg:"url"`
-	Prod   *bool   `scfg:"prod"`
+type configT struct {
+	URL    string `scfg:"url" required:"true"`
+	Prod   bool   `scfg:"prod" required:"true"`
 	Listen struct {
-		Proto *string `scfg:"proto"`
-		Net   *string `scfg:"net"`
-		Addr  *string `scfg:"addr"`
-		Trans *string `scfg:"trans"`
+		Proto string `scfg:"proto" default:"http"`
+		Net   string `scfg:"net" required:"true"`
+		Addr  string `scfg:"addr" required:"true"`
+		Trans string `scfg:"trans" default:"plain"`
 		TLS   struct {
-			Cert *string `scfg:"cert"`
-			Key  *string `scfg:"key"`
+			Cert string `scfg:"cert"`
+			Key  string `scfg:"key"`
 		} `scfg:"tls"`
+		Unix struct {
+			Mode  string `scfg:"mode" default:"0660"`
+			Owner string `scfg:"owner"`
+			Group string `scfg:"group"`
+		} `scfg:"unix"`
+		TrustedProxies string `scfg:"trusted_proxies"`
+		/* Parsed from TrustedProxies; see remoteIP */
+		TrustedProxyPrefixes []netip.Prefix
+		TrustUnixProxy       bool
 	} `scfg:"listen"`
 	DB struct {
-		Type *string `scfg:"type"`
-		Conn *string `scfg:"conn"`
+		Type        string `scfg:"type" required:"true"`
+		Conn        string `scfg:"conn" required:"true" secret:"true"`
+		AutoMigrate bool   `scfg:"auto_migrate" default:"false"`
 	} `scfg:"db"`
 	Auth struct {
-		Client      *string            `scfg:"client"`
-		Authorize   *string            `scfg:"authorize"`
-		Jwks        *string            `scfg:"jwks"`
-		Token       *string            `scfg:"token"`
-		Expr        *int               `scfg:"expr"`
-		Departments *map[string]string `scfg:"depts"`
-		Udepts      *map[string]string `scfg:"udepts"`
+		Client      string            `scfg:"client" required:"true"`
+		Authorize   string            `scfg:"authorize" required:"true"`
+		Jwks        string            `scfg:"jwks" required:"true"`
+		Token       string            `scfg:"token" required:"true"`
+		Expr        int               `scfg:"expr" default:"604800" min:"1"`
+		Departments map[string]string `scfg:"depts" required:"true"`
+		Udepts      map[string]string `scfg:"udepts"`
+		Students    struct {
+			Claim          string         `scfg:"claim"`
+			Domain         string         `scfg:"domain"`
+			Pattern        string         `scfg:"pattern" default:"^[sS]([0-9]+)$"`
+			PatternRegexp  *regexp.Regexp /* compiled from Pattern */
+			RefuseUnlisted bool           `scfg:"refuse_unlisted" default:"false"`
+			Email          string         `scfg:"email" default:"s%d@ykpaoschool.cn"`
+		} `scfg:"students"`
 	} `scfg:"auth"`
 	Perf struct {
-		SendQ               *int  `scfg:"sendq"`
-		MessageArgumentsCap *int  `scfg:"msg_args_cap"`
-		MessageBytesCap     *int  `scfg:"msg_bytes_cap"`
-		ReadHeaderTimeout   *int  `scfg:"read_header_timeout"`
-		UsemDelayShiftBits  *int  `scfg:"usem_delay_shift_bits"`
-		PropagateImmediate  *bool `scfg:"propagate_immediate"`
+		SendQ               int  `scfg:"sendq" default:"10" min:"1" max:"10000"`
+		MessageArgumentsCap int  `scfg:"msg_args_cap" default:"4" min:"0" max:"64"`
+		MessageBytesCap     int  `scfg:"msg_bytes_cap" default:"5" min:"0" max:"1024"`
+		ReadHeaderTimeout   int  `scfg:"read_header_timeout" default:"5" min:"1"`
+		DrainTimeout        int  `scfg:"drain_timeout" default:"20" min:"0"`
+		BroadcastInterval   int  `scfg:"broadcast_interval" default:"200" min:"1"`
+		PropagateImmediate  bool `scfg:"propagate_immediate" default:"true"`
+		ReconcileInterval   int  `scfg:"reconcile_interval" default:"300" min:"0"`
 	} `scfg:"perf"`
+	Metrics struct {
+		Token string `scfg:"token" secret:"true"`
+		Net   string `scfg:"net" default:"tcp"`
+		Addr  string `scfg:"addr"`
+	} `scfg:"metrics"`
+	Admin struct {
+		Socket string `scfg:"socket"`
+	} `scfg:"admin"`
 	Req struct {
-		Y9 struct {
-			Sport    *int `scfg:"sport"`
-			NonSport *int `scfg:"non_sport"`
-		} `scfg:"y9"`
-		Y10 struct {
-			Sport    *int `scfg:"sport"`
-			NonSport *int `scfg:"non_sport"`
-		} `scfg:"y10"`
-		Y11 struct {
-			Sport    *int `scfg:"sport"`
-			NonSport *int `scfg:"non_sport"`
-		} `scfg:"y11"`
-		Y12 struct {
-			Sport    *int `scfg:"sport"`
-			NonSport *int `scfg:"non_sport"`
-		} `scfg:"y12"`
+		Y9  reqT `scfg:"y9"`
+		Y10 reqT `scfg:"y10"`
+		Y11 reqT `scfg:"y11"`
+		Y12 reqT `scfg:"y12"`
 	} `scfg:"req"`
 }
 
-var config struct {
-	URL    string
-	Prod   bool
-	Listen struct {
-		Proto string
-		Net   string
-		Addr  string
-		Trans string
-		TLS   struct {
-			Cert string
-			Key  string
-		}
-	}
-	DB struct {
-		Type string
-		Conn string
-	}
-	Auth struct {
-		Client      string
-		Authorize   string
-		Jwks        string
-		Token       string
-		Expr        int
-		Departments map[string]string
-		Udepts      map[string]string
-	}
-	Perf struct {
-		SendQ               int
-		MessageArgumentsCap int
-		MessageBytesCap     int
-		ReadHeaderTimeout   int
-		UsemDelayShiftBits  int
-		PropagateImmediate  bool
-	}
-	Req struct {
-		Y9 struct {
-			Sport    int
-			NonSport int
-		}
-		Y10 struct {
-			Sport    int
-			NonSport int
-		}
-		Y11 struct {
-			Sport    int
-			NonSport int
-		}
-		Y12 struct {
-			Sport    int
-			NonSport int
-		}
-	}
+/*
+ * What a year group must choose, and may choose at most. Maximums of 0 are
+ * none.
+ */
+type reqT struct {
+	Sport       int `scfg:"sport" required:"true" min:"0"`
+	NonSport    int `scfg:"non_sport" required:"true" min:"0"`
+	MaxSport    int `scfg:"max_sport" min:"0"`
+	MaxNonSport int `scfg:"max_non_sport" min:"0"`
+	MaxTotal    int `scfg:"max_total" min:"0"`
 }
 
-func fetchConfig(path string) (retErr error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return fmt.Errorf("open config: %w", err)
-	}
+/*
+ * The configuration in effect. Reloading replaces it as a whole, so a
+ * pointer obtained from config is never modified.
+ */
+var currentConfig atomic.Pointer[configT]
 
-	err = scfg.NewDecoder(bufio.NewReader(f)).Decode(&configWithPointers)
-	if err != nil {
-		return fmt.Errorf("decode config: %w", err)
-	}
+/* Where the configuration was read from, for reloading */
+var configPath string
 
-	if configWithPointers.URL == nil {
-		return fmt.Errorf("missing config value: url")
-	}
-	config.URL = *(configWithPointers.URL)
+func config() *configT {
+	return currentConfig.Load()
+}
 
-	if configWithPointers.Prod == nil {
-		return fmt.Errorf("missing config value: prod")
+func fetchConfig(path string) error {
+	c, err := parseConfig(path)
+	if err != nil {
+		return err
 	}
-	config.Prod = *(configWithPointers.Prod)
+	configPath = path
+	currentConfig.Store(c)
+	return nil
+}
 
-	if configWithPointers.Listen.Proto == nil {
-		return fmt.Errorf("missing config value: listen.proto")
+func parseConfig(path string) (*configT, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, wrapError(errCannotOpenConfig, err)
 	}
-	config.Listen.Proto = *(configWithPointers.Listen.Proto)
+	defer f.Close()
 
-	if configWithPointers.Listen.Net == nil {
-		return fmt.Errorf("missing config value: listen.net")
+	block, err := scfg.Read(f)
+	if err != nil {
+		return nil, wrapError(errCannotDecodeConfig, err)
 	}
-	config.Listen.Net = *(configWithPointers.Listen.Net)
 
-	if configWithPointers.Listen.Addr == nil {
-		return fmt.Errorf("missing config value: listen.addr")
+	var c configT
+	err = loadConfigBlock(block, reflect.ValueOf(&c).Elem(), "")
+	if err != nil {
+		return nil, err
 	}
-	config.Listen.Addr = *(configWithPointers.Listen.Addr)
 
-	if configWithPointers.Listen.Trans == nil {
-		return fmt.Errorf("missing config value: listen.trans")
+	err = validateConfig(&c)
+	if err != nil {
+		return nil, err
 	}
-	config.Listen.Trans = *(configWithPointers.Listen.Trans)
+	return &c, nil
+}
 
-	if config.Listen.Trans == "tls" {
-		if configWithPointers.Listen.TLS.Cert == nil {
-			return fmt.Errorf("missing config value: listen.tls.cert")
+/*
+ * Checks involving more than one value, which tags cannot express.
+ */
+func validateConfig(c *configT) error {
+	if c.Listen.Trans == "tls" {
+		if c.Listen.TLS.Cert == "" {
+			return wrapAny(errMissingConfigValue, "listen.tls.cert")
 		}
-		config.Listen.TLS.Cert = *(configWithPointers.Listen.TLS.Cert)
-
-		if configWithPointers.Listen.TLS.Key == nil {
-			return fmt.Errorf("missing config value: listen.tls.key")
+		if c.Listen.TLS.Key == "" {
+			return wrapAny(errMissingConfigValue, "listen.tls.key")
 		}
-		config.Listen.TLS.Key = *(configWithPointers.Listen.TLS.Key)
-	}
-
-	if configWithPointers.DB.Type == nil {
-		return fmt.Errorf("missing config value: db.type")
 	}
-	config.DB.Type = *(configWithPointers.DB.Type)
-
-	if configWithPointers.DB.Conn == nil {
-		return fmt.Errorf("missing config value: db.conn")
+	if c.Listen.Net == "unix" {
+		_, err := strconv.ParseUint(c.Listen.Unix.Mode, 8, 32)
+		if err != nil {
+			return wrapAny(errBadConfigValue, "listen.unix.mode: "+err.Error())
+		}
 	}
-	config.DB.Conn = *(configWithPointers.DB.Conn)
-
-	if configWithPointers.Auth.Client == nil {
-		return fmt.Errorf("missing config value: auth.client")
+	c.Listen.TrustedProxyPrefixes = nil
+	c.Listen.TrustUnixProxy = false
+	for _, field := range strings.Fields(c.Listen.TrustedProxies) {
+		if field == "unix" {
+			c.Listen.TrustUnixProxy = true
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return wrapAny(errBadConfigValue, "listen.trusted_proxies: "+field)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		c.Listen.TrustedProxyPrefixes = append(c.Listen.TrustedProxyPrefixes, prefix.Masked())
 	}
-	config.Auth.Client = *(configWithPointers.Auth.Client)
-
-	if configWithPointers.Auth.Authorize == nil {
-		return fmt.Errorf("missing config value: auth.authorize")
+	re, err := regexp.Compile(c.Auth.Students.Pattern)
+	if err != nil {
+		return wrapAny(errBadConfigValue, "auth.students.pattern: "+err.Error())
+	}
+	if re.NumSubexp() != 1 {
+		return wrapAny(errBadConfigValue, "auth.students.pattern must have exactly one group")
+	}
+	c.Auth.Students.PatternRegexp = re
+	if c.Auth.Students.Email != "" && strings.Count(c.Auth.Students.Email, "%d") != 1 {
+		return wrapAny(errBadConfigValue, "auth.students.email must have exactly one %d")
+	}
+	for _, yg := range []struct {
+		name string
+		req  reqT
+	}{
+		{"y9", c.Req.Y9},
+		{"y10", c.Req.Y10},
+		{"y11", c.Req.Y11},
+		{"y12", c.Req.Y12},
+	} {
+		name, req := yg.name, yg.req
+		if req.MaxSport != 0 && req.MaxSport < req.Sport {
+			return wrapAny(errBadConfigValue, "req."+name+".max_sport is less than req."+name+".sport")
+		}
+		if req.MaxNonSport != 0 && req.MaxNonSport < req.NonSport {
+			return wrapAny(errBadConfigValue, "req."+name+".max_non_sport is less than req."+name+".non_sport")
+		}
+		if req.MaxTotal != 0 && req.MaxTotal < req.Sport+req.NonSport {
+			return wrapAny(errBadConfigValue, "req."+name+".max_total is less than the courses required")
+		}
 	}
-	config.Auth.Authorize = *(configWithPointers.Auth.Authorize)
+	return nil
+}
 
-	if configWithPointers.Auth.Jwks == nil {
-		return fmt.Errorf("missing config value: auth.jwks")
-	}
-	config.Auth.Jwks = *(configWithPointers.Auth.Jwks)
+/*
+ * The environment variable that overrides the value at the given path.
+ */
+func configEnvName(path string) string {
+	return "CCA_" + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
 
-	if configWithPointers.Auth.Token == nil {
-		return fmt.Errorf("missing config value: auth.token")
-	}
-	config.Auth.Token = *(configWithPointers.Auth.Token)
+/*
+ * Removed directives, by path, with why they are no longer needed.
+ */
+var deprecatedConfigValues = map[string]string{
+	"perf.usem_delay_shift_bits": "selected counts are now batched by perf.broadcast_interval",
+}
 
-	if configWithPointers.Auth.Expr == nil {
-		return fmt.Errorf("missing config value: auth.expr")
-	}
-	config.Auth.Expr = *(configWithPointers.Auth.Expr)
+func loadConfigBlock(block scfg.Block, v reflect.Value, prefix string) error {
+	t := v.Type()
 
-	if configWithPointers.Auth.Departments == nil {
-		return fmt.Errorf("missing config value: auth.depts")
+	known := make(map[string]struct{}, t.NumField())
+	for i := range t.NumField() {
+		if name := t.Field(i).Tag.Get("scfg"); name != "" {
+			known[name] = struct{}{}
+		}
 	}
-	config.Auth.Departments = *(configWithPointers.Auth.Departments)
-	if config.Auth.Departments == nil {
-		return fmt.Errorf("missing config value: auth.depts")
+	for _, dir := range block {
+		if _, ok := known[dir.Name]; ok {
+			continue
+		}
+		if reason, ok := deprecatedConfigValues[prefix+dir.Name]; ok {
+			slog.Warn("ignoring deprecated configuration", "directive", prefix+dir.Name, "reason", reason)
+			continue
+		}
+		return wrapAny(errUnknownConfigValue, prefix+dir.Name)
 	}
 
-	if configWithPointers.Auth.Udepts == nil {
-		return fmt.Errorf("missing config value: auth.udepts")
-	}
-	config.Auth.Udepts = *(configWithPointers.Auth.Udepts)
-	if config.Auth.Udepts == nil {
-		return fmt.Errorf("missing config value: auth.udepts")
-	}
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name := field.Tag.Get("scfg")
+		if name == "" {
+			continue
+		}
+		path := prefix + name
 
-	if configWithPointers.Perf.SendQ == nil {
-		return fmt.Errorf("missing config value: perf.sendq")
-	}
-	config.Perf.SendQ = *(configWithPointers.Perf.SendQ)
+		dirs := block.GetAll(name)
+		if len(dirs) > 1 {
+			return wrapAny(errDuplicateConfigValue, path)
+		}
+		var dir *scfg.Directive
+		if len(dirs) == 1 {
+			dir = dirs[0]
+		}
 
-	if configWithPointers.Perf.MessageArgumentsCap == nil {
-		return fmt.Errorf("missing config value: perf.msg_args_cap")
+		fv := v.Field(i)
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			var children scfg.Block
+			if dir != nil {
+				children = dir.Children
+			}
+			err := loadConfigBlock(children, fv, path+".")
+			if err != nil {
+				return err
+			}
+		case reflect.Map:
+			if dir == nil {
+				if field.Tag.Get("required") == "true" {
+					return wrapAny(errMissingConfigValue, path)
+				}
+				fv.Set(reflect.MakeMap(field.Type))
+				continue
+			}
+			m := reflect.MakeMapWithSize(field.Type, len(dir.Children))
+			for _, child := range dir.Children {
+				if len(child.Params) != 1 {
+					return wrapAny(errBadConfigValue, path+"."+child.Name)
+				}
+				m.SetMapIndex(
+					reflect.ValueOf(child.Name),
+					reflect.ValueOf(child.Params[0]),
+				)
+			}
+			fv.Set(m)
+		default:
+			value, ok := os.LookupEnv(configEnvName(path))
+			if !ok && dir != nil {
+				if len(dir.Params) != 1 || len(dir.Children) != 0 {
+					return wrapAny(errBadConfigValue, path)
+				}
+				value, ok = dir.Params[0], true
+			}
+			if !ok {
+				value, ok = field.Tag.Lookup("default")
+			}
+			if !ok {
+				if field.Tag.Get("required") == "true" {
+					return wrapAny(errMissingConfigValue, path)
+				}
+				continue
+			}
+			err := setConfigValue(fv, field, value, path)
+			if err != nil {
+				return err
+			}
+		}
 	}
-	config.Perf.MessageArgumentsCap = *(configWithPointers.Perf.MessageArgumentsCap)
 
-	if configWithPointers.Perf.MessageBytesCap == nil {
-		return fmt.Errorf("missing config value: perf.msg_bytes_cap")
-	}
-	config.Perf.MessageBytesCap = *(configWithPointers.Perf.MessageBytesCap)
+	return nil
+}
 
-	if configWithPointers.Perf.ReadHeaderTimeout == nil {
-		return fmt.Errorf("missing config value: perf.read_header_timeout")
+func setConfigValue(fv reflect.Value, field reflect.StructField, value, path string) error {
+	switch field.Type.Kind() {
+	case reflect.String:
+		fv.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return wrapAny(errBadConfigValue, path+": "+err.Error())
+		}
+		fv.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return wrapAny(errBadConfigValue, path+": "+err.Error())
+		}
+		if limit, ok := field.Tag.Lookup("min"); ok {
+			if m, _ := strconv.Atoi(limit); n < m {
+				return wrapAny(errConfigValueOutOfRange, fmt.Sprintf("%s must be at least %d", path, m))
+			}
+		}
+		if limit, ok := field.Tag.Lookup("max"); ok {
+			if m, _ := strconv.Atoi(limit); n > m {
+				return wrapAny(errConfigValueOutOfRange, fmt.Sprintf("%s must be at most %d", path, m))
+			}
+		}
+		fv.SetInt(int64(n))
+	default:
+		return wrapAny(errType, path)
 	}
-	config.Perf.ReadHeaderTimeout = *(configWithPointers.Perf.ReadHeaderTimeout)
+	return nil
+}
 
-	if configWithPointers.Perf.UsemDelayShiftBits == nil {
-		return fmt.Errorf("missing config value: perf.usem_delay_shift_bits")
-	}
-	config.Perf.UsemDelayShiftBits = *(configWithPointers.Perf.UsemDelayShiftBits)
+const redacted = "[redacted]"
 
-	if configWithPointers.Perf.PropagateImmediate == nil {
-		return fmt.Errorf("missing config value: perf.propagate_immediate")
+/*
+ * Turn a configuration back into scfg, for "cca config check".
+ */
+func dumpConfigBlock(v reflect.Value) scfg.Block {
+	t := v.Type()
+	block := make(scfg.Block, 0, t.NumField())
+	for i := range t.NumField() {
+		field := t.Field(i)
+		fv := v.Field(i)
+		if field.Tag.Get("scfg") == "" {
+			continue
+		}
+		dir := &scfg.Directive{Name: field.Tag.Get("scfg")} //exhaustruct:ignore
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			dir.Children = dumpConfigBlock(fv)
+		case reflect.Map:
+			keys := make([]string, 0, fv.Len())
+			for _, key := range fv.MapKeys() {
+				keys = append(keys, key.String())
+			}
+			slices.Sort(keys)
+			for _, key := range keys {
+				dir.Children = append(dir.Children, &scfg.Directive{
+					Name:   key,
+					Params: []string{fv.MapIndex(reflect.ValueOf(key)).String()},
+				}) //exhaustruct:ignore
+			}
+		default:
+			value := fmt.Sprint(fv.Interface())
+			if field.Tag.Get("secret") == "true" && value != "" {
+				value = redacted
+			}
+			dir.Params = []string{value}
+		}
+		block = append(block, dir)
 	}
-	config.Perf.PropagateImmediate = *(configWithPointers.Perf.PropagateImmediate)
+	return block
+}
 
-	if configWithPointers.Req.Y9.Sport == nil {
-		return fmt.Errorf("missing config value: req.y9.sport")
-	}
-	config.Req.Y9.Sport = *(configWithPointers.Req.Y9.Sport)
-	if configWithPointers.Req.Y9.NonSport == nil {
-		return fmt.Errorf("missing config value: req.y9.non_sport")
-	}
-	config.Req.Y9.NonSport = *(configWithPointers.Req.Y9.NonSport)
-	if configWithPointers.Req.Y10.Sport == nil {
-		return fmt.Errorf("missing config value: req.y10.sport")
-	}
-	config.Req.Y10.Sport = *(configWithPointers.Req.Y10.Sport)
-	if configWithPointers.Req.Y10.NonSport == nil {
-		return fmt.Errorf("missing config value: req.y10.non_sport")
-	}
-	config.Req.Y10.NonSport = *(configWithPointers.Req.Y10.NonSport)
-	if configWithPointers.Req.Y11.Sport == nil {
-		return fmt.Errorf("missing config value: req.y11.sport")
-	}
-	config.Req.Y11.Sport = *(configWithPointers.Req.Y11.Sport)
-	if configWithPointers.Req.Y11.NonSport == nil {
-		return fmt.Errorf("missing config value: req.y11.non_sport")
-	}
-	config.Req.Y11.NonSport = *(configWithPointers.Req.Y11.NonSport)
-	if configWithPointers.Req.Y12.Sport == nil {
-		return fmt.Errorf("missing config value: req.y12.sport")
-	}
-	config.Req.Y12.Sport = *(configWithPointers.Req.Y12.Sport)
-	if configWithPointers.Req.Y12.NonSport == nil {
-		return fmt.Errorf("missing config value: req.y12.non_sport")
+/*
+ * Validate the configuration and print it as it would take effect, with
+ * defaults and environment overrides applied and secrets redacted. The
+ * configuration has already been loaded by the time subcommands run, so
+ * reaching this point means it is valid.
+ */
+func cmdConfig(args []string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return errBadNumberOfArguments
 	}
-	config.Req.Y12.NonSport = *(configWithPointers.Req.Y12.NonSport)
-
-	return nil
+	return scfg.Write(os.Stdout, dumpConfigBlock(reflect.ValueOf(config()).Elem()))
 }
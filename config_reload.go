@@ -0,0 +1,127 @@
+/*
+ * Configuration reloading
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * On SIGHUP, or when staff ask on the diagnostics page, we re-read the
+ * configuration file. Settings that are only read when needed take effect
+ * right away. Settings that were used to set something up at startup, such
+ * as listeners and the database, keep their old values until the next
+ * restart, and we report which of them changed.
+ */
+
+type configReloadReportT struct {
+	Time time.Time
+	/* Settings that changed but need a restart to take effect */
+	Restart []string
+	Err     error
+}
+
+var lastConfigReload atomic.Pointer[configReloadReportT]
+
+/* Serializes reloads, which would otherwise lose each other's changes */
+var configReloadLock sync.Mutex
+
+/*
+ * Copy the settings that may change at runtime from src into dst.
+ */
+func copyReloadableConfig(dst, src *configT) {
+	dst.Auth.Expr = src.Auth.Expr
+	dst.Auth.Departments = src.Auth.Departments
+	dst.Auth.Udepts = src.Auth.Udepts
+	dst.Auth.Students = src.Auth.Students
+	dst.Perf.SendQ = src.Perf.SendQ
+	dst.Perf.MessageArgumentsCap = src.Perf.MessageArgumentsCap
+	dst.Perf.MessageBytesCap = src.Perf.MessageBytesCap
+	dst.Perf.DrainTimeout = src.Perf.DrainTimeout
+	dst.Perf.PropagateImmediate = src.Perf.PropagateImmediate
+	dst.Req = src.Req
+}
+
+/*
+ * List the settings that differ between current and updated and need a
+ * restart.
+ */
+func configNeedingRestart(current, updated *configT) []string {
+	var restart []string
+	check := func(name string, a, b any) {
+		if !reflect.DeepEqual(a, b) {
+			restart = append(restart, name)
+		}
+	}
+	check("url", current.URL, updated.URL)
+	check("prod", current.Prod, updated.Prod)
+	check("listen", current.Listen, updated.Listen)
+	check("db", current.DB, updated.DB)
+	check("auth.client", current.Auth.Client, updated.Auth.Client)
+	check("auth.authorize", current.Auth.Authorize, updated.Auth.Authorize)
+	check("auth.jwks", current.Auth.Jwks, updated.Auth.Jwks)
+	check("auth.token", current.Auth.Token, updated.Auth.Token)
+	check("perf.read_header_timeout", current.Perf.ReadHeaderTimeout, updated.Perf.ReadHeaderTimeout)
+	check("perf.broadcast_interval", current.Perf.BroadcastInterval, updated.Perf.BroadcastInterval)
+	check("perf.reconcile_interval", current.Perf.ReconcileInterval, updated.Perf.ReconcileInterval)
+	check("metrics", current.Metrics, updated.Metrics)
+	check("admin", current.Admin, updated.Admin)
+	return restart
+}
+
+/*
+ * The actor is the ID of the staff member who asked for the reload, for the
+ * audit log, or an empty string for SIGHUP.
+ */
+func reloadConfig(ctx context.Context, actor string) (report configReloadReportT) {
+	configReloadLock.Lock()
+	defer configReloadLock.Unlock()
+
+	report.Time = time.Now()
+	defer func() {
+		lastConfigReload.Store(&report)
+		outcome, detail := auditOK, ""
+		if report.Err != nil {
+			outcome, detail = auditRejected, report.Err.Error()
+			slog.Error("reload config", "error", report.Err)
+		} else if len(report.Restart) > 0 {
+			detail = "restart needed for " + strings.Join(report.Restart, ", ")
+			slog.Warn("reload config", "restart_needed", report.Restart)
+		} else {
+			slog.Info("reloaded config")
+		}
+		err := db.Audit(ctx, auditEntryT{
+			Actor:   actor,
+			Action:  auditReloadConfig,
+			Outcome: outcome,
+			Detail:  detail,
+		}) //exhaustruct:ignore
+		if err != nil {
+			slog.Error("audit", "error", err)
+		}
+	}()
+
+	updated, err := parseConfig(configPath)
+	if err != nil {
+		report.Err = err
+		return report
+	}
+
+	current := config()
+	merged := *current
+	copyReloadableConfig(&merged, updated)
+	report.Restart = configNeedingRestart(current, updated)
+	currentConfig.Store(&merged)
+	return report
+}
@@ -0,0 +1,94 @@
+/*
+ * Tests of configuration checking
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"codeberg.org/emersion/go-scfg"
+)
+
+func TestConfigLimits(t *testing.T) {
+	perf := reflect.TypeOf(configT{}.Perf) //exhaustruct:ignore
+	for _, tc := range []struct {
+		field string
+		value string
+		ok    bool
+	}{
+		{"SendQ", "0", false},
+		{"SendQ", "1", true},
+		{"SendQ", "10000", true},
+		{"SendQ", "10001", false},
+		{"MessageArgumentsCap", "64", true},
+		{"MessageArgumentsCap", "65", false},
+		{"MessageBytesCap", "1024", true},
+		{"MessageBytesCap", "1025", false},
+		{"ReconcileInterval", "1000000", true},
+	} {
+		field, ok := perf.FieldByName(tc.field)
+		if !ok {
+			t.Fatalf("no field %s", tc.field)
+		}
+		var n int
+		err := setConfigValue(reflect.ValueOf(&n).Elem(), field, tc.value, "perf."+tc.field)
+		switch {
+		case tc.ok && err != nil:
+			t.Errorf("%s %s: %v", tc.field, tc.value, err)
+		case !tc.ok && !errors.Is(err, errConfigValueOutOfRange):
+			t.Errorf("%s %s: got %v, want out of range", tc.field, tc.value, err)
+		}
+	}
+}
+
+func TestValidateConfigMaximums(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		req  reqT
+		ok   bool
+	}{
+		{"no maximums", reqT{Sport: 1, NonSport: 2}, true},
+		{"maximums at the minimums", reqT{Sport: 1, NonSport: 2, MaxSport: 1, MaxNonSport: 2, MaxTotal: 3}, true},
+		{"sport below", reqT{Sport: 2, NonSport: 1, MaxSport: 1}, false},
+		{"non-sport below", reqT{Sport: 1, NonSport: 2, MaxNonSport: 1}, false},
+		{"total below", reqT{Sport: 1, NonSport: 2, MaxTotal: 2}, false},
+	} {
+		var c configT
+		c.Auth.Students.Pattern = `^[sS]([0-9]+)$`
+		c.Req.Y11 = tc.req
+		err := validateConfig(&c)
+		switch {
+		case tc.ok && err != nil:
+			t.Errorf("%s: %v", tc.desc, err)
+		case !tc.ok && !errors.Is(err, errBadConfigValue):
+			t.Errorf("%s: got %v, want a bad value", tc.desc, err)
+		}
+	}
+}
+
+func TestDeprecatedConfig(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		want   error
+	}{
+		{"usem_delay_shift_bits 5", nil},
+		{"usem_delay_shift_bit 5", errUnknownConfigValue},
+	} {
+		block, err := scfg.Read(strings.NewReader(tc.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c configT
+		err = loadConfigBlock(block, reflect.ValueOf(&c.Perf).Elem(), "perf.")
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.config, err, tc.want)
+		}
+	}
+}
@@ -16,13 +16,9 @@ func getConfirmedStatus(
 	ctx context.Context,
 	userID string,
 ) (confirmed bool, retErr error) {
-	err := db.QueryRow(
-		ctx,
-		"SELECT confirmed FROM users WHERE id = $1",
-		userID,
-	).Scan(&confirmed)
+	user, err := db.GetUser(ctx, userID)
 	if err != nil {
 		retErr = fmt.Errorf("get confirmed status: %w", err)
 	}
-	return
+	return user.Confirmed, retErr
 }
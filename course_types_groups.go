@@ -31,49 +31,100 @@ func checkCourseType(ct string) bool {
 
 type userCourseTypesT map[string]int
 
-func getCourseTypeMinimumForYearGroup(yearGroup, courseType string) (int, error) {
+/*
+ * The number of courses of each type among those given.
+ */
+func countCourseTypes(chosen []*courseT) userCourseTypesT {
+	result := make(userCourseTypesT)
+	for _, course := range chosen {
+		result[course.Type]++
+	}
+	return result
+}
+
+func getYearGroupReq(yearGroup string) (reqT, error) {
 	switch yearGroup {
 	case "Y9":
-		switch courseType {
-		case sport:
-			return config.Req.Y9.Sport, nil
-		case nonSport:
-			return config.Req.Y9.NonSport, nil
-		default:
-			return 0, fmt.Errorf("invalid course type: %v", courseType)
-		}
+		return config().Req.Y9, nil
 	case "Y10":
-		switch courseType {
-		case sport:
-			return config.Req.Y10.Sport, nil
-		case nonSport:
-			return config.Req.Y10.NonSport, nil
-		default:
-			return 0, fmt.Errorf("invalid course type: %v", courseType)
-		}
+		return config().Req.Y10, nil
 	case "Y11":
-		switch courseType {
-		case sport:
-			return config.Req.Y11.Sport, nil
-		case nonSport:
-			return config.Req.Y11.NonSport, nil
-		default:
-			return 0, fmt.Errorf("invalid course type: %v", courseType)
-		}
+		return config().Req.Y11, nil
 	case "Y12":
-		switch courseType {
-		case sport:
-			return config.Req.Y12.Sport, nil
-		case nonSport:
-			return config.Req.Y12.NonSport, nil
-		default:
-			return 0, fmt.Errorf("invalid course type: %v", courseType)
-		}
+		return config().Req.Y12, nil
+	default:
+		return reqT{}, fmt.Errorf("invalid year group: %v", yearGroup) //exhaustruct:ignore
+	}
+}
+
+func getCourseTypeMinimumForYearGroup(yearGroup, courseType string) (int, error) {
+	req, err := getYearGroupReq(yearGroup)
+	if err != nil {
+		return 0, err
+	}
+	switch courseType {
+	case sport:
+		return req.Sport, nil
+	case nonSport:
+		return req.NonSport, nil
 	default:
-		return 0, fmt.Errorf("invalid year group: %v", yearGroup)
+		return 0, fmt.Errorf("invalid course type: %v", courseType)
 	}
 }
 
+/*
+ * The most courses of the type a year group may choose, or 0 if there is no
+ * maximum.
+ */
+func getCourseTypeMaximumForYearGroup(yearGroup, courseType string) (int, error) {
+	req, err := getYearGroupReq(yearGroup)
+	if err != nil {
+		return 0, err
+	}
+	switch courseType {
+	case sport:
+		return req.MaxSport, nil
+	case nonSport:
+		return req.MaxNonSport, nil
+	default:
+		return 0, fmt.Errorf("invalid course type: %v", courseType)
+	}
+}
+
+/*
+ * Whether the year group has any maximum on the courses chosen.
+ */
+func (req reqT) hasMaximums() bool {
+	return req.MaxSport != 0 || req.MaxNonSport != 0 || req.MaxTotal != 0
+}
+
+/*
+ * Why a student in the year group, who has chosen courses of each type as
+ * given, may not choose another of the type, as the rejection to count and
+ * the reason to give them, or empty strings if they may.
+ */
+func checkMaximums(yearGroup, courseType string, userCourseTypes userCourseTypesT) (string, string, error) {
+	maximum, err := getCourseTypeMaximumForYearGroup(yearGroup, courseType)
+	if err != nil {
+		return "", "", err
+	}
+	if maximum != 0 && userCourseTypes[courseType] >= maximum {
+		return rejectTypeMaximum, fmt.Sprintf("You may choose at most %d of type %s", maximum, courseType), nil
+	}
+	req, err := getYearGroupReq(yearGroup)
+	if err != nil {
+		return "", "", err
+	}
+	total := 0
+	for _, n := range userCourseTypes {
+		total += n
+	}
+	if req.MaxTotal != 0 && total >= req.MaxTotal {
+		return rejectTotalMaximum, fmt.Sprintf("You may choose at most %d courses", req.MaxTotal), nil
+	}
+	return "", "", nil
+}
+
 /* Course groups, e.g. MW1 */
 
 type userCourseGroupsT map[string]struct{}
@@ -101,48 +152,27 @@ var courseGroups = map[string]string{
 	tt3: "Tuesday/Thursday CCA3",
 }
 
-/* Populate both */
-
-func populateUserCourseTypesAndGroups(
+func populateUserCourseGroups(
 	ctx context.Context,
-	userCourseTypes *userCourseTypesT,
 	userCourseGroups *userCourseGroupsT,
 	userID string,
 ) error {
-	rows, err := db.Query(
-		ctx,
-		"SELECT courseid FROM choices WHERE userid = $1",
-		userID,
-	)
+	choices, err := db.GetUserChoices(ctx, userID)
 	if err != nil {
 		return fmt.Errorf("get user choices: %w", err)
 	}
-	for {
-		if !rows.Next() {
-			err := rows.Err()
-			if err != nil {
-				return fmt.Errorf("read next user choice: %w", err)
-			}
-			break
-		}
-		var thisCourseID int
-		err := rows.Scan(&thisCourseID)
-		if err != nil {
-			return fmt.Errorf("scan user choice: %w", err)
-		}
-		var thisGroupName, thisTypeName string
+	for _, thisCourseID := range choices {
+		var thisGroupName string
 		_course, ok := courses.Load(thisCourseID)
 		if !ok {
 			return fmt.Errorf("unknown course in user choice: %v", thisCourseID)
 		}
 		course := _course.(*courseT)
 		thisGroupName = course.Group
-		thisTypeName = course.Type
 		if _, ok := (*userCourseGroups)[thisGroupName]; ok {
 			return fmt.Errorf("duplicate group in user choices: user %v", userID)
 		}
 		(*userCourseGroups)[thisGroupName] = struct{}{}
-		(*userCourseTypes)[thisTypeName]++
 	}
 	return nil
 }
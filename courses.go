@@ -8,38 +8,56 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"fmt"
-	"log/slog"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
-
-	"github.com/coder/websocket"
+	"time"
 )
 
 type courseT struct {
 	/*
-	 * Selected is usually accessed atomically, but a lock is still
-	 * necessary as we need to sequentialize compare-with-Max-and-increment
-	 * operations.
+	 * Selected caches the selected count held in the courses table, which
+	 * is authoritative as several instances may share one database. It is
+	 * only updated through notifications (see notify.go), and it needs to
+	 * be accessed atomically.
 	 * We put Selected before other values to ensure 64-bit alignment on
 	 * all systems, because it needs to be accessed atomically. See the
 	 * "Bugs" section of sync/atomic.
 	 */
-	Selected     uint32 /* atomic */
-	SelectedLock sync.Mutex
-	ID           int
-	Max          uint32
-	Title        string
-	Type         string
-	Group        string
-	Teacher      string
-	Location     string
-	CourseID     string
-	SectionID    string
-	YearGroups   uint8
-	Usems        sync.Map /* string, *usemT */
+	Selected   uint32 /* atomic */
+	SelectedF  uint32 /* atomic, as for Selected */
+	SelectedM  uint32 /* atomic, as for Selected */
+	ID         int
+	Max        uint32
+	MaxF       uint32 /* both 0 if not limited by legal sex */
+	MaxM       uint32
+	Title      string
+	Type       string
+	Group      string
+	Teacher    string
+	Location   string
+	CourseID   string
+	SectionID  string
+	YearGroups uint8
+	/* Seats set aside for year groups, nil if there are none */
+	Quotas       map[string]*quotaT
+	QuotaRelease time.Time /* when Quotas stop applying, zero if never */
+	/* Who may choose the course beyond its year groups; see eligibility.go */
+	Students     map[int64]struct{} /* those invited, nil if anyone may */
+	ExclusionSet string             /* empty if none */
+	Requires     []string           /* Course IDs, nil if none */
+}
+
+/*
+ * The seats in a course set aside for a year group
+ */
+type quotaT struct {
+	Selected uint32 /* atomic, as for courseT.Selected */
+	Max      uint32
 }
 
 var courses sync.Map /* int, *courseT */
@@ -50,84 +68,43 @@ const staffDepartment = "Staff"
 
 /*
  * Read course information from the database. This should be called during
- * setup.
+ * setup, and may be called again later to replace the courses in memory;
+ * courses that no longer exist in the database are removed.
  */
 func setupCourses(ctx context.Context) error {
-	rows, err := db.Query(
-		ctx,
-		"SELECT id, nmax, title, ctype, cgroup, teacher, location, course_id, section_id, year_groups FROM courses",
-	)
+	list, err := db.GetCourses(ctx)
 	if err != nil {
 		return fmt.Errorf("get courses from database: %w", err)
 	}
 
-	for {
-		if !rows.Next() {
-			err := rows.Err()
-			if err != nil {
-				return fmt.Errorf("read next course: %w", err)
-			}
-			break
-		}
-		currentCourse := courseT{} //exhaustruct:ignore
-		err = rows.Scan(
-			&currentCourse.ID,
-			&currentCourse.Max,
-			&currentCourse.Title,
-			&currentCourse.Type,
-			&currentCourse.Group,
-			&currentCourse.Teacher,
-			&currentCourse.Location,
-			&currentCourse.CourseID,
-			&currentCourse.SectionID,
-			&currentCourse.YearGroups,
-		)
-		if err != nil {
-			return fmt.Errorf("scan course: %w", err)
-		}
-		if !checkCourseType(currentCourse.Type) {
-			return fmt.Errorf("invalid course type in database: %d %s", currentCourse.ID, currentCourse.Type)
-		}
-		if !checkCourseGroup(currentCourse.Group) {
-			return fmt.Errorf("invalid course group in database: %d %s", currentCourse.ID, currentCourse.Group)
+	newCourses := make(map[int]*courseT)
+	for _, course := range list {
+		if !checkCourseType(course.Type) {
+			return fmt.Errorf("invalid course type in database: %d %s", course.ID, course.Type)
 		}
-		err := db.QueryRow(
-			ctx,
-			"SELECT COUNT (*) FROM choices WHERE courseid = $1",
-			currentCourse.ID,
-		).Scan(&currentCourse.Selected)
-		if err != nil {
-			return fmt.Errorf("get selected count: %w", err)
+		if !checkCourseGroup(course.Group) {
+			return fmt.Errorf("invalid course group in database: %d %s", course.ID, course.Group)
 		}
-		courses.Store(currentCourse.ID, &currentCourse)
-		atomic.AddUint32(&numCourses, 1)
+		newCourses[course.ID] = course
 	}
 
-	return nil
-}
-
-func (course *courseT) decrementSelectedAndPropagate(
-	ctx context.Context,
-	conn *websocket.Conn,
-) error {
-	func() {
-		course.SelectedLock.Lock()
-		defer course.SelectedLock.Unlock()
-		atomic.AddUint32(&course.Selected, ^uint32(0))
-	}()
-	go func() {
-		defer func() {
-			if e := recover(); e != nil {
-				slog.Error("panic", "arg", e)
-			}
-		}()
-		propagateSelectedUpdate(course)
-	}()
-	err := sendSelectedUpdate(ctx, conn, course.ID)
-	if err != nil {
-		return fmt.Errorf("send selected update: %w", err)
+	for id, course := range newCourses {
+		courses.Store(id, course)
 	}
-	return nil
+	courses.Range(func(key, _ interface{}) bool {
+		id, ok := key.(int)
+		if !ok {
+			err = errType
+			return false
+		}
+		if _, ok := newCourses[id]; !ok {
+			courses.Delete(key)
+		}
+		return true
+	})
+	atomic.StoreUint32(&numCourses, uint32(len(newCourses)))
+
+	return err
 }
 
 var yearGroupsNumberBits = map[string]uint8{"Y9": 1, "Y10": 2, "Y11": 4, "Y12": 8}
@@ -150,3 +127,45 @@ func yearGroupsStringToNumber(s string) (uint8, error) {
 	}
 	return spec, nil
 }
+
+/*
+ * The inverse of yearGroupsStringToNumber, in ascending order, except that
+ * every year group is spelled out.
+ */
+func yearGroupsNumberToString(spec uint8) string {
+	yearGroups := make([]string, 0, len(yearGroupsNumberBits))
+	for yg, v := range yearGroupsNumberBits {
+		if spec&v != 0 {
+			yearGroups = append(yearGroups, yg)
+		}
+	}
+	sortYearGroups(yearGroups)
+	return strings.Join(yearGroups, " ")
+}
+
+func sortYearGroups(yearGroups []string) {
+	slices.SortFunc(yearGroups, func(a, b string) int {
+		return cmp.Compare(yearGroupsNumberBits[a], yearGroupsNumberBits[b])
+	})
+}
+
+/*
+ * The year groups with a quota in the course, in ascending order, for
+ * templates.
+ */
+func (course *courseT) QuotaYearGroups() []string {
+	yearGroups := getKeysOfMap(course.Quotas)
+	sortYearGroups(yearGroups)
+	return yearGroups
+}
+
+/*
+ * When the quotas of the course are released, in school time, or an empty
+ * string if never, for templates.
+ */
+func (course *courseT) QuotaReleaseText() string {
+	if course.QuotaRelease.IsZero() {
+		return ""
+	}
+	return course.QuotaRelease.In(loc).Format("2006-01-02 15:04")
+}
@@ -11,24 +11,417 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+ * Everything that touches the database goes through storeT, so that the rest
+ * of the program does not care which database it runs on. There is one
+ * implementation for PostgreSQL (db_postgres.go), which may be shared by
+ * several instances, and one for SQLite (db_sqlite.go), which is embedded and
+ * only suitable for a single instance. The memory store (db_memory.go) keeps
+ * nothing across restarts and is used by the tests.
+ *
+ * Methods that change something take the audit entry describing the change,
+ * and record it in the same transaction. Methods that change something other
+ * instances cache also send the corresponding notification (see notify.go)
+ * when the transaction commits.
+ */
+type storeT interface {
+	Close()
+	Ping(ctx context.Context) error
+	Stats() dbStatsT
+
+	/* The name of the backend, which is also the migrations directory */
+	Type() string
+	SchemaVersion(ctx context.Context) (int, error)
+	/* Returns false if the migration had already been applied */
+	ApplyMigration(ctx context.Context, m migrationT) (bool, error)
+
+	/*
+	 * Deliver notifications to handle until the context is canceled or
+	 * the connection breaks.
+	 */
+	Listen(ctx context.Context, handle func(ctx context.Context, payload string)) error
+	Notify(ctx context.Context, verb string, args ...string) error
+
+	GetCourses(ctx context.Context) ([]*courseT, error)
+	/*
+	 * Replace every course, which also removes every choice and
+	 * unconfirms every user.
+	 */
+	ReplaceCourses(ctx context.Context, courses []*courseT, entry auditEntryT) error
+
+	/* Insert the user, or update everything but confirmed if it exists */
+	UpsertUser(ctx context.Context, user userT) error
+	/* Returns errNoSuchUser if nobody has the session */
+	GetUserBySession(ctx context.Context, session string) (userT, error)
+	GetUser(ctx context.Context, userID string) (userT, error)
+	GetUsers(ctx context.Context) ([]userT, error)
+	SetConfirmed(ctx context.Context, userID string, confirmed bool, entry auditEntryT) error
+
+	GetChoices(ctx context.Context) ([]choiceT, error)
+	GetUserChoices(ctx context.Context, userID string) ([]int, error)
+	/*
+	 * Choose and Unchoose update the choices table and the selected count
+	 * of the course atomically, audit the attempt whatever the outcome,
+	 * and return the new selected counts. The legal sex of the student
+	 * choosing, which is empty if unknown, and their year group are
+	 * recorded with the choice.
+	 */
+	Choose(ctx context.Context, userID string, courseID int, legalSex string, yearGroup string) (chooseResultT, seatsT, error)
+	Unchoose(ctx context.Context, userID string, courseID int) (bool, seatsT, error)
+	Recount(ctx context.Context, check recountFuncT) error
+
+	/* A year group that has no state yet is created as disabled */
+	LoadState(ctx context.Context, yeargroup string) (uint32, time.Time, error)
+	SetState(ctx context.Context, yeargroup string, state uint32, entry auditEntryT) error
+	/*
+	 * OpenScheduled enables a year group if it is still scheduled, and
+	 * only then audits and notifies, so that when several instances reach
+	 * the schedule at once only one of them opens it. It returns whether
+	 * the year group was opened.
+	 */
+	OpenScheduled(ctx context.Context, yeargroup string, entry auditEntryT) (bool, error)
+	SetSchedule(ctx context.Context, yeargroup string, schedule time.Time, entry auditEntryT) error
+
+	GetExpectedStudents(ctx context.Context) ([]expectedStudentT, error)
+	/*
+	 * ReplaceExpectedStudents also moves users whose number is on the new
+	 * roster into the year group it gives them, if it gives one.
+	 */
+	ReplaceExpectedStudents(ctx context.Context, students []expectedStudentT, entry auditEntryT) error
+
+	Audit(ctx context.Context, entry auditEntryT) error
+	QueryAudit(ctx context.Context, filter auditFilterT) ([]auditEntryT, map[string]string, error)
+}
+
+var db storeT
+
+/*
+ * Connection pool statistics, for metrics
+ */
+type dbStatsT struct {
+	Total    int
+	InUse    int
+	Idle     int
+	Max      int
+	Waits    int64 /* acquisitions that had to wait for a connection */
+	WaitTime time.Duration
+}
+
+type userT struct {
+	ID         string
+	Name       string
+	Email      string
+	Department string
+	Session    string
+	Expr       int64 /* seconds */
+	Confirmed  bool
+	StudentID  int64 /* 0 if unknown, as for staff */
+	/* As the sign-in token said, which the roster may overrule */
+	ClaimedDepartment string
+}
+
+type choiceT struct {
+	UserID   string
+	CourseID int
+	Seltime  int64 /* microseconds */
+}
+
+type expectedStudentT struct {
+	ID        int64
+	Name      string
+	LegalSex  string
+	YearGroup string /* empty if the roster does not say */
+}
+
+/*
+ * The seats taken in a course, altogether, by the legal sex of the students
+ * who took them, and by their year group for those with a quota. Students
+ * whose legal sex was unknown when they chose are only counted in Total.
+ */
+type seatsT struct {
+	Total  uint32
+	F      uint32
+	M      uint32
+	Quotas map[string]uint32 /* nil if the course has no quotas */
+}
+
+type chooseResultT int
+
+const (
+	chooseOK chooseResultT = iota
+	chooseAlready
+	chooseFull
+	chooseSexFull    /* no seats left for the student's legal sex */
+	chooseSexUnknown /* the course is limited by legal sex, but theirs is unknown */
+	chooseQuotaFull  /* the quota of the student's year group is full */
+	chooseSeatsHeld  /* the seats left are held for other year groups */
+)
+
+/*
+ * Recount calls this for each course while changes to it are held off, with
+ * the seats counted from the rows in choices and the selected counts in the
+ * courses table. If it returns true, the selected counts are set to those
+ * from choices, the returned entry is audited, and the new counts are
+ * announced.
+ */
+type recountFuncT func(courseID int, title string, choices, column seatsT) (auditEntryT, bool)
+
+type recountRowT struct {
+	ID      int
+	Title   string
+	Column  seatsT
+	Choices seatsT /* not selected, filled in separately */
+}
+
+/*
+ * Choose and Unchoose of each backend return these from their transactions
+ * when the choice is rejected, and hand the result to chooseResult or
+ * unchooseResult, which audit the rejection now that it has been rolled
+ * back.
+ */
+func chooseResult(
+	ctx context.Context,
+	s storeT,
+	userID string,
+	courseID int,
+	err error,
+) (chooseResultT, error) {
+	switch {
+	case err == nil:
+		return chooseOK, nil
+	case errors.Is(err, errUniqueViolation):
+		return chooseAlready, s.Audit(ctx, selfEntry(userID, auditChoose, courseID, auditNoop, "Already chosen"))
+	case errors.Is(err, errCourseFull):
+		return chooseFull, s.Audit(ctx, selfEntry(userID, auditChoose, courseID, auditRejected, "Full"))
+	case errors.Is(err, errSexFull):
+		return chooseSexFull, s.Audit(ctx, selfEntry(userID, auditChoose, courseID, auditRejected, err.Error()))
+	case errors.Is(err, errLegalSexUnknown):
+		return chooseSexUnknown, s.Audit(ctx, selfEntry(userID, auditChoose, courseID, auditRejected, "Legal sex unknown"))
+	case errors.Is(err, errQuotaFull):
+		return chooseQuotaFull, s.Audit(ctx, selfEntry(userID, auditChoose, courseID, auditRejected, err.Error()))
+	case errors.Is(err, errSeatsHeld):
+		return chooseSeatsHeld, s.Audit(ctx, selfEntry(userID, auditChoose, courseID, auditRejected, "Seats held for other year groups"))
+	default:
+		return chooseOK, err
+	}
+}
+
+func unchooseResult(
+	ctx context.Context,
+	s storeT,
+	userID string,
+	courseID int,
+	err error,
+) (bool, error) {
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, errNotChosen):
+		return false, s.Audit(ctx, selfEntry(userID, auditUnchoose, courseID, auditNoop, "Not chosen"))
+	default:
+		return false, err
+	}
+}
+
+/*
+ * Both pgx and database/sql rows have this.
+ */
+type scannerT interface {
+	Scan(dest ...any) error
+}
+
+const selectCourses = "SELECT id, nmax, selected, title, ctype, cgroup, teacher, location, course_id, section_id, year_groups, nmax_f, nmax_m, selected_f, selected_m, quota_release, students, exclusion_set, requires FROM courses"
+
+func scanCourse(row scannerT) (*courseT, error) {
+	course := courseT{} //exhaustruct:ignore
+	var quotaRelease int64
+	var students, requires string
+	err := row.Scan(
+		&course.ID,
+		&course.Max,
+		&course.Selected,
+		&course.Title,
+		&course.Type,
+		&course.Group,
+		&course.Teacher,
+		&course.Location,
+		&course.CourseID,
+		&course.SectionID,
+		&course.YearGroups,
+		&course.MaxF,
+		&course.MaxM,
+		&course.SelectedF,
+		&course.SelectedM,
+		&quotaRelease,
+		&students,
+		&course.ExclusionSet,
+		&requires,
+	)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	course.QuotaRelease = unixOrZero(quotaRelease)
+	course.Students, err = parseStudentIDs(students)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	course.Requires = strings.Fields(requires)
+	if len(course.Requires) == 0 {
+		course.Requires = nil
+	}
+	return &course, nil
+}
+
+/*
+ * Quota release times are stored as Unix seconds, and 0 if never.
+ */
+func unixOrZero(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+func zeroOrUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+/*
+ * Both pgx and database/sql rows have this.
+ */
+type rowsT interface {
+	scannerT
+	Next() bool
+	Err() error
+}
 
-	"github.com/jackc/pgx/v5/pgxpool"
+const selectQuotas = "SELECT courseid, yeargroup, nmax, selected FROM quotas"
+
+/*
+ * Read the quotas selected with selectQuotas, by course. Courses without
+ * quotas are not in the result.
+ */
+func scanQuotas(rows rowsT) (map[int]map[string]*quotaT, error) {
+	result := make(map[int]map[string]*quotaT)
+	for rows.Next() {
+		var courseID int
+		var yearGroup string
+		quota := quotaT{} //exhaustruct:ignore
+		err := rows.Scan(&courseID, &yearGroup, &quota.Max, &quota.Selected)
+		if err != nil {
+			return nil, wrapError(errUnexpectedDBError, err)
+		}
+		if result[courseID] == nil {
+			result[courseID] = make(map[string]*quotaT)
+		}
+		result[courseID][yearGroup] = &quota
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	return result, nil
+}
+
+/*
+ * Take a seat in a course, given its ID and the legal sex of the student,
+ * only if checkSeats would allow it, returning the new counts and the
+ * maximum. Give one up again, returning the same. Both PostgreSQL and SQLite
+ * accept these.
+ */
+const chooseUpdate = `UPDATE courses SET
+selected = selected + 1,
+selected_f = selected_f + CASE WHEN $2 = 'F' THEN 1 ELSE 0 END,
+selected_m = selected_m + CASE WHEN $2 = 'M' THEN 1 ELSE 0 END
+WHERE id = $1 AND selected < nmax AND (nmax_f = 0 AND nmax_m = 0 OR CASE $2
+WHEN 'F' THEN selected_f < nmax_f
+WHEN 'M' THEN selected_m < nmax_m
+ELSE false
+END)
+RETURNING selected, selected_f, selected_m, nmax, quota_release`
+
+const unchooseUpdate = `UPDATE courses SET
+selected = selected - 1,
+selected_f = selected_f - CASE WHEN $2 = 'F' THEN 1 ELSE 0 END,
+selected_m = selected_m - CASE WHEN $2 = 'M' THEN 1 ELSE 0 END
+WHERE id = $1
+RETURNING selected, selected_f, selected_m, nmax`
+
+/*
+ * The seats taken in each course that has any, counted from choices.
+ */
+const countChoices = `SELECT courseid, COUNT(*),
+SUM(CASE WHEN legal_sex = 'F' THEN 1 ELSE 0 END),
+SUM(CASE WHEN legal_sex = 'M' THEN 1 ELSE 0 END)
+FROM choices GROUP BY courseid`
+
+/*
+ * The seats taken under each quota, counted from choices.
+ */
+const countQuotaChoices = `SELECT quotas.courseid, quotas.yeargroup, COUNT(choices.userid)
+FROM quotas LEFT JOIN choices
+ON choices.courseid = quotas.courseid AND choices.year_group = quotas.yeargroup
+GROUP BY quotas.courseid, quotas.yeargroup`
+
+/*
+ * Take a seat under a quota, or give it up again. Nothing happens if the
+ * year group has no quota in the course.
+ */
+const (
+	chooseQuotaUpdate   = "UPDATE quotas SET selected = selected + 1 WHERE courseid = $1 AND yeargroup = $2"
+	unchooseQuotaUpdate = "UPDATE quotas SET selected = selected - 1 WHERE courseid = $1 AND yeargroup = $2"
 )
 
-var db *pgxpool.Pool
+/*
+ * Move users into the year group the roster gives them, for
+ * ReplaceExpectedStudents. Both PostgreSQL and SQLite accept this.
+ */
+const updateRosterDepartments = `UPDATE users SET department = expected_students.year_group
+FROM expected_students
+WHERE users.student_id = expected_students.id
+AND expected_students.year_group IS NOT NULL
+AND users.department <> expected_students.year_group`
 
-const pgErrUniqueViolation = "23505"
+const selectUsers = "SELECT id, name, email, department, COALESCE(session, ''), COALESCE(expr, 0), confirmed, COALESCE(student_id, 0), COALESCE(claimed_department, '') FROM users"
+
+func scanUser(row scannerT) (userT, error) {
+	var user userT
+	err := row.Scan(
+		&user.ID,
+		&user.Name,
+		&user.Email,
+		&user.Department,
+		&user.Session,
+		&user.Expr,
+		&user.Confirmed,
+		&user.StudentID,
+		&user.ClaimedDepartment,
+	)
+	return user, err
+}
 
 /*
  * This must be run during setup, before the database is accessed by any
- * means. Otherwise, db would be a null pointer.
+ * means. Otherwise, db would be nil.
  */
 func setupDatabase() error {
 	var err error
-	if config.DB.Type != "postgres" {
-		return errors.New("only postgres databases are supported")
+	switch config().DB.Type {
+	case "postgres":
+		db, err = openPostgres(context.Background(), config().DB.Conn)
+	case "sqlite":
+		db, err = openSQLite(context.Background(), config().DB.Conn)
+	case "memory":
+		db = newMemoryStore()
+	default:
+		return wrapAny(errUnsupportedDatabaseType, config().DB.Type)
 	}
-	db, err = pgxpool.New(context.Background(), config.DB.Conn)
 	if err != nil {
 		return fmt.Errorf("open database: %w", err)
 	}
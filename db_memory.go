@@ -0,0 +1,580 @@
+/*
+ * In-memory storage
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * The memory store keeps everything in maps and loses it all on exit. It is
+ * meant for tests and demonstrations. Every method holds one lock for its
+ * whole duration, which stands in for transactions; methods check everything
+ * that could fail before they change anything, so there is never anything to
+ * roll back.
+ */
+
+type memoryChoiceKeyT struct {
+	UserID   string
+	CourseID int
+}
+
+type memoryChoiceT struct {
+	Seltime   int64
+	LegalSex  string
+	YearGroup string
+}
+
+type memoryStateT struct {
+	State    uint32
+	Schedule time.Time
+}
+
+type memoryStoreT struct {
+	localNotifierT
+
+	lock         sync.Mutex
+	courses      map[int]courseT
+	nextCourseID int
+	users        map[string]userT
+	choices      map[memoryChoiceKeyT]memoryChoiceT
+	states       map[string]memoryStateT
+	expected     map[int64]expectedStudentT
+	audit        []auditEntryT
+}
+
+func newMemoryStore() *memoryStoreT {
+	return &memoryStoreT{
+		courses:      make(map[int]courseT),
+		nextCourseID: 1,
+		users:        make(map[string]userT),
+		choices:      make(map[memoryChoiceKeyT]memoryChoiceT),
+		states:       make(map[string]memoryStateT),
+		expected:     make(map[int64]expectedStudentT),
+	} //exhaustruct:ignore
+}
+
+/*
+ * Run f with the lock held, delivering the notifications it returns before
+ * the lock is released, so that seat counts are delivered in the order in
+ * which they were changed. Handling our own notifications never calls back
+ * into the store, so this cannot deadlock.
+ */
+func (s *memoryStoreT) locked(ctx context.Context, f func() ([]string, error)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	payloads, err := f()
+	if err != nil {
+		return err
+	}
+	s.deliver(ctx, payloads)
+	return nil
+}
+
+/*
+ * The caller must hold the lock.
+ */
+func (s *memoryStoreT) appendAudit(ctx context.Context, entry auditEntryT) {
+	source := getAuditSource(ctx)
+	entry.ID = int64(len(s.audit) + 1)
+	entry.Time = time.Now()
+	entry.Source = source.Source
+	entry.IP = source.IP
+	s.audit = append(s.audit, entry)
+}
+
+/*
+ * Courses in the store must not share quotas with those handed out, whose
+ * counts are updated through notifications.
+ */
+func cloneQuotas(quotas map[string]*quotaT) map[string]*quotaT {
+	if quotas == nil {
+		return nil
+	}
+	result := make(map[string]*quotaT, len(quotas))
+	for yearGroup, quota := range quotas {
+		quota := *quota
+		result[yearGroup] = &quota
+	}
+	return result
+}
+
+func selectedPayload(course courseT) string {
+	return notificationPayload("M", seatsArgs(course.ID, course.loadSeats())...)
+}
+
+func (s *memoryStoreT) Close() {
+}
+
+func (s *memoryStoreT) Ping(_ context.Context) error {
+	return nil
+}
+
+func (s *memoryStoreT) Stats() dbStatsT {
+	return dbStatsT{} //exhaustruct:ignore
+}
+
+/*
+ * There is no sql/memory, so there are no migrations to apply.
+ */
+func (s *memoryStoreT) Type() string {
+	return "memory"
+}
+
+func (s *memoryStoreT) SchemaVersion(_ context.Context) (int, error) {
+	return 0, nil
+}
+
+func (s *memoryStoreT) ApplyMigration(_ context.Context, _ migrationT) (bool, error) {
+	return false, nil
+}
+
+func (s *memoryStoreT) GetCourses(_ context.Context) ([]*courseT, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	result := make([]*courseT, 0, len(s.courses))
+	for _, course := range s.courses {
+		course := course
+		course.Quotas = cloneQuotas(course.Quotas)
+		result = append(result, &course)
+	}
+	slices.SortFunc(result, func(a, b *courseT) int {
+		return a.ID - b.ID
+	})
+	return result, nil
+}
+
+func (s *memoryStoreT) ReplaceCourses(
+	ctx context.Context,
+	courses []*courseT,
+	entry auditEntryT,
+) error {
+	return s.locked(ctx, func() ([]string, error) {
+		clear(s.choices)
+		for id, user := range s.users {
+			user.Confirmed = false
+			s.users[id] = user
+		}
+		clear(s.courses)
+		for _, course := range courses {
+			c := courseT{
+				ID:           s.nextCourseID,
+				Max:          course.Max,
+				Title:        course.Title,
+				Type:         course.Type,
+				Group:        course.Group,
+				Teacher:      course.Teacher,
+				Location:     course.Location,
+				CourseID:     course.CourseID,
+				SectionID:    course.SectionID,
+				YearGroups:   course.YearGroups,
+				MaxF:         course.MaxF,
+				MaxM:         course.MaxM,
+				Quotas:       cloneQuotas(course.Quotas),
+				QuotaRelease: course.QuotaRelease,
+				Students:     course.Students,
+				ExclusionSet: course.ExclusionSet,
+				Requires:     course.Requires,
+			} //exhaustruct:ignore
+			s.courses[c.ID] = c
+			s.nextCourseID++
+		}
+		s.appendAudit(ctx, entry)
+		return []string{notificationPayload("C")}, nil
+	})
+}
+
+func (s *memoryStoreT) UpsertUser(_ context.Context, user userT) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old, ok := s.users[user.ID]
+	user.Confirmed = ok && old.Confirmed
+	s.users[user.ID] = user
+	return nil
+}
+
+func (s *memoryStoreT) GetUserBySession(_ context.Context, session string) (userT, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, user := range s.users {
+		if user.Session == session && session != "" {
+			return user, nil
+		}
+	}
+	return userT{}, errNoSuchUser //exhaustruct:ignore
+}
+
+func (s *memoryStoreT) GetUser(_ context.Context, userID string) (userT, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	user, ok := s.users[userID]
+	if !ok {
+		return user, errNoSuchUser
+	}
+	return user, nil
+}
+
+func (s *memoryStoreT) GetUsers(_ context.Context) ([]userT, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	result := make([]userT, 0, len(s.users))
+	for _, user := range s.users {
+		result = append(result, user)
+	}
+	return result, nil
+}
+
+func (s *memoryStoreT) SetConfirmed(
+	ctx context.Context,
+	userID string,
+	confirmed bool,
+	entry auditEntryT,
+) error {
+	return s.locked(ctx, func() ([]string, error) {
+		user, ok := s.users[userID]
+		if ok {
+			user.Confirmed = confirmed
+			s.users[userID] = user
+		}
+		s.appendAudit(ctx, entry)
+		return nil, nil
+	})
+}
+
+func (s *memoryStoreT) GetChoices(_ context.Context) ([]choiceT, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	result := make([]choiceT, 0, len(s.choices))
+	for key, choice := range s.choices {
+		result = append(result, choiceT{
+			UserID:   key.UserID,
+			CourseID: key.CourseID,
+			Seltime:  choice.Seltime,
+		})
+	}
+	return result, nil
+}
+
+func (s *memoryStoreT) GetUserChoices(_ context.Context, userID string) ([]int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var result []int
+	for key := range s.choices {
+		if key.UserID == userID {
+			result = append(result, key.CourseID)
+		}
+	}
+	slices.Sort(result)
+	return result, nil
+}
+
+func (s *memoryStoreT) Choose(
+	ctx context.Context,
+	userID string,
+	courseID int,
+	legalSex string,
+	yearGroup string,
+) (chooseResultT, seatsT, error) {
+	var seats seatsT
+	err := s.locked(ctx, func() ([]string, error) {
+		key := memoryChoiceKeyT{UserID: userID, CourseID: courseID}
+		if _, ok := s.choices[key]; ok {
+			return nil, errUniqueViolation
+		}
+		course, ok := s.courses[courseID]
+		if !ok {
+			return nil, errNoSuchCourse
+		}
+		err := checkSeats(&course, course.loadSeats(), legalSex)
+		if err != nil {
+			return nil, err
+		}
+		err = checkQuotas(&course, course.loadSeats(), yearGroup, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		s.choices[key] = memoryChoiceT{
+			Seltime:   time.Now().UnixMicro(),
+			LegalSex:  legalSex,
+			YearGroup: yearGroup,
+		}
+		course.Selected++
+		switch legalSex {
+		case "F":
+			course.SelectedF++
+		case "M":
+			course.SelectedM++
+		}
+		if quota, ok := course.Quotas[yearGroup]; ok {
+			quota.Selected++
+		}
+		s.courses[courseID] = course
+		seats = course.loadSeats()
+		s.appendAudit(ctx, selfEntry(
+			userID,
+			auditChoose,
+			courseID,
+			auditOK,
+			fmt.Sprintf("%d/%d", course.Selected, course.Max),
+		))
+		return []string{selectedPayload(course)}, nil
+	})
+	result, err := chooseResult(ctx, s, userID, courseID, err)
+	return result, seats, err
+}
+
+func (s *memoryStoreT) Unchoose(
+	ctx context.Context,
+	userID string,
+	courseID int,
+) (bool, seatsT, error) {
+	var seats seatsT
+	err := s.locked(ctx, func() ([]string, error) {
+		key := memoryChoiceKeyT{UserID: userID, CourseID: courseID}
+		choice, ok := s.choices[key]
+		if !ok {
+			return nil, errNotChosen
+		}
+		course, ok := s.courses[courseID]
+		if !ok {
+			return nil, errNoSuchCourse
+		}
+		delete(s.choices, key)
+		course.Selected--
+		switch choice.LegalSex {
+		case "F":
+			course.SelectedF--
+		case "M":
+			course.SelectedM--
+		}
+		if quota, ok := course.Quotas[choice.YearGroup]; ok {
+			quota.Selected--
+		}
+		s.courses[courseID] = course
+		seats = course.loadSeats()
+		s.appendAudit(ctx, selfEntry(
+			userID,
+			auditUnchoose,
+			courseID,
+			auditOK,
+			fmt.Sprintf("%d/%d", course.Selected, course.Max),
+		))
+		return []string{selectedPayload(course)}, nil
+	})
+	deleted, err := unchooseResult(ctx, s, userID, courseID, err)
+	return deleted, seats, err
+}
+
+func (s *memoryStoreT) Recount(ctx context.Context, check recountFuncT) error {
+	return s.locked(ctx, func() ([]string, error) {
+		counted := make(map[int]seatsT)
+		for id, course := range s.courses {
+			if len(course.Quotas) != 0 {
+				seats := seatsT{Quotas: make(map[string]uint32)} //exhaustruct:ignore
+				for yearGroup := range course.Quotas {
+					seats.Quotas[yearGroup] = 0
+				}
+				counted[id] = seats
+			}
+		}
+		for key, choice := range s.choices {
+			seats := counted[key.CourseID]
+			seats.Total++
+			switch choice.LegalSex {
+			case "F":
+				seats.F++
+			case "M":
+				seats.M++
+			}
+			if _, ok := s.courses[key.CourseID].Quotas[choice.YearGroup]; ok {
+				seats.Quotas[choice.YearGroup]++
+			}
+			counted[key.CourseID] = seats
+		}
+		ids := getKeysOfMap(s.courses)
+		slices.Sort(ids)
+		var payloads []string
+		for _, id := range ids {
+			course := s.courses[id]
+			entry, fix := check(id, course.Title, counted[id], course.loadSeats())
+			if !fix {
+				continue
+			}
+			course.storeSeats(counted[id])
+			s.courses[id] = course
+			s.appendAudit(ctx, entry)
+			payloads = append(payloads, selectedPayload(course))
+		}
+		return payloads, nil
+	})
+}
+
+func (s *memoryStoreT) LoadState(_ context.Context, yeargroup string) (uint32, time.Time, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	state, ok := s.states[yeargroup]
+	if !ok {
+		state = memoryStateT{State: 0, Schedule: time.Time{}}
+		s.states[yeargroup] = state
+	}
+	return state.State, state.Schedule, nil
+}
+
+func (s *memoryStoreT) SetState(
+	ctx context.Context,
+	yeargroup string,
+	state uint32,
+	entry auditEntryT,
+) error {
+	return s.locked(ctx, func() ([]string, error) {
+		st := s.states[yeargroup]
+		st.State = state
+		s.states[yeargroup] = st
+		s.appendAudit(ctx, entry)
+		return []string{notificationPayload("S", yeargroup)}, nil
+	})
+}
+
+func (s *memoryStoreT) OpenScheduled(
+	ctx context.Context,
+	yeargroup string,
+	entry auditEntryT,
+) (bool, error) {
+	opened := false
+	err := s.locked(ctx, func() ([]string, error) {
+		st := s.states[yeargroup]
+		if st.State != 3 {
+			return nil, nil
+		}
+		st.State = 2
+		s.states[yeargroup] = st
+		s.appendAudit(ctx, entry)
+		opened = true
+		return []string{notificationPayload("S", yeargroup)}, nil
+	})
+	return opened, err
+}
+
+func (s *memoryStoreT) SetSchedule(
+	ctx context.Context,
+	yeargroup string,
+	schedule time.Time,
+	entry auditEntryT,
+) error {
+	return s.locked(ctx, func() ([]string, error) {
+		st := s.states[yeargroup]
+		st.Schedule = schedule
+		s.states[yeargroup] = st
+		s.appendAudit(ctx, entry)
+		return []string{notificationPayload("S", yeargroup)}, nil
+	})
+}
+
+func (s *memoryStoreT) GetExpectedStudents(_ context.Context) ([]expectedStudentT, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	result := make([]expectedStudentT, 0, len(s.expected))
+	for _, student := range s.expected {
+		result = append(result, student)
+	}
+	return result, nil
+}
+
+func (s *memoryStoreT) ReplaceExpectedStudents(
+	ctx context.Context,
+	students []expectedStudentT,
+	entry auditEntryT,
+) error {
+	return s.locked(ctx, func() ([]string, error) {
+		replacement := make(map[int64]expectedStudentT, len(students))
+		for _, student := range students {
+			if _, ok := replacement[student.ID]; ok {
+				return nil, wrapAny(errUniqueViolation, student.ID)
+			}
+			replacement[student.ID] = student
+		}
+		s.expected = replacement
+		for id, user := range s.users {
+			student, ok := replacement[user.StudentID]
+			if user.StudentID != 0 && ok && student.YearGroup != "" {
+				user.Department = student.YearGroup
+				s.users[id] = user
+			}
+		}
+		s.appendAudit(ctx, entry)
+		return nil, nil
+	})
+}
+
+func (s *memoryStoreT) Audit(ctx context.Context, entry auditEntryT) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.appendAudit(ctx, entry)
+	return nil
+}
+
+func (s *memoryStoreT) QueryAudit(
+	_ context.Context,
+	filter auditFilterT,
+) ([]auditEntryT, map[string]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	matchesUser := func(userID string) bool {
+		if userID == filter.User {
+			return true
+		}
+		user, ok := s.users[userID]
+		if !ok {
+			return false
+		}
+		needle := strings.ToLower(filter.User)
+		return strings.Contains(strings.ToLower(user.Name), needle) ||
+			strings.Contains(strings.ToLower(user.Email), needle)
+	}
+
+	var entries []auditEntryT
+	names := make(map[string]string)
+	for i := len(s.audit) - 1; i >= 0; i-- {
+		entry := s.audit[i]
+		if filter.User != "" && !matchesUser(entry.Actor) && !matchesUser(entry.Target) {
+			continue
+		}
+		if filter.Action != "" && entry.Action != filter.Action {
+			continue
+		}
+		if filter.Outcome != "" && entry.Outcome != filter.Outcome {
+			continue
+		}
+		if filter.Course != 0 && entry.CourseID != filter.Course {
+			continue
+		}
+		if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+			continue
+		}
+		if !filter.Until.IsZero() && !entry.Time.Before(filter.Until) {
+			continue
+		}
+		entry.Time = entry.Time.In(loc)
+		for _, userID := range []string{entry.Actor, entry.Target} {
+			if user, ok := s.users[userID]; ok {
+				names[userID] = user.Name
+			}
+		}
+		entries = append(entries, entry)
+		if filter.Limit > 0 && len(entries) >= filter.Limit {
+			break
+		}
+	}
+	return entries, names, nil
+}
@@ -0,0 +1,924 @@
+/*
+ * PostgreSQL storage
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	pgErrUniqueViolation = "23505"
+	pgErrUndefinedTable  = "42P01"
+)
+
+/*
+ * An arbitrary key for pg_advisory_xact_lock, so that several instances
+ * starting at once don't apply the same migration concurrently.
+ */
+const migrationLockKey = 0x636361
+
+type postgresStoreT struct {
+	pool *pgxpool.Pool
+}
+
+/*
+ * Both pgxpool.Pool and pgx.Tx have this.
+ */
+type execer interface {
+	Exec(
+		ctx context.Context,
+		sql string,
+		arguments ...any,
+	) (pgconn.CommandTag, error)
+}
+
+/*
+ * Both pgxpool.Pool and pgx.Tx have this too.
+ */
+type queryer interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+func openPostgres(ctx context.Context, conn string) (*postgresStoreT, error) {
+	pool, err := pgxpool.New(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresStoreT{pool: pool}, nil
+}
+
+func mapPostgresError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgErrUniqueViolation {
+		return wrapError(errUniqueViolation, err)
+	}
+	return wrapError(errUnexpectedDBError, err)
+}
+
+/*
+ * Run f in a transaction, which is committed if f returns nil and rolled
+ * back otherwise.
+ */
+func (s *postgresStoreT) inTx(ctx context.Context, f func(tx pgx.Tx) error) (retErr error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+		}
+	}()
+	err = f(tx)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	return nil
+}
+
+func (s *postgresStoreT) audit(ctx context.Context, e execer, entry auditEntryT) error {
+	_, err := e.Exec(ctx, insertAudit, auditArgs(ctx, entry)...)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	return nil
+}
+
+/*
+ * Notifications sent inside a transaction are only delivered when it
+ * commits, and they are delivered in commit order.
+ */
+func (s *postgresStoreT) notify(ctx context.Context, e execer, verb string, args ...string) error {
+	_, err := e.Exec(
+		ctx,
+		"SELECT pg_notify($1, $2)",
+		notifyChannel,
+		notificationPayload(verb, args...),
+	)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	return nil
+}
+
+func (s *postgresStoreT) notifySelected(ctx context.Context, e execer, courseID int, seats seatsT) error {
+	return s.notify(ctx, e, "M", seatsArgs(courseID, seats)...)
+}
+
+func (s *postgresStoreT) Close() {
+	s.pool.Close()
+}
+
+func (s *postgresStoreT) Stats() dbStatsT {
+	stat := s.pool.Stat()
+	return dbStatsT{
+		Total:    int(stat.TotalConns()),
+		InUse:    int(stat.AcquiredConns()),
+		Idle:     int(stat.IdleConns()),
+		Max:      int(stat.MaxConns()),
+		Waits:    stat.EmptyAcquireCount(),
+		WaitTime: stat.AcquireDuration(),
+	}
+}
+
+func (s *postgresStoreT) Ping(ctx context.Context) error {
+	err := s.pool.Ping(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	return nil
+}
+
+func (s *postgresStoreT) Type() string {
+	return "postgres"
+}
+
+func (s *postgresStoreT) SchemaVersion(ctx context.Context) (int, error) {
+	return s.schemaVersion(ctx, s.pool)
+}
+
+/*
+ * Get the version of the database schema, which is 0 if no migrations have
+ * ever been applied.
+ */
+func (s *postgresStoreT) schemaVersion(
+	ctx context.Context,
+	q interface {
+		QueryRow(context.Context, string, ...any) pgx.Row
+	},
+) (int, error) {
+	var version int
+	err := q.QueryRow(
+		ctx,
+		"SELECT COALESCE(MAX(version), 0) FROM schema_version",
+	).Scan(&version)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgErrUndefinedTable {
+			return 0, nil
+		}
+		return 0, wrapError(errUnexpectedDBError, err)
+	}
+	return version, nil
+}
+
+func (s *postgresStoreT) ApplyMigration(ctx context.Context, m migrationT) (bool, error) {
+	applied := false
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockKey)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		_, err = tx.Exec(
+			ctx,
+			"CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY NOT NULL, name TEXT NOT NULL, applied BIGINT NOT NULL)",
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+
+		current, err := s.schemaVersion(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if current >= m.Version {
+			return nil
+		}
+
+		_, err = tx.Exec(ctx, m.SQL)
+		if err != nil {
+			return fmt.Errorf("apply migration %s: %w", m.Name, err)
+		}
+		_, err = tx.Exec(
+			ctx,
+			"INSERT INTO schema_version (version, name, applied) VALUES ($1, $2, $3)",
+			m.Version,
+			m.Name,
+			time.Now().Unix(),
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		applied = true
+		return nil
+	})
+	return applied && err == nil, err
+}
+
+func (s *postgresStoreT) Listen(
+	ctx context.Context,
+	handle func(ctx context.Context, payload string),
+) error {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	/*
+	 * The connection is in LISTEN mode, so it must not go back to the
+	 * pool.
+	 */
+	defer func() {
+		_ = conn.Conn().Close(ctx)
+		conn.Release()
+	}()
+
+	_, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{notifyChannel}.Sanitize())
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		handle(ctx, n.Payload)
+	}
+}
+
+func (s *postgresStoreT) Notify(ctx context.Context, verb string, args ...string) error {
+	return s.notify(ctx, s.pool, verb, args...)
+}
+
+func (s *postgresStoreT) GetCourses(ctx context.Context) ([]*courseT, error) {
+	rows, err := s.pool.Query(ctx, selectCourses)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	var result []*courseT
+	for rows.Next() {
+		course, err := scanCourse(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, course)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	quotas, err := postgresQuotas(ctx, s.pool, selectQuotas)
+	if err != nil {
+		return nil, err
+	}
+	for _, course := range result {
+		course.Quotas = quotas[course.ID]
+	}
+	return result, nil
+}
+
+func postgresQuotas(
+	ctx context.Context,
+	q queryer,
+	query string,
+	args ...any,
+) (map[int]map[string]*quotaT, error) {
+	rows, err := q.Query(ctx, query, args...)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	return scanQuotas(rows)
+}
+
+func (s *postgresStoreT) ReplaceCourses(
+	ctx context.Context,
+	courses []*courseT,
+	entry auditEntryT,
+) error {
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		for _, query := range []string{
+			"DELETE FROM choices",
+			"UPDATE users SET confirmed = false",
+			"DELETE FROM quotas",
+			"DELETE FROM courses",
+		} {
+			_, err := tx.Exec(ctx, query)
+			if err != nil {
+				return wrapError(errUnexpectedDBError, err)
+			}
+		}
+		for _, course := range courses {
+			var id int
+			err := tx.QueryRow(
+				ctx,
+				"INSERT INTO courses(nmax, title, teacher, location, ctype, cgroup, section_id, course_id, year_groups, nmax_f, nmax_m, quota_release, students, exclusion_set, requires) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) RETURNING id",
+				course.Max,
+				course.Title,
+				course.Teacher,
+				course.Location,
+				course.Type,
+				course.Group,
+				course.SectionID,
+				course.CourseID,
+				course.YearGroups,
+				course.MaxF,
+				course.MaxM,
+				zeroOrUnix(course.QuotaRelease),
+				formatStudentIDs(course.Students),
+				course.ExclusionSet,
+				strings.Join(course.Requires, " "),
+			).Scan(&id)
+			if err != nil {
+				return wrapError(errUnexpectedDBError, err)
+			}
+			for yearGroup, quota := range course.Quotas {
+				_, err := tx.Exec(
+					ctx,
+					"INSERT INTO quotas(courseid, yeargroup, nmax) VALUES ($1, $2, $3)",
+					id,
+					yearGroup,
+					quota.Max,
+				)
+				if err != nil {
+					return wrapError(errUnexpectedDBError, err)
+				}
+			}
+		}
+		err := s.audit(ctx, tx, entry)
+		if err != nil {
+			return err
+		}
+		return s.notify(ctx, tx, "C")
+	})
+}
+
+func (s *postgresStoreT) UpsertUser(ctx context.Context, user userT) error {
+	_, err := s.pool.Exec(
+		ctx,
+		"INSERT INTO users (id, name, email, department, session, expr, confirmed, student_id, claimed_department) VALUES ($1, $2, $3, $4, $5, $6, false, NULLIF($7::bigint, 0), NULLIF($8, ''))",
+		user.ID,
+		user.Name,
+		user.Email,
+		user.Department,
+		user.Session,
+		user.Expr,
+		user.StudentID,
+		user.ClaimedDepartment,
+	)
+	if err == nil {
+		return nil
+	}
+	err = mapPostgresError(err)
+	if !errors.Is(err, errUniqueViolation) {
+		return err
+	}
+	_, err = s.pool.Exec(
+		ctx,
+		"UPDATE users SET (name, email, department, session, expr, student_id, claimed_department) = ($1, $2, $3, $4, $5, NULLIF($6::bigint, 0), NULLIF($7, '')) WHERE id = $8",
+		user.Name,
+		user.Email,
+		user.Department,
+		user.Session,
+		user.Expr,
+		user.StudentID,
+		user.ClaimedDepartment,
+		user.ID,
+	)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	return nil
+}
+
+func (s *postgresStoreT) GetUserBySession(ctx context.Context, session string) (userT, error) {
+	user, err := scanUser(s.pool.QueryRow(ctx, selectUsers+" WHERE session = $1", session))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return user, errNoSuchUser
+	} else if err != nil {
+		return user, wrapError(errUnexpectedDBError, err)
+	}
+	return user, nil
+}
+
+func (s *postgresStoreT) GetUser(ctx context.Context, userID string) (userT, error) {
+	user, err := scanUser(s.pool.QueryRow(ctx, selectUsers+" WHERE id = $1", userID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return user, errNoSuchUser
+	} else if err != nil {
+		return user, wrapError(errUnexpectedDBError, err)
+	}
+	return user, nil
+}
+
+func (s *postgresStoreT) GetUsers(ctx context.Context) ([]userT, error) {
+	rows, err := s.pool.Query(ctx, selectUsers)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	var result []userT
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, wrapError(errUnexpectedDBError, err)
+		}
+		result = append(result, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	return result, nil
+}
+
+func (s *postgresStoreT) SetConfirmed(
+	ctx context.Context,
+	userID string,
+	confirmed bool,
+	entry auditEntryT,
+) error {
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(
+			ctx,
+			"UPDATE users SET confirmed = $2 WHERE id = $1",
+			userID,
+			confirmed,
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		return s.audit(ctx, tx, entry)
+	})
+}
+
+func (s *postgresStoreT) GetChoices(ctx context.Context) ([]choiceT, error) {
+	rows, err := s.pool.Query(ctx, "SELECT userid, courseid, seltime FROM choices")
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	var result []choiceT
+	for rows.Next() {
+		var choice choiceT
+		err := rows.Scan(&choice.UserID, &choice.CourseID, &choice.Seltime)
+		if err != nil {
+			return nil, wrapError(errUnexpectedDBError, err)
+		}
+		result = append(result, choice)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	return result, nil
+}
+
+func (s *postgresStoreT) GetUserChoices(ctx context.Context, userID string) ([]int, error) {
+	rows, err := s.pool.Query(
+		ctx,
+		"SELECT courseid FROM choices WHERE userid = $1",
+		userID,
+	)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	courseIDs, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	return courseIDs, nil
+}
+
+func (s *postgresStoreT) Choose(
+	ctx context.Context,
+	userID string,
+	courseID int,
+	legalSex string,
+	yearGroup string,
+) (chooseResultT, seatsT, error) {
+	var seats seatsT
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(
+			ctx,
+			"INSERT INTO choices (seltime, userid, courseid, legal_sex, year_group) VALUES ($1, $2, $3, NULLIF($4, ''), $5)",
+			time.Now().UnixMicro(),
+			userID,
+			courseID,
+			legalSex,
+			yearGroup,
+		)
+		if err != nil {
+			return mapPostgresError(err)
+		}
+
+		/*
+		 * The row lock taken by the update sequentializes
+		 * compare-with-max-and-increment operations across every
+		 * instance sharing the database.
+		 */
+		var nmax uint32
+		var quotaRelease int64
+		err = tx.QueryRow(
+			ctx,
+			chooseUpdate,
+			courseID,
+			legalSex,
+		).Scan(&seats.Total, &seats.F, &seats.M, &nmax, &quotaRelease)
+		if errors.Is(err, pgx.ErrNoRows) {
+			course, err := scanCourse(tx.QueryRow(ctx, selectCourses+" WHERE id = $1", courseID))
+			if err != nil {
+				return err
+			}
+			return cmp.Or(checkSeats(course, course.loadSeats(), legalSex), errCourseFull)
+		} else if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+
+		/*
+		 * The course row is locked until we commit, and quotas are only
+		 * updated with it locked, so these are current.
+		 */
+		quotas, err := postgresQuotas(ctx, tx, selectQuotas+" WHERE courseid = $1", courseID)
+		if err != nil {
+			return err
+		}
+		err = checkTakenQuota(nmax, quotas[courseID], quotaRelease, seats.Total, yearGroup)
+		if err != nil {
+			return err
+		}
+		if _, ok := quotas[courseID][yearGroup]; ok {
+			_, err = tx.Exec(ctx, chooseQuotaUpdate, courseID, yearGroup)
+			if err != nil {
+				return wrapError(errUnexpectedDBError, err)
+			}
+		}
+		seats.Quotas = quotaSeats(quotas[courseID])
+
+		err = s.audit(ctx, tx, selfEntry(
+			userID,
+			auditChoose,
+			courseID,
+			auditOK,
+			fmt.Sprintf("%d/%d", seats.Total, nmax),
+		))
+		if err != nil {
+			return err
+		}
+		return s.notifySelected(ctx, tx, courseID, seats)
+	})
+	result, err := chooseResult(ctx, s, userID, courseID, err)
+	return result, seats, err
+}
+
+func (s *postgresStoreT) Unchoose(
+	ctx context.Context,
+	userID string,
+	courseID int,
+) (bool, seatsT, error) {
+	var seats seatsT
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		var legalSex, yearGroup string
+		err := tx.QueryRow(
+			ctx,
+			"DELETE FROM choices WHERE userid = $1 AND courseid = $2 RETURNING COALESCE(legal_sex, ''), COALESCE(year_group, '')",
+			userID,
+			courseID,
+		).Scan(&legalSex, &yearGroup)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errNotChosen
+		} else if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+
+		var nmax uint32
+		err = tx.QueryRow(
+			ctx,
+			unchooseUpdate,
+			courseID,
+			legalSex,
+		).Scan(&seats.Total, &seats.F, &seats.M, &nmax)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+
+		quotas, err := postgresQuotas(ctx, tx, selectQuotas+" WHERE courseid = $1", courseID)
+		if err != nil {
+			return err
+		}
+		if quota, ok := quotas[courseID][yearGroup]; ok {
+			_, err = tx.Exec(ctx, unchooseQuotaUpdate, courseID, yearGroup)
+			if err != nil {
+				return wrapError(errUnexpectedDBError, err)
+			}
+			quota.Selected--
+		}
+		seats.Quotas = quotaSeats(quotas[courseID])
+
+		err = s.audit(ctx, tx, selfEntry(
+			userID,
+			auditUnchoose,
+			courseID,
+			auditOK,
+			fmt.Sprintf("%d/%d", seats.Total, nmax),
+		))
+		if err != nil {
+			return err
+		}
+		return s.notifySelected(ctx, tx, courseID, seats)
+	})
+	deleted, err := unchooseResult(ctx, s, userID, courseID, err)
+	return deleted, seats, err
+}
+
+func (s *postgresStoreT) Recount(ctx context.Context, check recountFuncT) error {
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		/*
+		 * Choosing and unchoosing update the course row in the same
+		 * transaction as the choice, so locking every course row
+		 * holds them off while we count.
+		 */
+		rows, err := tx.Query(
+			ctx,
+			"SELECT id, title, selected, selected_f, selected_m FROM courses ORDER BY id FOR UPDATE",
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		var counts []recountRowT
+		var c recountRowT
+		_, err = pgx.ForEachRow(rows, []any{&c.ID, &c.Title, &c.Column.Total, &c.Column.F, &c.Column.M}, func() error {
+			counts = append(counts, c)
+			return nil
+		})
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+
+		rows, err = tx.Query(ctx, countChoices)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		counted := make(map[int]seatsT)
+		var id int
+		var seats seatsT
+		_, err = pgx.ForEachRow(rows, []any{&id, &seats.Total, &seats.F, &seats.M}, func() error {
+			counted[id] = seats
+			return nil
+		})
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+
+		quotas, err := postgresQuotas(ctx, tx, selectQuotas)
+		if err != nil {
+			return err
+		}
+		rows, err = tx.Query(ctx, countQuotaChoices)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		var yearGroup string
+		var selected uint32
+		_, err = pgx.ForEachRow(rows, []any{&id, &yearGroup, &selected}, func() error {
+			seats := counted[id]
+			if seats.Quotas == nil {
+				seats.Quotas = make(map[string]uint32)
+			}
+			seats.Quotas[yearGroup] = selected
+			counted[id] = seats
+			return nil
+		})
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+
+		for i := range counts {
+			counts[i].Column.Quotas = quotaSeats(quotas[counts[i].ID])
+			counts[i].Choices = counted[counts[i].ID]
+		}
+
+		for _, c := range counts {
+			entry, fix := check(c.ID, c.Title, c.Choices, c.Column)
+			if !fix {
+				continue
+			}
+			if !c.Choices.equal(c.Column) {
+				_, err := tx.Exec(
+					ctx,
+					"UPDATE courses SET selected = $2, selected_f = $3, selected_m = $4 WHERE id = $1",
+					c.ID,
+					c.Choices.Total,
+					c.Choices.F,
+					c.Choices.M,
+				)
+				if err != nil {
+					return wrapError(errUnexpectedDBError, err)
+				}
+				for yearGroup, selected := range c.Choices.Quotas {
+					_, err := tx.Exec(
+						ctx,
+						"UPDATE quotas SET selected = $3 WHERE courseid = $1 AND yeargroup = $2",
+						c.ID,
+						yearGroup,
+						selected,
+					)
+					if err != nil {
+						return wrapError(errUnexpectedDBError, err)
+					}
+				}
+			}
+			err := s.audit(ctx, tx, entry)
+			if err != nil {
+				return err
+			}
+			err = s.notifySelected(ctx, tx, c.ID, c.Choices)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *postgresStoreT) LoadState(ctx context.Context, yeargroup string) (uint32, time.Time, error) {
+	var state uint32
+	var schedule time.Time
+	err := s.pool.QueryRow(
+		ctx,
+		"SELECT state, schedule FROM states WHERE yeargroup = $1",
+		yeargroup,
+	).Scan(&state, &schedule)
+	if errors.Is(err, pgx.ErrNoRows) {
+		_, err := s.pool.Exec(
+			ctx,
+			"INSERT INTO states(yeargroup, state, schedule) VALUES ($1, $2, $3)",
+			yeargroup,
+			0,
+			time.Time{},
+		)
+		if err != nil {
+			return 0, time.Time{}, wrapError(errUnexpectedDBError, err)
+		}
+		return 0, time.Time{}, nil
+	} else if err != nil {
+		return 0, time.Time{}, wrapError(errUnexpectedDBError, err)
+	}
+	return state, schedule, nil
+}
+
+func (s *postgresStoreT) SetState(
+	ctx context.Context,
+	yeargroup string,
+	state uint32,
+	entry auditEntryT,
+) error {
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(
+			ctx,
+			"UPDATE states SET state = $2 WHERE yeargroup = $1",
+			yeargroup,
+			state,
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		err = s.audit(ctx, tx, entry)
+		if err != nil {
+			return err
+		}
+		return s.notify(ctx, tx, "S", yeargroup)
+	})
+}
+
+func (s *postgresStoreT) OpenScheduled(
+	ctx context.Context,
+	yeargroup string,
+	entry auditEntryT,
+) (bool, error) {
+	opened := false
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(
+			ctx,
+			"UPDATE states SET state = 2 WHERE yeargroup = $1 AND state = 3",
+			yeargroup,
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return nil
+		}
+		err = s.audit(ctx, tx, entry)
+		if err != nil {
+			return err
+		}
+		opened = true
+		return s.notify(ctx, tx, "S", yeargroup)
+	})
+	return opened, err
+}
+
+func (s *postgresStoreT) SetSchedule(
+	ctx context.Context,
+	yeargroup string,
+	schedule time.Time,
+	entry auditEntryT,
+) error {
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(
+			ctx,
+			"UPDATE states SET schedule = $2 WHERE yeargroup = $1",
+			yeargroup,
+			schedule,
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		err = s.audit(ctx, tx, entry)
+		if err != nil {
+			return err
+		}
+		return s.notify(ctx, tx, "S", yeargroup)
+	})
+}
+
+func (s *postgresStoreT) GetExpectedStudents(ctx context.Context) ([]expectedStudentT, error) {
+	rows, err := s.pool.Query(ctx, "SELECT id, name, legal_sex, COALESCE(year_group, '') FROM expected_students")
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	students, err := pgx.CollectRows(rows, pgx.RowToStructByPos[expectedStudentT])
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	return students, nil
+}
+
+func (s *postgresStoreT) ReplaceExpectedStudents(
+	ctx context.Context,
+	students []expectedStudentT,
+	entry auditEntryT,
+) error {
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "DELETE FROM expected_students")
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		for _, student := range students {
+			_, err := tx.Exec(
+				ctx,
+				"INSERT INTO expected_students(name, id, legal_sex, year_group) VALUES ($1, $2, $3, NULLIF($4, ''))",
+				student.Name,
+				student.ID,
+				student.LegalSex,
+				student.YearGroup,
+			)
+			if err != nil {
+				return mapPostgresError(err)
+			}
+		}
+		_, err = tx.Exec(ctx, updateRosterDepartments)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		return s.audit(ctx, tx, entry)
+	})
+}
+
+func (s *postgresStoreT) Audit(ctx context.Context, entry auditEntryT) error {
+	return s.audit(ctx, s.pool, entry)
+}
+
+func (s *postgresStoreT) QueryAudit(
+	ctx context.Context,
+	filter auditFilterT,
+) ([]auditEntryT, map[string]string, error) {
+	query, args := buildAuditQuery(filter, "ILIKE")
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+
+	var entries []auditEntryT
+	names := make(map[string]string)
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows, names)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, wrapError(errUnexpectedDBError, err)
+	}
+	return entries, names, nil
+}
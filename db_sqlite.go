@@ -0,0 +1,932 @@
+/*
+ * SQLite storage
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+/*
+ * The SQLite database is a file that only one instance may use, so there is
+ * nobody else to notify: notifications are delivered to our own listener
+ * once the transaction that sent them commits, which keeps the rest of the
+ * program oblivious to the difference.
+ *
+ * Every transaction takes the write lock when it begins (_txlock=immediate),
+ * and there is only one connection, so transactions are serialized. That is
+ * what makes compare-with-max-and-increment safe here.
+ */
+
+type sqliteStoreT struct {
+	localNotifierT
+	db *sql.DB
+
+	/*
+	 * Held from each commit until its notifications are delivered, so that
+	 * seat counts are delivered in the order in which they were committed.
+	 */
+	commitLock sync.Mutex
+}
+
+type sqliteTxT struct {
+	*sql.Tx
+	payloads []string
+}
+
+/*
+ * Both sql.DB and sql.Tx have this.
+ */
+type sqliteExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+type sqliteQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+/*
+ * The path is the database file, which is created if it does not exist.
+ */
+func openSQLite(ctx context.Context, path string) (*sqliteStoreT, error) {
+	sdb, err := sql.Open(
+		"sqlite",
+		"file:"+path+"?_txlock=immediate&_pragma=foreign_keys(1)&_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)",
+	)
+	if err != nil {
+		return nil, err
+	}
+	/*
+	 * This also keeps ":memory:" databases from being a different empty
+	 * database on each connection.
+	 */
+	sdb.SetMaxOpenConns(1)
+	err = sdb.PingContext(ctx)
+	if err != nil {
+		_ = sdb.Close()
+		return nil, err
+	}
+	return &sqliteStoreT{db: sdb}, nil //exhaustruct:ignore
+}
+
+func mapSQLiteError(err error) error {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() {
+		case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+			return wrapError(errUniqueViolation, err)
+		}
+	}
+	return wrapError(errUnexpectedDBError, err)
+}
+
+/*
+ * Run f in a transaction, which is committed if f returns nil and rolled
+ * back otherwise. Notifications sent by f are delivered after the commit,
+ * before any later transaction's.
+ */
+func (s *sqliteStoreT) inTx(ctx context.Context, f func(tx *sqliteTxT) error) (retErr error) {
+	_tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	tx := &sqliteTxT{Tx: _tx, payloads: nil}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && (!errors.Is(err, sql.ErrTxDone)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+		}
+	}()
+	err = f(tx)
+	if err != nil {
+		return err
+	}
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+	err = tx.Commit()
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	s.deliver(ctx, tx.payloads)
+	return nil
+}
+
+func (s *sqliteStoreT) audit(ctx context.Context, e sqliteExecer, entry auditEntryT) error {
+	_, err := e.ExecContext(ctx, insertAudit, auditArgs(ctx, entry)...)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	return nil
+}
+
+func (tx *sqliteTxT) notify(verb string, args ...string) {
+	tx.payloads = append(tx.payloads, notificationPayload(verb, args...))
+}
+
+func (tx *sqliteTxT) notifySelected(courseID int, seats seatsT) {
+	tx.notify("M", seatsArgs(courseID, seats)...)
+}
+
+func (s *sqliteStoreT) Close() {
+	_ = s.db.Close()
+}
+
+func (s *sqliteStoreT) Stats() dbStatsT {
+	stat := s.db.Stats()
+	return dbStatsT{
+		Total:    stat.OpenConnections,
+		InUse:    stat.InUse,
+		Idle:     stat.Idle,
+		Max:      stat.MaxOpenConnections,
+		Waits:    stat.WaitCount,
+		WaitTime: stat.WaitDuration,
+	}
+}
+
+func (s *sqliteStoreT) Ping(ctx context.Context) error {
+	err := s.db.PingContext(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	return nil
+}
+
+func (s *sqliteStoreT) Type() string {
+	return "sqlite"
+}
+
+func (s *sqliteStoreT) SchemaVersion(ctx context.Context) (int, error) {
+	var exists bool
+	err := s.db.QueryRowContext(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'schema_version')",
+	).Scan(&exists)
+	if err != nil {
+		return 0, wrapError(errUnexpectedDBError, err)
+	}
+	if !exists {
+		return 0, nil
+	}
+	var version int
+	err = s.db.QueryRowContext(
+		ctx,
+		"SELECT COALESCE(MAX(version), 0) FROM schema_version",
+	).Scan(&version)
+	if err != nil {
+		return 0, wrapError(errUnexpectedDBError, err)
+	}
+	return version, nil
+}
+
+func (s *sqliteStoreT) ApplyMigration(ctx context.Context, m migrationT) (bool, error) {
+	applied := false
+	err := s.inTx(ctx, func(tx *sqliteTxT) error {
+		_, err := tx.ExecContext(
+			ctx,
+			"CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY NOT NULL, name TEXT NOT NULL, applied INTEGER NOT NULL)",
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+
+		var current int
+		err = tx.QueryRowContext(
+			ctx,
+			"SELECT COALESCE(MAX(version), 0) FROM schema_version",
+		).Scan(&current)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		if current >= m.Version {
+			return nil
+		}
+
+		_, err = tx.ExecContext(ctx, m.SQL)
+		if err != nil {
+			return fmt.Errorf("apply migration %s: %w", m.Name, err)
+		}
+		_, err = tx.ExecContext(
+			ctx,
+			"INSERT INTO schema_version (version, name, applied) VALUES ($1, $2, $3)",
+			m.Version,
+			m.Name,
+			time.Now().Unix(),
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		applied = true
+		return nil
+	})
+	return applied && err == nil, err
+}
+
+func (s *sqliteStoreT) GetCourses(ctx context.Context) ([]*courseT, error) {
+	rows, err := s.db.QueryContext(ctx, selectCourses)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	var result []*courseT
+	for rows.Next() {
+		course, err := scanCourse(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, course)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	quotas, err := sqliteQuotas(ctx, s.db, selectQuotas)
+	if err != nil {
+		return nil, err
+	}
+	for _, course := range result {
+		course.Quotas = quotas[course.ID]
+	}
+	return result, nil
+}
+
+func sqliteQuotas(
+	ctx context.Context,
+	q sqliteQueryer,
+	query string,
+	args ...any,
+) (map[int]map[string]*quotaT, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	return scanQuotas(rows)
+}
+
+func (s *sqliteStoreT) ReplaceCourses(
+	ctx context.Context,
+	courses []*courseT,
+	entry auditEntryT,
+) error {
+	return s.inTx(ctx, func(tx *sqliteTxT) error {
+		for _, query := range []string{
+			"DELETE FROM choices",
+			"UPDATE users SET confirmed = false",
+			"DELETE FROM quotas",
+			"DELETE FROM courses",
+		} {
+			_, err := tx.ExecContext(ctx, query)
+			if err != nil {
+				return wrapError(errUnexpectedDBError, err)
+			}
+		}
+		for _, course := range courses {
+			var id int
+			err := tx.QueryRowContext(
+				ctx,
+				"INSERT INTO courses(nmax, title, teacher, location, ctype, cgroup, section_id, course_id, year_groups, nmax_f, nmax_m, quota_release, students, exclusion_set, requires) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) RETURNING id",
+				course.Max,
+				course.Title,
+				course.Teacher,
+				course.Location,
+				course.Type,
+				course.Group,
+				course.SectionID,
+				course.CourseID,
+				course.YearGroups,
+				course.MaxF,
+				course.MaxM,
+				zeroOrUnix(course.QuotaRelease),
+				formatStudentIDs(course.Students),
+				course.ExclusionSet,
+				strings.Join(course.Requires, " "),
+			).Scan(&id)
+			if err != nil {
+				return wrapError(errUnexpectedDBError, err)
+			}
+			for yearGroup, quota := range course.Quotas {
+				_, err := tx.ExecContext(
+					ctx,
+					"INSERT INTO quotas(courseid, yeargroup, nmax) VALUES ($1, $2, $3)",
+					id,
+					yearGroup,
+					quota.Max,
+				)
+				if err != nil {
+					return wrapError(errUnexpectedDBError, err)
+				}
+			}
+		}
+		err := s.audit(ctx, tx, entry)
+		if err != nil {
+			return err
+		}
+		tx.notify("C")
+		return nil
+	})
+}
+
+func (s *sqliteStoreT) UpsertUser(ctx context.Context, user userT) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		"INSERT INTO users (id, name, email, department, session, expr, confirmed, student_id, claimed_department) VALUES ($1, $2, $3, $4, $5, $6, false, NULLIF($7, 0), NULLIF($8, ''))",
+		user.ID,
+		user.Name,
+		user.Email,
+		user.Department,
+		user.Session,
+		user.Expr,
+		user.StudentID,
+		user.ClaimedDepartment,
+	)
+	if err == nil {
+		return nil
+	}
+	err = mapSQLiteError(err)
+	if !errors.Is(err, errUniqueViolation) {
+		return err
+	}
+	_, err = s.db.ExecContext(
+		ctx,
+		"UPDATE users SET (name, email, department, session, expr, student_id, claimed_department) = ($1, $2, $3, $4, $5, NULLIF($6, 0), NULLIF($7, '')) WHERE id = $8",
+		user.Name,
+		user.Email,
+		user.Department,
+		user.Session,
+		user.Expr,
+		user.StudentID,
+		user.ClaimedDepartment,
+		user.ID,
+	)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	return nil
+}
+
+func (s *sqliteStoreT) GetUserBySession(ctx context.Context, session string) (userT, error) {
+	user, err := scanUser(s.db.QueryRowContext(ctx, selectUsers+" WHERE session = $1", session))
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, errNoSuchUser
+	} else if err != nil {
+		return user, wrapError(errUnexpectedDBError, err)
+	}
+	return user, nil
+}
+
+func (s *sqliteStoreT) GetUser(ctx context.Context, userID string) (userT, error) {
+	user, err := scanUser(s.db.QueryRowContext(ctx, selectUsers+" WHERE id = $1", userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, errNoSuchUser
+	} else if err != nil {
+		return user, wrapError(errUnexpectedDBError, err)
+	}
+	return user, nil
+}
+
+func (s *sqliteStoreT) GetUsers(ctx context.Context) ([]userT, error) {
+	rows, err := s.db.QueryContext(ctx, selectUsers)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	var result []userT
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, wrapError(errUnexpectedDBError, err)
+		}
+		result = append(result, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	return result, nil
+}
+
+func (s *sqliteStoreT) SetConfirmed(
+	ctx context.Context,
+	userID string,
+	confirmed bool,
+	entry auditEntryT,
+) error {
+	return s.inTx(ctx, func(tx *sqliteTxT) error {
+		_, err := tx.ExecContext(
+			ctx,
+			"UPDATE users SET confirmed = $2 WHERE id = $1",
+			userID,
+			confirmed,
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		return s.audit(ctx, tx, entry)
+	})
+}
+
+func (s *sqliteStoreT) GetChoices(ctx context.Context) ([]choiceT, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT userid, courseid, seltime FROM choices")
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	var result []choiceT
+	for rows.Next() {
+		var choice choiceT
+		err := rows.Scan(&choice.UserID, &choice.CourseID, &choice.Seltime)
+		if err != nil {
+			return nil, wrapError(errUnexpectedDBError, err)
+		}
+		result = append(result, choice)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	return result, nil
+}
+
+func (s *sqliteStoreT) GetUserChoices(ctx context.Context, userID string) ([]int, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT courseid FROM choices WHERE userid = $1",
+		userID,
+	)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	var courseIDs []int
+	for rows.Next() {
+		var courseID int
+		err := rows.Scan(&courseID)
+		if err != nil {
+			return nil, wrapError(errUnexpectedDBError, err)
+		}
+		courseIDs = append(courseIDs, courseID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	return courseIDs, nil
+}
+
+func (s *sqliteStoreT) Choose(
+	ctx context.Context,
+	userID string,
+	courseID int,
+	legalSex string,
+	yearGroup string,
+) (chooseResultT, seatsT, error) {
+	var seats seatsT
+	err := s.inTx(ctx, func(tx *sqliteTxT) error {
+		_, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO choices (seltime, userid, courseid, legal_sex, year_group) VALUES ($1, $2, $3, NULLIF($4, ''), $5)",
+			time.Now().UnixMicro(),
+			userID,
+			courseID,
+			legalSex,
+			yearGroup,
+		)
+		if err != nil {
+			return mapSQLiteError(err)
+		}
+
+		var nmax uint32
+		var quotaRelease int64
+		err = tx.QueryRowContext(
+			ctx,
+			chooseUpdate,
+			courseID,
+			legalSex,
+		).Scan(&seats.Total, &seats.F, &seats.M, &nmax, &quotaRelease)
+		if errors.Is(err, sql.ErrNoRows) {
+			course, err := scanCourse(tx.QueryRowContext(ctx, selectCourses+" WHERE id = $1", courseID))
+			if err != nil {
+				return err
+			}
+			return cmp.Or(checkSeats(course, course.loadSeats(), legalSex), errCourseFull)
+		} else if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+
+		quotas, err := sqliteQuotas(ctx, tx, selectQuotas+" WHERE courseid = $1", courseID)
+		if err != nil {
+			return err
+		}
+		err = checkTakenQuota(nmax, quotas[courseID], quotaRelease, seats.Total, yearGroup)
+		if err != nil {
+			return err
+		}
+		if _, ok := quotas[courseID][yearGroup]; ok {
+			_, err = tx.ExecContext(ctx, chooseQuotaUpdate, courseID, yearGroup)
+			if err != nil {
+				return wrapError(errUnexpectedDBError, err)
+			}
+		}
+		seats.Quotas = quotaSeats(quotas[courseID])
+
+		err = s.audit(ctx, tx, selfEntry(
+			userID,
+			auditChoose,
+			courseID,
+			auditOK,
+			fmt.Sprintf("%d/%d", seats.Total, nmax),
+		))
+		if err != nil {
+			return err
+		}
+		tx.notifySelected(courseID, seats)
+		return nil
+	})
+	result, err := chooseResult(ctx, s, userID, courseID, err)
+	return result, seats, err
+}
+
+func (s *sqliteStoreT) Unchoose(
+	ctx context.Context,
+	userID string,
+	courseID int,
+) (bool, seatsT, error) {
+	var seats seatsT
+	err := s.inTx(ctx, func(tx *sqliteTxT) error {
+		var legalSex, yearGroup string
+		err := tx.QueryRowContext(
+			ctx,
+			"DELETE FROM choices WHERE userid = $1 AND courseid = $2 RETURNING COALESCE(legal_sex, ''), COALESCE(year_group, '')",
+			userID,
+			courseID,
+		).Scan(&legalSex, &yearGroup)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errNotChosen
+		} else if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+
+		var nmax uint32
+		err = tx.QueryRowContext(
+			ctx,
+			unchooseUpdate,
+			courseID,
+			legalSex,
+		).Scan(&seats.Total, &seats.F, &seats.M, &nmax)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+
+		quotas, err := sqliteQuotas(ctx, tx, selectQuotas+" WHERE courseid = $1", courseID)
+		if err != nil {
+			return err
+		}
+		if quota, ok := quotas[courseID][yearGroup]; ok {
+			_, err = tx.ExecContext(ctx, unchooseQuotaUpdate, courseID, yearGroup)
+			if err != nil {
+				return wrapError(errUnexpectedDBError, err)
+			}
+			quota.Selected--
+		}
+		seats.Quotas = quotaSeats(quotas[courseID])
+
+		err = s.audit(ctx, tx, selfEntry(
+			userID,
+			auditUnchoose,
+			courseID,
+			auditOK,
+			fmt.Sprintf("%d/%d", seats.Total, nmax),
+		))
+		if err != nil {
+			return err
+		}
+		tx.notifySelected(courseID, seats)
+		return nil
+	})
+	deleted, err := unchooseResult(ctx, s, userID, courseID, err)
+	return deleted, seats, err
+}
+
+func (s *sqliteStoreT) Recount(ctx context.Context, check recountFuncT) error {
+	return s.inTx(ctx, func(tx *sqliteTxT) error {
+		counted, err := sqliteCountChoices(ctx, tx)
+		if err != nil {
+			return err
+		}
+		quotas, err := sqliteQuotas(ctx, tx, selectQuotas)
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(
+			ctx,
+			"SELECT id, title, selected, selected_f, selected_m FROM courses ORDER BY id",
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		defer rows.Close()
+		var counts []recountRowT
+		for rows.Next() {
+			var c recountRowT
+			err := rows.Scan(&c.ID, &c.Title, &c.Column.Total, &c.Column.F, &c.Column.M)
+			if err != nil {
+				return wrapError(errUnexpectedDBError, err)
+			}
+			c.Column.Quotas = quotaSeats(quotas[c.ID])
+			c.Choices = counted[c.ID]
+			counts = append(counts, c)
+		}
+		if err := rows.Err(); err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+
+		for _, c := range counts {
+			entry, fix := check(c.ID, c.Title, c.Choices, c.Column)
+			if !fix {
+				continue
+			}
+			if !c.Choices.equal(c.Column) {
+				_, err := tx.ExecContext(
+					ctx,
+					"UPDATE courses SET selected = $2, selected_f = $3, selected_m = $4 WHERE id = $1",
+					c.ID,
+					c.Choices.Total,
+					c.Choices.F,
+					c.Choices.M,
+				)
+				if err != nil {
+					return wrapError(errUnexpectedDBError, err)
+				}
+				for yearGroup, selected := range c.Choices.Quotas {
+					_, err := tx.ExecContext(
+						ctx,
+						"UPDATE quotas SET selected = $3 WHERE courseid = $1 AND yeargroup = $2",
+						c.ID,
+						yearGroup,
+						selected,
+					)
+					if err != nil {
+						return wrapError(errUnexpectedDBError, err)
+					}
+				}
+			}
+			err := s.audit(ctx, tx, entry)
+			if err != nil {
+				return err
+			}
+			tx.notifySelected(c.ID, c.Choices)
+		}
+		return nil
+	})
+}
+
+func sqliteCountChoices(ctx context.Context, tx *sqliteTxT) (map[int]seatsT, error) {
+	rows, err := tx.QueryContext(ctx, countChoices)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	counted := make(map[int]seatsT)
+	for rows.Next() {
+		var id int
+		var seats seatsT
+		err := rows.Scan(&id, &seats.Total, &seats.F, &seats.M)
+		if err != nil {
+			return nil, wrapError(errUnexpectedDBError, err)
+		}
+		counted[id] = seats
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+
+	rows, err = tx.QueryContext(ctx, countQuotaChoices)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var yearGroup string
+		var selected uint32
+		err := rows.Scan(&id, &yearGroup, &selected)
+		if err != nil {
+			return nil, wrapError(errUnexpectedDBError, err)
+		}
+		seats := counted[id]
+		if seats.Quotas == nil {
+			seats.Quotas = make(map[string]uint32)
+		}
+		seats.Quotas[yearGroup] = selected
+		counted[id] = seats
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	return counted, nil
+}
+
+/*
+ * Schedules are stored as Unix seconds.
+ */
+func (s *sqliteStoreT) LoadState(ctx context.Context, yeargroup string) (uint32, time.Time, error) {
+	var state uint32
+	var schedule int64
+	err := s.db.QueryRowContext(
+		ctx,
+		"SELECT state, schedule FROM states WHERE yeargroup = $1",
+		yeargroup,
+	).Scan(&state, &schedule)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err := s.db.ExecContext(
+			ctx,
+			"INSERT INTO states(yeargroup, state, schedule) VALUES ($1, $2, $3)",
+			yeargroup,
+			0,
+			time.Time{}.Unix(),
+		)
+		if err != nil {
+			return 0, time.Time{}, wrapError(errUnexpectedDBError, err)
+		}
+		return 0, time.Time{}, nil
+	} else if err != nil {
+		return 0, time.Time{}, wrapError(errUnexpectedDBError, err)
+	}
+	return state, time.Unix(schedule, 0), nil
+}
+
+func (s *sqliteStoreT) SetState(
+	ctx context.Context,
+	yeargroup string,
+	state uint32,
+	entry auditEntryT,
+) error {
+	return s.inTx(ctx, func(tx *sqliteTxT) error {
+		_, err := tx.ExecContext(
+			ctx,
+			"UPDATE states SET state = $2 WHERE yeargroup = $1",
+			yeargroup,
+			state,
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		err = s.audit(ctx, tx, entry)
+		if err != nil {
+			return err
+		}
+		tx.notify("S", yeargroup)
+		return nil
+	})
+}
+
+func (s *sqliteStoreT) OpenScheduled(
+	ctx context.Context,
+	yeargroup string,
+	entry auditEntryT,
+) (bool, error) {
+	opened := false
+	err := s.inTx(ctx, func(tx *sqliteTxT) error {
+		res, err := tx.ExecContext(
+			ctx,
+			"UPDATE states SET state = 2 WHERE yeargroup = $1 AND state = 3",
+			yeargroup,
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		if n == 0 {
+			return nil
+		}
+		err = s.audit(ctx, tx, entry)
+		if err != nil {
+			return err
+		}
+		tx.notify("S", yeargroup)
+		opened = true
+		return nil
+	})
+	return opened, err
+}
+
+func (s *sqliteStoreT) SetSchedule(
+	ctx context.Context,
+	yeargroup string,
+	schedule time.Time,
+	entry auditEntryT,
+) error {
+	return s.inTx(ctx, func(tx *sqliteTxT) error {
+		_, err := tx.ExecContext(
+			ctx,
+			"UPDATE states SET schedule = $2 WHERE yeargroup = $1",
+			yeargroup,
+			schedule.Unix(),
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		err = s.audit(ctx, tx, entry)
+		if err != nil {
+			return err
+		}
+		tx.notify("S", yeargroup)
+		return nil
+	})
+}
+
+func (s *sqliteStoreT) GetExpectedStudents(ctx context.Context) ([]expectedStudentT, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name, legal_sex, COALESCE(year_group, '') FROM expected_students")
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	var students []expectedStudentT
+	for rows.Next() {
+		var student expectedStudentT
+		err := rows.Scan(&student.ID, &student.Name, &student.LegalSex, &student.YearGroup)
+		if err != nil {
+			return nil, wrapError(errUnexpectedDBError, err)
+		}
+		students = append(students, student)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	return students, nil
+}
+
+func (s *sqliteStoreT) ReplaceExpectedStudents(
+	ctx context.Context,
+	students []expectedStudentT,
+	entry auditEntryT,
+) error {
+	return s.inTx(ctx, func(tx *sqliteTxT) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM expected_students")
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		for _, student := range students {
+			_, err := tx.ExecContext(
+				ctx,
+				"INSERT INTO expected_students(name, id, legal_sex, year_group) VALUES ($1, $2, $3, NULLIF($4, ''))",
+				student.Name,
+				student.ID,
+				student.LegalSex,
+				student.YearGroup,
+			)
+			if err != nil {
+				return mapSQLiteError(err)
+			}
+		}
+		_, err = tx.ExecContext(ctx, updateRosterDepartments)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		return s.audit(ctx, tx, entry)
+	})
+}
+
+func (s *sqliteStoreT) Audit(ctx context.Context, entry auditEntryT) error {
+	return s.audit(ctx, s.db, entry)
+}
+
+func (s *sqliteStoreT) QueryAudit(
+	ctx context.Context,
+	filter auditFilterT,
+) ([]auditEntryT, map[string]string, error) {
+	/* LIKE is already case-insensitive for ASCII in SQLite */
+	query, args := buildAuditQuery(filter, "LIKE")
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+
+	var entries []auditEntryT
+	names := make(map[string]string)
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows, names)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, wrapError(errUnexpectedDBError, err)
+	}
+	return entries, names, nil
+}
@@ -3,80 +3,53 @@ package main
 import (
 	"context"
 	"strconv"
-	"strings"
 )
 
 func eee(ctx context.Context) (res []student_ish, err error) {
-	ni, err := queryNameID(ctx, "SELECT name, id FROM expected_students")
+	expected, err := db.GetExpectedStudents(ctx)
 	if err != nil {
-		return nil, wrapError(errUnexpectedDBError, err)
+		return nil, err
 	}
+	ni := expectedStudentsByID(expected)
 
-	rows, err := db.Query(
-		ctx,
-		"SELECT name, email, department, confirmed FROM users",
-	)
+	users, err := db.GetUsers(ctx)
 	if err != nil {
-		return nil, wrapError(errUnexpectedDBError, err)
+		return nil, err
 	}
-	for {
-		if !rows.Next() {
-			err := rows.Err()
-			if err != nil {
-				return nil, wrapError(errUnexpectedDBError, err)
-			}
-			break
-		}
-		var currentUserName, currentEmail, currentDepartment string
-		var currentConfirmed bool
-		err := rows.Scan(
-			&currentUserName,
-			&currentEmail,
-			&currentDepartment,
-			&currentConfirmed,
-		)
-		if err != nil {
-			return nil, wrapError(errUnexpectedDBError, err)
-		}
-		unamepart, _, _ := strings.Cut(currentEmail, "@")
-		unamepart = strings.TrimPrefix(strings.TrimPrefix(unamepart, "s"), "S")
-		nii, _ := strconv.ParseInt(unamepart, 10, 64)
-		delete(ni, nii)
+	for _, user := range users {
+		studentID := userStudentID(user, expected, users)
+		delete(ni, studentID)
 
-		if currentDepartment == staffDepartment {
+		if user.Department == staffDepartment {
 			continue
 		}
 
 		res = append(
 			res,
 			student_ish{
-				Name:       currentUserName,
-				Email:      currentEmail,
-				Department: currentDepartment,
-				Status:     strconv.FormatBool(currentConfirmed),
+				StudentID:  studentID,
+				Name:       user.Name,
+				Email:      user.Email,
+				Department: user.Department,
+				Status:     strconv.FormatBool(user.Confirmed),
 			},
 		)
 	}
 
 	for k, v := range ni {
-		/*
-			res = append(
-				res,
-				[]string{
-					v,
-					"s" + strconv.FormatInt(k, 10) + "@ykpaoschool.cn",
-					"Unknown",
-					"never logged in",
-				},
-			)*/
+		department := v.YearGroup
+		if department == "" {
+			department = "Unknown"
+		}
 		res = append(
 			res,
 			student_ish{
-				Name:       v,
-				Email:      "s" + strconv.FormatInt(k, 10) + "@ykpaoschool.cn",
-				Department: "Unknown",
+				StudentID:  k,
+				Name:       v.Name,
+				Email:      studentEmail(k),
+				Department: department,
 				Status:     "never logged in",
-			},
+			}, //exhaustruct:ignore
 		)
 	}
 
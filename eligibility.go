@@ -0,0 +1,209 @@
+/*
+ * Rules on who may choose a course beyond its year groups
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+/*
+ * A course may be for invited students only, such as a team picked at
+ * tryouts; it may be in an exclusion set, of which each student may choose
+ * only one course, such as the sections of Model UN that meet on different
+ * days; and it may require other courses, by their Course ID, to be chosen
+ * first, in which case those may not be unchosen while it is chosen.
+ * These are stored in the courses table as space-separated lists.
+ */
+
+/*
+ * Parse space-separated student numbers, which are nil if there are none.
+ */
+func parseStudentIDs(s string) (map[int64]struct{}, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	result := make(map[int64]struct{}, len(fields))
+	for _, field := range fields {
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid student number: %s", field)
+		}
+		result[id] = struct{}{}
+	}
+	return result, nil
+}
+
+/*
+ * The inverse of parseStudentIDs, in ascending order.
+ */
+func formatStudentIDs(students map[int64]struct{}) string {
+	ids := getKeysOfMap(students)
+	slices.Sort(ids)
+	fields := make([]string, 0, len(ids))
+	for _, id := range ids {
+		fields = append(fields, strconv.FormatInt(id, 10))
+	}
+	return strings.Join(fields, " ")
+}
+
+/*
+ * The title of the first section of the course with the given Course ID,
+ * which is the Course ID itself if there is none.
+ */
+func courseTitleByCourseID(courseID string) string {
+	title := courseID
+	first := -1
+	courses.Range(func(_, value interface{}) bool {
+		course := value.(*courseT)
+		if course.CourseID == courseID && (first == -1 || course.ID < first) {
+			title = course.Title
+			first = course.ID
+		}
+		return true
+	})
+	return title
+}
+
+/*
+ * The courses a user has chosen.
+ */
+func getUserChosenCourses(ctx context.Context, userID string) ([]*courseT, error) {
+	choices, err := db.GetUserChoices(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("get user choices: %w", err)
+	}
+	result := make([]*courseT, 0, len(choices))
+	for _, courseID := range choices {
+		_course, ok := courses.Load(courseID)
+		if !ok {
+			return nil, errNoSuchCourse
+		}
+		result = append(result, _course.(*courseT))
+	}
+	return result, nil
+}
+
+func (course *courseT) invited(studentID int64) bool {
+	if course.Students == nil {
+		return true
+	}
+	_, ok := course.Students[studentID]
+	return ok
+}
+
+/*
+ * Whether the course's rules depend on what else a student has chosen.
+ */
+func (course *courseT) dependsOnChoices() bool {
+	return course.ExclusionSet != "" || len(course.Requires) != 0
+}
+
+/*
+ * Whether any course requires this one.
+ */
+func (course *courseT) required() bool {
+	found := false
+	courses.Range(func(_, value interface{}) bool {
+		found = slices.Contains(value.(*courseT).Requires, course.CourseID)
+		return !found
+	})
+	return found
+}
+
+/*
+ * Why the student with the given number, who has chosen the given courses,
+ * may not choose the course, as the rejection to count and the reason to
+ * give them, or empty strings if they may.
+ */
+func checkEligibility(course *courseT, studentID int64, chosen []*courseT) (string, string) {
+	if !course.invited(studentID) {
+		return rejectNotInvited, "By invitation only"
+	}
+	if course.ExclusionSet != "" {
+		for _, other := range chosen {
+			if other.ID != course.ID && other.ExclusionSet == course.ExclusionSet {
+				return rejectExcluded, "Cannot be taken with " + other.Title
+			}
+		}
+	}
+	for _, required := range course.Requires {
+		if !slices.ContainsFunc(chosen, func(other *courseT) bool {
+			return other.CourseID == required
+		}) {
+			return rejectRequires, "Choose " + courseTitleByCourseID(required) + " first"
+		}
+	}
+	return "", ""
+}
+
+/*
+ * A chosen course that requires the given one and would be left without it
+ * were it unchosen, or nil if there is none.
+ */
+func requiredBy(course *courseT, chosen []*courseT) *courseT {
+	for _, other := range chosen {
+		if other.ID != course.ID && other.CourseID == course.CourseID {
+			/* Another section still satisfies whatever requires it */
+			return nil
+		}
+	}
+	for _, other := range chosen {
+		if slices.Contains(other.Requires, course.CourseID) {
+			return other
+		}
+	}
+	return nil
+}
+
+/*
+ * The course's rules as a student should read them, for templates, or an
+ * empty string if there are none.
+ */
+func (course *courseT) EligibilityText() string {
+	var parts []string
+	if course.Students != nil {
+		parts = append(parts, "By invitation only")
+	}
+	if course.ExclusionSet != "" {
+		var titles []string
+		courses.Range(func(_, value interface{}) bool {
+			other := value.(*courseT)
+			if other.ID != course.ID &&
+				other.ExclusionSet == course.ExclusionSet &&
+				!slices.Contains(titles, other.Title) {
+				titles = append(titles, other.Title)
+			}
+			return true
+		})
+		if len(titles) != 0 {
+			slices.Sort(titles)
+			parts = append(parts, "Not with "+strings.Join(titles, ", "))
+		}
+	}
+	if len(course.Requires) != 0 {
+		titles := make([]string, 0, len(course.Requires))
+		for _, required := range course.Requires {
+			titles = append(titles, courseTitleByCourseID(required))
+		}
+		parts = append(parts, "Requires "+strings.Join(titles, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+/*
+ * Whether the student with the given number is invited to the course, or
+ * it is not by invitation, for templates.
+ */
+func (course *courseT) Invited(studentID int64) bool {
+	return course.invited(studentID)
+}
@@ -0,0 +1,133 @@
+/*
+ * Tests of the rules on who may choose a course
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+/*
+ * Courses for the tests below, which are not in the courses map, so those
+ * required are named by their Course ID.
+ */
+var (
+	eligMUNMonday = &courseT{
+		ID:           1001,
+		Title:        "Model UN (Monday)",
+		CourseID:     "ELIG-MUN",
+		ExclusionSet: "ELIG-MUN",
+	} //exhaustruct:ignore
+	eligMUNTuesday = &courseT{
+		ID:           1002,
+		Title:        "Model UN (Tuesday)",
+		CourseID:     "ELIG-MUN",
+		ExclusionSet: "ELIG-MUN",
+	} //exhaustruct:ignore
+	eligDebate = &courseT{
+		ID:           1003,
+		Title:        "Debate",
+		CourseID:     "ELIG-DEBATE",
+		ExclusionSet: "ELIG-MUN",
+	} //exhaustruct:ignore
+	eligTeam = &courseT{
+		ID:       1004,
+		Title:    "Varsity Team",
+		CourseID: "ELIG-TEAM",
+		Students: map[int64]struct{}{7: {}},
+	} //exhaustruct:ignore
+	eligCrisis = &courseT{
+		ID:       1005,
+		Title:    "Crisis Committee",
+		CourseID: "ELIG-CRISIS",
+		Requires: []string{"ELIG-MUN"},
+	} //exhaustruct:ignore
+	eligChair = &courseT{
+		ID:       1006,
+		Title:    "Chairing",
+		CourseID: "ELIG-CHAIR",
+		Requires: []string{"ELIG-MUN", "ELIG-DEBATE"},
+	} //exhaustruct:ignore
+)
+
+func TestCheckEligibility(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		course    *courseT
+		studentID int64
+		chosen    []*courseT
+		rejection string
+		reason    string
+	}{
+		{"no rules", eligMUNMonday, 1, nil, "", ""},
+		{"invited", eligTeam, 7, nil, "", ""},
+		{"not invited", eligTeam, 8, nil, rejectNotInvited, "By invitation only"},
+		{"no number", eligTeam, 0, nil, rejectNotInvited, "By invitation only"},
+		{
+			"another section excluded", eligMUNTuesday, 1,
+			[]*courseT{eligMUNMonday},
+			rejectExcluded, "Cannot be taken with Model UN (Monday)",
+		},
+		{
+			"another course excluded", eligDebate, 1,
+			[]*courseT{eligMUNMonday},
+			rejectExcluded, "Cannot be taken with Model UN (Monday)",
+		},
+		{
+			"itself, as when confirming", eligMUNMonday, 1,
+			[]*courseT{eligMUNMonday},
+			"", "",
+		},
+		{"required missing", eligCrisis, 1, nil, rejectRequires, "Choose ELIG-MUN first"},
+		{"required in one section", eligCrisis, 1, []*courseT{eligMUNTuesday}, "", ""},
+		{
+			"one of two required", eligChair, 1,
+			[]*courseT{eligMUNMonday},
+			rejectRequires, "Choose ELIG-DEBATE first",
+		},
+	} {
+		rejection, reason := checkEligibility(tc.course, tc.studentID, tc.chosen)
+		if rejection != tc.rejection || reason != tc.reason {
+			t.Errorf("%s: got %q %q, want %q %q", tc.desc, rejection, reason, tc.rejection, tc.reason)
+		}
+	}
+}
+
+func TestRequiredBy(t *testing.T) {
+	for _, tc := range []struct {
+		desc   string
+		course *courseT
+		chosen []*courseT
+		want   *courseT
+	}{
+		{"not required", eligMUNMonday, []*courseT{eligMUNMonday}, nil},
+		{
+			"required", eligMUNMonday,
+			[]*courseT{eligMUNMonday, eligCrisis},
+			eligCrisis,
+		},
+		{
+			"another section still satisfies it", eligMUNMonday,
+			[]*courseT{eligMUNMonday, eligMUNTuesday, eligCrisis},
+			nil,
+		},
+		{
+			"required by one of two", eligDebate,
+			[]*courseT{eligMUNMonday, eligDebate, eligChair},
+			eligChair,
+		},
+		{
+			"another course in the exclusion set does not satisfy it", eligMUNMonday,
+			[]*courseT{eligMUNMonday, eligDebate, eligChair},
+			eligChair,
+		},
+	} {
+		if got := requiredBy(tc.course, tc.chosen); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.desc, got, tc.want)
+		}
+	}
+}
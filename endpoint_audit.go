@@ -0,0 +1,144 @@
+/*
+ * Audit log viewer and export
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"net/http"
+)
+
+const auditViewLimit = 500
+
+func handleAudit(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_, username, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", http.StatusUnauthorized, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	filter, err := auditFilterFromRequest(req)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	filter.Limit = auditViewLimit
+
+	entries, names, err := db.QueryAudit(req.Context(), filter)
+	if err != nil {
+		return "", -1, err
+	}
+
+	err = tmpl.ExecuteTemplate(
+		w,
+		"audit",
+		struct {
+			Name    string
+			Form    map[string]string
+			Query   string
+			Entries []auditEntryT
+			Names   map[string]string
+			Limit   int
+			Actions []string
+		}{
+			username,
+			map[string]string{
+				"user":    req.FormValue("user"),
+				"action":  req.FormValue("action"),
+				"course":  req.FormValue("course"),
+				"outcome": req.FormValue("outcome"),
+				"since":   req.FormValue("since"),
+				"until":   req.FormValue("until"),
+			},
+			req.URL.RawQuery,
+			entries,
+			names,
+			auditViewLimit,
+			[]string{
+				auditChoose,
+				auditUnchoose,
+				auditConfirm,
+				auditUnconfirm,
+				auditImportCourses,
+				auditImportStudents,
+				auditSetState,
+				auditSetSchedule,
+				auditReconcile,
+				auditReloadConfig,
+			},
+		},
+	)
+	if err != nil {
+		return "", -1, wrapError(errCannotWriteTemplate, err)
+	}
+	return "", -1, nil
+}
+
+func handleExportAudit(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", http.StatusUnauthorized, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	filter, err := auditFilterFromRequest(req)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	format, err := exportFormat(req)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
+	entries, names, err := db.QueryAudit(req.Context(), filter)
+	if err != nil {
+		return "", -1, err
+	}
+
+	table := tableT{
+		Header: []string{
+			"Time",
+			"Actor",
+			"Actor Name",
+			"Target",
+			"Target Name",
+			"Course",
+			"Action",
+			"Source",
+			"IP",
+			"Outcome",
+			"Detail",
+		},
+		Rows: make([][]any, 0, len(entries)),
+	}
+	for _, entry := range entries {
+		var courseID any
+		if entry.CourseID != 0 {
+			courseID = entry.CourseID
+		}
+		table.Rows = append(table.Rows, []any{
+			entry.Time,
+			entry.Actor,
+			names[entry.Actor],
+			entry.Target,
+			names[entry.Target],
+			courseID,
+			entry.Action,
+			entry.Source,
+			entry.IP,
+			entry.Outcome,
+			entry.Detail,
+		})
+	}
+	err = writeTableDownload(w, "Audit", format, table)
+	if err != nil {
+		return "", -1, err
+	}
+	return "", -1, nil
+}
@@ -13,9 +13,10 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/MicahParks/jwkset"
 	"github.com/MicahParks/keyfunc/v3"
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/jackc/pgx/v5/pgconn"
+	"golang.org/x/time/rate"
 )
 
 var myKeyfunc keyfunc.Keyfunc
@@ -54,8 +55,8 @@ func generateAuthorizationURL() (string, error) { // \codelabel{generateAuthoriz
 	 */
 	return fmt.Sprintf(
 		"https://login.microsoftonline.com/ddd3d26c-b197-4d00-a32d-1ffd84c0c295/oauth2/authorize?client_id=%s&response_type=id_token%%20code&redirect_uri=%s%%2Fauth&response_mode=form_post&scope=openid+profile+email+User.Read&nonce=%s",
-		config.Auth.Client,
-		config.URL,
+		config().Auth.Client,
+		config().URL,
 		nonce,
 	), nil
 }
@@ -116,15 +117,55 @@ func handleAuth(w http.ResponseWriter, req *http.Request) (string, int, error) {
 		return "", http.StatusBadRequest, errors.New("failed to unpack claims")
 	}
 
-	var department string
-	var ok bool
-	department, ok = getDepartmentByUserIDOverride(claims.Oid)
-	if !ok {
-		department, ok = getDepartmentByGroups(claims.Groups)
-		if !ok {
-			return "", http.StatusBadRequest, errors.New("unknown department")
+	claimedDepartment, _ := getDepartmentByGroups(claims.Groups)
+	department, overridden := getDepartmentByUserIDOverride(claims.Oid)
+	if !overridden {
+		department = claimedDepartment
+	}
+
+	/*
+	 * Anyone who is not staff may be a student, including those whose
+	 * groups say nothing, as the roster may know them.
+	 */
+	var studentID int64
+	if department != staffDepartment {
+		var claim any
+		if name := config().Auth.Students.Claim; name != "" {
+			/* The signature has already been checked above */
+			mapClaims := jwt.MapClaims{}
+			_, _, err := jwt.NewParser().ParseUnverified(idTokenString, mapClaims)
+			if err != nil {
+				return "", http.StatusBadRequest, fmt.Errorf("parse jwt claims: %w", err)
+			}
+			claim = mapClaims[name]
+		}
+		expected, err := db.GetExpectedStudents(req.Context())
+		if err != nil {
+			return "", -1, err
+		}
+		studentID, err = resolveStudentID(
+			claim,
+			claims.Oid,
+			claims.Email,
+			claims.Name,
+			expected,
+			func() ([]userT, error) {
+				return db.GetUsers(req.Context())
+			},
+		)
+		if err != nil {
+			return "", -1, err
+		}
+		if !overridden {
+			department, err = rosterDepartment(studentID, department, expected)
+			if err != nil {
+				return "", http.StatusForbidden, err
+			}
 		}
 	}
+	if department == "" {
+		return "", http.StatusBadRequest, errUnknownDepartment
+	}
 
 	cookieValue, err := randomString(tokenLength)
 	if err != nil {
@@ -132,7 +173,7 @@ func handleAuth(w http.ResponseWriter, req *http.Request) (string, int, error) {
 	}
 
 	now := time.Now()
-	expr := now.Add(time.Duration(config.Auth.Expr) * time.Second)
+	expr := now.Add(time.Duration(config().Auth.Expr) * time.Second)
 	exprU := expr.Unix()
 
 	cookie := http.Cookie{
@@ -140,41 +181,24 @@ func handleAuth(w http.ResponseWriter, req *http.Request) (string, int, error) {
 		Value:    cookieValue,
 		SameSite: http.SameSiteLaxMode,
 		HttpOnly: true,
-		Secure:   config.Prod,
+		Secure:   config().Prod,
 		Expires:  expr,
 	} //exhaustruct:ignore
 
 	http.SetCookie(w, &cookie)
 
-	_, err = db.Exec(
-		req.Context(),
-		"INSERT INTO users (id, name, email, department, session, expr, confirmed) VALUES ($1, $2, $3, $4, $5, $6, false)",
-		claims.Oid,
-		claims.Name,
-		claims.Email,
-		department,
-		cookieValue,
-		exprU,
-	)
+	err = db.UpsertUser(req.Context(), userT{
+		ID:                claims.Oid,
+		Name:              claims.Name,
+		Email:             claims.Email,
+		Department:        department,
+		Session:           cookieValue,
+		Expr:              exprU,
+		StudentID:         studentID,
+		ClaimedDepartment: claimedDepartment,
+	}) //exhaustruct:ignore
 	if err != nil {
-		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) && pgErr.Code == pgErrUniqueViolation {
-			_, err := db.Exec(
-				req.Context(),
-				"UPDATE users SET (name, email, department, session, expr) = ($1, $2, $3, $4, $5) WHERE id = $6",
-				claims.Name,
-				claims.Email,
-				department,
-				cookieValue,
-				exprU,
-				claims.Oid,
-			)
-			if err != nil {
-				return "", -1, fmt.Errorf("update user: %w", err)
-			}
-		} else {
-			return "", -1, fmt.Errorf("insert user: %w", err)
-		}
+		return "", -1, fmt.Errorf("upsert user: %w", err)
 	}
 
 	http.Redirect(w, req, "/", http.StatusSeeOther)
@@ -182,9 +206,34 @@ func handleAuth(w http.ResponseWriter, req *http.Request) (string, int, error) {
 	return "", -1, nil
 }
 
+/*
+ * This is keyfunc.NewDefault, except that we watch the refreshes for the
+ * readiness check (see health.go).
+ */
 func setupJwks() error {
-	var err error
-	myKeyfunc, err = keyfunc.NewDefault([]string{config.Auth.Jwks})
+	storage, err := jwkset.NewStorageFromHTTP(
+		config().Auth.Jwks,
+		jwkset.HTTPClientStorageOptions{
+			Client: &http.Client{
+				Transport: jwksTransportT{http.DefaultTransport},
+			}, //exhaustruct:ignore
+			NoErrorReturnFirstHTTPReq: true,
+			RefreshErrorHandler:       recordJwksError,
+			RefreshInterval:           jwksRefreshInterval,
+		}, //exhaustruct:ignore
+	)
+	if err != nil {
+		return fmt.Errorf("setup jwks: %w", err)
+	}
+	client, err := jwkset.NewHTTPClient(jwkset.HTTPClientOptions{
+		HTTPURLs:          map[string]jwkset.Storage{config().Auth.Jwks: storage},
+		RateLimitWaitMax:  time.Minute,
+		RefreshUnknownKID: rate.NewLimiter(rate.Every(5*time.Minute), 1),
+	}) //exhaustruct:ignore
+	if err != nil {
+		return fmt.Errorf("setup jwks: %w", err)
+	}
+	myKeyfunc, err = keyfunc.New(keyfunc.Options{Storage: client}) //exhaustruct:ignore
 	if err != nil {
 		return fmt.Errorf("setup jwks: %w", err)
 	}
@@ -193,7 +242,7 @@ func setupJwks() error {
 
 func getDepartmentByGroups(groups []string) (string, bool) {
 	for _, g := range groups {
-		d, ok := config.Auth.Departments[g]
+		d, ok := config().Auth.Departments[g]
 		if ok {
 			return d, true
 		}
@@ -202,9 +251,34 @@ func getDepartmentByGroups(groups []string) (string, bool) {
 }
 
 func getDepartmentByUserIDOverride(userID string) (string, bool) {
-	d, ok := config.Auth.Udepts[userID]
+	d, ok := config().Auth.Udepts[userID]
 	if ok {
 		return d, true
 	}
 	return "", false
 }
+
+/*
+ * The year group the roster puts a student in, which overrules the one from
+ * their groups. Students the roster does not give a year group keep theirs,
+ * as do those who are not on it at all, unless auth.students.refuse_unlisted
+ * is set. Nobody is refused while the roster is empty.
+ */
+func rosterDepartment(studentID int64, claimed string, expected []expectedStudentT) (string, error) {
+	if len(expected) == 0 {
+		return claimed, nil
+	}
+	for _, student := range expected {
+		if studentID == 0 || student.ID != studentID {
+			continue
+		}
+		if student.YearGroup != "" {
+			return student.YearGroup, nil
+		}
+		return claimed, nil
+	}
+	if config().Auth.Students.RefuseUnlisted {
+		return "", errNotOnRoster
+	}
+	return claimed, nil
+}
@@ -0,0 +1,63 @@
+/*
+ * Staff diagnostics page
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"net/http"
+)
+
+func handleDiagnostics(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	userID, username, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", http.StatusUnauthorized, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	if req.Method == http.MethodPost {
+		switch req.FormValue("action") {
+		case "reload-config":
+			/* The outcome is shown on the page */
+			reloadConfig(req.Context(), userID)
+		case "reconcile":
+			_, err := reconcileCounts(req.Context(), userID)
+			if err != nil {
+				return "", -1, err
+			}
+		default:
+			return "", http.StatusBadRequest, errUnknownAction
+		}
+		http.Redirect(w, req, "/diagnostics", http.StatusSeeOther)
+		return "", -1, nil
+	}
+
+	err = tmpl.ExecuteTemplate(
+		w,
+		"diagnostics",
+		struct {
+			Name      string
+			Reconcile *reconcileReportT
+			Interval  int
+			Dropped   uint64
+			SendQ     int
+			Reload    *configReloadReportT
+		}{
+			username,
+			lastReconcile.Load(),
+			config().Perf.ReconcileInterval,
+			sendqDropped.Load(),
+			config().Perf.SendQ,
+			lastConfigReload.Load(),
+		},
+	)
+	if err != nil {
+		return "", -1, wrapError(errCannotWriteTemplate, err)
+	}
+	return "", -1, nil
+}
@@ -8,11 +8,10 @@
 package main
 
 import (
-	"encoding/csv"
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
-	"strings"
 )
 
 func handleExportChoices(
@@ -26,82 +25,77 @@ func handleExportChoices(
 	if department != staffDepartment {
 		return "", http.StatusForbidden, errors.New("staff only")
 	}
+	format, err := exportFormat(req)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
 
-	type userCacheT struct {
-		Name       string
-		StudentID  string
-		Department string
+	table, err := choicesTable(req.Context())
+	if err != nil {
+		return "", -1, err
 	}
-	userCacheMap := make(map[string]userCacheT)
+	err = writeTableDownload(w, "Choices", format, table)
+	if err != nil {
+		return "", -1, err
+	}
+	return "", -1, nil
+}
+
+/*
+ * Every choice, with the student and the course.
+ */
+func choicesTable(ctx context.Context) (tableT, error) {
+	table := tableT{
+		Header: []string{
+			"Student Name",
+			"Student ID",
+			"Grade/Year",
+			"Group/Activity",
+			"Container",
+			"Section ID",
+			"Course ID",
+		},
+	} //exhaustruct:ignore
 
-	rows, err := db.Query(req.Context(), "SELECT userid, courseid FROM choices")
+	expected, err := db.GetExpectedStudents(ctx)
 	if err != nil {
-		return "", -1, fmt.Errorf("query choices: %w", err)
+		return table, err
 	}
-	output := make([][]string, 0)
-	for {
-		if !rows.Next() {
-			err := rows.Err()
-			if err != nil {
-				return "", -1, fmt.Errorf("read next choice: %w", err)
-			}
-			break
-		}
-		var currentUserID,
-			currentUserName,
-			currentStudentID,
-			currentDepartment string
-		var currentCourseID int
-		err := rows.Scan(&currentUserID, &currentCourseID)
-		if err != nil {
-			return "", -1, fmt.Errorf("scan choice: %w", err)
-		}
-		currentUserCache, ok := userCacheMap[currentUserID]
-		if ok {
-			currentUserName = currentUserCache.Name
-			currentDepartment = currentUserCache.Department
-			currentStudentID = currentUserCache.StudentID
-		} else {
-			var currentUserEmail string
-			err := db.QueryRow(
-				req.Context(),
-				"SELECT name, email, department FROM users WHERE id = $1",
-				currentUserID,
-			).Scan(
-				&currentUserName,
-				&currentUserEmail,
-				&currentDepartment,
-			)
-			if err != nil {
-				return "", -1, fmt.Errorf("scan user info: %w")
-			}
-			before, _, found := strings.Cut(currentUserEmail, "@")
-			if found {
-				currentStudentID, _ = strings.CutPrefix(returnFirst(strings.CutPrefix(before, "s")), "S")
-			} else {
-				currentStudentID = currentUserEmail
-			}
-			userCacheMap[currentUserID] = userCacheT{
-				Name:       currentUserName,
-				StudentID:  currentStudentID,
-				Department: currentDepartment,
-			}
+	userMap := make(map[string]userT)
+	users, err := db.GetUsers(ctx)
+	if err != nil {
+		return table, fmt.Errorf("query users: %w", err)
+	}
+	for _, user := range users {
+		user.StudentID = userStudentID(user, expected, users)
+		userMap[user.ID] = user
+	}
+
+	choices, err := db.GetChoices(ctx)
+	if err != nil {
+		return table, fmt.Errorf("query choices: %w", err)
+	}
+	table.Rows = make([][]any, 0, len(choices))
+	for _, choice := range choices {
+		user, ok := userMap[choice.UserID]
+		if !ok {
+			return table, errNoSuchUser
 		}
 
-		_course, ok := courses.Load(currentCourseID)
+		_course, ok := courses.Load(choice.CourseID)
 		if !ok {
-			return "", -1, fmt.Errorf("no such course")
+			return table, fmt.Errorf("no such course")
 		}
 		course := _course.(*courseT)
 		if course == nil {
-			return "", -1, fmt.Errorf("no such course")
+			return table, fmt.Errorf("no such course")
 		}
-		output = append(
-			output,
-			[]string{
-				currentUserName,
-				currentStudentID,
-				currentDepartment,
+		table.Rows = append(
+			table.Rows,
+			[]any{
+				user.Name,
+				studentIDCell(user.StudentID),
+				user.Department,
 				course.Title,
 				course.Group,
 				course.SectionID,
@@ -109,33 +103,5 @@ func handleExportChoices(
 			},
 		)
 	}
-
-	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
-	w.Header().Set("Content-Disposition", "attachment;filename=cca_choices.csv")
-	_, err = w.Write([]byte{0xEF, 0xBB, 0xBF}) // utf8 bom because excel
-	if err != nil {
-		return "", -1, fmt.Errorf("write http stream: %w", err)
-	}
-	csvWriter := csv.NewWriter(w)
-	err = csvWriter.Write([]string{
-		"Student Name",
-		"Student ID",
-		"Grade/Year",
-		"Group/Activity",
-		"Container",
-		"Section ID",
-		"Course ID",
-	})
-	if err != nil {
-		return "", -1, fmt.Errorf("write http stream: %w", err)
-	}
-	err = csvWriter.WriteAll(output)
-	if err != nil {
-		return "", -1, fmt.Errorf("write http stream: %w", err)
-	}
-	csvWriter.Flush()
-	if csvWriter.Error() != nil {
-		return "", -1, fmt.Errorf("write http stream: %w", err)
-	}
-	return "", -1, nil
+	return table, nil
 }
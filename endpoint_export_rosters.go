@@ -0,0 +1,242 @@
+/*
+ * Per-course rosters and attendance sheets
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+/*
+ * How many blank columns for session dates the attendance sheets have,
+ * unless the "sessions" query parameter says otherwise
+ */
+const (
+	attendanceSessionsDefault = 10
+	attendanceSessionsMax     = 40
+)
+
+type rosterStudentT struct {
+	Name      string
+	StudentID int64 /* 0 if unknown */
+	YearGroup string
+	Email     string
+}
+
+type rosterT struct {
+	Course   *courseT
+	Slot     string
+	Students []rosterStudentT
+}
+
+/*
+ * Gather the students in each course, including courses nobody chose, by
+ * group and then title, with students by name.
+ */
+func getRosters(ctx context.Context) ([]rosterT, error) {
+	expected, err := db.GetExpectedStudents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	users, err := db.GetUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("query users: %w", err)
+	}
+	userMap := make(map[string]userT, len(users))
+	for _, user := range users {
+		user.StudentID = userStudentID(user, expected, users)
+		userMap[user.ID] = user
+	}
+
+	rosterMap := make(map[int]*rosterT)
+	courses.Range(func(_, value interface{}) bool {
+		course := value.(*courseT)
+		rosterMap[course.ID] = &rosterT{
+			Course: course,
+			Slot:   course.Group + " (" + courseGroups[course.Group] + ")",
+		} //exhaustruct:ignore
+		return true
+	})
+
+	choices, err := db.GetChoices(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("query choices: %w", err)
+	}
+	for _, choice := range choices {
+		user, ok := userMap[choice.UserID]
+		if !ok {
+			return nil, errNoSuchUser
+		}
+		roster, ok := rosterMap[choice.CourseID]
+		if !ok {
+			return nil, errNoSuchCourse
+		}
+		roster.Students = append(roster.Students, rosterStudentT{
+			Name:      user.Name,
+			StudentID: user.StudentID,
+			YearGroup: user.Department,
+			Email:     user.Email,
+		})
+	}
+
+	rosters := make([]rosterT, 0, len(rosterMap))
+	for _, roster := range rosterMap {
+		slices.SortFunc(roster.Students, func(a, b rosterStudentT) int {
+			return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.StudentID, b.StudentID))
+		})
+		rosters = append(rosters, *roster)
+	}
+	slices.SortFunc(rosters, func(a, b rosterT) int {
+		return cmp.Or(
+			cmp.Compare(a.Course.Group, b.Course.Group),
+			cmp.Compare(a.Course.Title, b.Course.Title),
+			cmp.Compare(a.Course.ID, b.Course.ID),
+		)
+	})
+	return rosters, nil
+}
+
+/*
+ * Write the rosters as a spreadsheet with a sheet for each course.
+ */
+func writeRostersXLSX(ctx context.Context, w io.Writer) error {
+	rosters, err := getRosters(ctx)
+	if err != nil {
+		return err
+	}
+	return writeXLSX(w, rosterSheets(rosters))
+}
+
+/*
+ * A sheet for each course, which starts with the details of the course.
+ */
+func rosterSheets(rosters []rosterT) []xlsxSheetT {
+	sheets := make([]xlsxSheetT, 0, len(rosters))
+	for _, roster := range rosters {
+		course := roster.Course
+		rows := [][]any{
+			{"Course", course.Title},
+			{"Section ID", course.SectionID},
+			{"Course ID", course.CourseID},
+			{"Teacher", course.Teacher},
+			{"Location", course.Location},
+			{"Slot", roster.Slot},
+			{"Students", len(roster.Students)},
+			{},
+			{"Student Name", "Student ID", "Grade/Year", "Email"},
+		}
+		for _, student := range roster.Students {
+			rows = append(rows, []any{
+				student.Name,
+				studentIDCell(student.StudentID),
+				student.YearGroup,
+				student.Email,
+			})
+		}
+		sheets = append(sheets, xlsxSheetT{
+			/* IDs keep names unique when titles are cut short */
+			Name: strconv.Itoa(course.ID) + " " + course.Title,
+			Rows: rows,
+		})
+	}
+	return sheets
+}
+
+func handleExportRosters(
+	w http.ResponseWriter,
+	req *http.Request,
+) (string, int, error) {
+	_, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	var buf bytes.Buffer
+	err = writeRostersXLSX(req.Context(), &buf)
+	if err != nil {
+		return "", -1, err
+	}
+
+	w.Header().Set("Content-Type", xlsxContentType)
+	w.Header().Set("Content-Disposition", "attachment;filename=cca_rosters.xlsx")
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		return "", -1, errHTTPWrite
+	}
+	return "", -1, nil
+}
+
+/*
+ * Printable attendance sheets, one page per course. The "course" query
+ * parameter limits them to one course.
+ */
+func handleAttendance(
+	w http.ResponseWriter,
+	req *http.Request,
+) (string, int, error) {
+	_, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	sessions := attendanceSessionsDefault
+	if s := req.FormValue("sessions"); s != "" {
+		sessions, err = strconv.Atoi(s)
+		if err != nil || sessions < 0 || sessions > attendanceSessionsMax {
+			return "", http.StatusBadRequest, wrapAny(
+				errInvalidForm,
+				fmt.Sprintf("sessions must be between 0 and %d", attendanceSessionsMax),
+			)
+		}
+	}
+
+	rosters, err := getRosters(req.Context())
+	if err != nil {
+		return "", -1, err
+	}
+	if s := req.FormValue("course"); s != "" {
+		courseID, err := strconv.Atoi(s)
+		if err != nil {
+			return "", http.StatusBadRequest, wrapError(errInvalidForm, err)
+		}
+		rosters = slices.DeleteFunc(rosters, func(roster rosterT) bool {
+			return roster.Course.ID != courseID
+		})
+		if len(rosters) == 0 {
+			return "", http.StatusNotFound, errNoSuchCourse
+		}
+	}
+
+	err = tmpl.ExecuteTemplate(
+		w,
+		"attendance",
+		struct {
+			Rosters  []rosterT
+			Sessions []struct{}
+		}{
+			rosters,
+			make([]struct{}, sessions),
+		},
+	)
+	if err != nil {
+		return "", -1, wrapError(errCannotWriteTemplate, err)
+	}
+	return "", -1, nil
+}
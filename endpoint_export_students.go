@@ -8,11 +8,8 @@
 package main
 
 import (
-	"encoding/csv"
-	"fmt"
+	"context"
 	"net/http"
-	"strconv"
-	"strings"
 )
 
 func handleExportStudents(
@@ -26,101 +23,84 @@ func handleExportStudents(
 	if department != staffDepartment {
 		return "", -1, errStaffOnly
 	}
+	format, err := exportFormat(req)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
 
-	ni, err := queryNameID(req.Context(), "SELECT name, id FROM expected_students")
+	table, err := studentsTable(req.Context())
 	if err != nil {
-		return "", -1, wrapError(errUnexpectedDBError, err)
+		return "", -1, err
 	}
+	err = writeTableDownload(w, "Students", format, table)
+	if err != nil {
+		return "", -1, err
+	}
+
+	return "", -1, nil
+}
 
-	rows, err := db.Query(
-		req.Context(),
-		"SELECT name, email, department, confirmed FROM users",
-	)
+/*
+ * Every student who has signed in or is expected to, and whether they have
+ * confirmed their choices.
+ */
+func studentsTable(ctx context.Context) (tableT, error) {
+	table := tableT{
+		Header: []string{
+			"Student Name",
+			"Student ID",
+			"Email",
+			"Grade/Year",
+			"Confirmed",
+		},
+	} //exhaustruct:ignore
+
+	expected, err := db.GetExpectedStudents(ctx)
 	if err != nil {
-		return "", -1, wrapError(errUnexpectedDBError, err)
+		return table, err
 	}
-	output := make([][]string, 0)
-	for {
-		if !rows.Next() {
-			err := rows.Err()
-			if err != nil {
-				return "", -1, wrapError(errUnexpectedDBError, err)
-			}
-			break
-		}
-		var currentUserName, currentEmail, currentDepartment string
-		var currentConfirmed bool
-		err := rows.Scan(
-			&currentUserName,
-			&currentEmail,
-			&currentDepartment,
-			&currentConfirmed,
-		)
-		if err != nil {
-			return "", -1, wrapError(errUnexpectedDBError, err)
-		}
-		unamepart, _, _ := strings.Cut(currentEmail, "@")
-		unamepart = strings.TrimPrefix(strings.TrimPrefix(unamepart, "s"), "S")
-		nii, _ := strconv.ParseInt(unamepart, 10, 64)
-		delete(ni, nii)
+	ni := expectedStudentsByID(expected)
+
+	users, err := db.GetUsers(ctx)
+	if err != nil {
+		return table, err
+	}
+	for _, user := range users {
+		studentID := userStudentID(user, expected, users)
+		delete(ni, studentID)
 
-		if currentDepartment == staffDepartment {
+		if user.Department == staffDepartment {
 			continue
 		}
 
-		output = append(
-			output,
-			[]string{
-				currentUserName,
-				currentEmail,
-				currentDepartment,
-				strconv.FormatBool(currentConfirmed),
+		table.Rows = append(
+			table.Rows,
+			[]any{
+				user.Name,
+				studentIDCell(studentID),
+				user.Email,
+				user.Department,
+				user.Confirmed,
 			},
 		)
 	}
 
 	for k, v := range ni {
-		output = append(
-			output,
-			[]string{
-				v,
-				"s" + strconv.FormatInt(k, 10) + "@ykpaoschool.cn",
-				"Unknown",
+		yearGroup := v.YearGroup
+		if yearGroup == "" {
+			yearGroup = "Unknown"
+		}
+		table.Rows = append(
+			table.Rows,
+			[]any{
+				v.Name,
+				k,
+				nil,
+				yearGroup,
 				"never logged in",
 			},
 		)
 	}
 
-	w.Header().Set(
-		"Content-Type",
-		"text/csv; charset=utf-8",
-	)
-	w.Header().Set(
-		"Content-Disposition",
-		"attachment;filename=cca_students.csv",
-	)
-	_, err = w.Write([]byte{0xEF, 0xBB, 0xBF}) // utf8 bom for excel
-	if err != nil {
-		return "", -1, fmt.Errorf("write http stream: %w", err)
-	}
-	csvWriter := csv.NewWriter(w)
-	err = csvWriter.Write([]string{
-		"Student Name",
-		"Student ID",
-		"Grade/Year",
-		"Confirmed",
-	})
-	if err != nil {
-		return "", -1, errHTTPWrite
-	}
-	err = csvWriter.WriteAll(output)
-	if err != nil {
-		return "", -1, errHTTPWrite
-	}
-	csvWriter.Flush()
-	if csvWriter.Error() != nil {
-		return "", -1, errHTTPWrite
-	}
-
-	return "", -1, nil
+	return table, nil
 }
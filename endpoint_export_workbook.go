@@ -0,0 +1,160 @@
+/*
+ * Everything in one spreadsheet
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+/*
+ * Each course and how full it is, in the same order as the rosters.
+ */
+func summaryTable(rosters []rosterT) tableT {
+	table := tableT{
+		Header: []string{
+			"ID",
+			"Title",
+			"Type",
+			"Group",
+			"Teacher",
+			"Location",
+			"Section ID",
+			"Course ID",
+			"Year Groups",
+			"Max",
+			"Selected",
+			"Remaining",
+			"Max F",
+			"Max M",
+			"Selected F",
+			"Selected M",
+			"Quotas",
+			"Quota Release",
+			"Students",
+			"Exclusion Set",
+			"Requires",
+		},
+		Rows: make([][]any, 0, len(rosters)),
+	}
+	for _, roster := range rosters {
+		course := roster.Course
+		seats := course.loadSeats()
+		selected := seats.Total
+		remaining := 0
+		if selected < course.Max {
+			remaining = int(course.Max - selected)
+		}
+		/* Blank for courses not limited by legal sex */
+		sexSeats := []any{"", "", "", ""}
+		if course.sexLimited() {
+			sexSeats = []any{course.MaxF, course.MaxM, seats.F, seats.M}
+		}
+		/* Such as "Y9 3/10, Y10 2/10", or blank if there are none */
+		quotas := make([]string, 0, len(course.Quotas))
+		for _, yearGroup := range course.QuotaYearGroups() {
+			quotas = append(quotas, fmt.Sprintf(
+				"%s %d/%d",
+				yearGroup,
+				seats.Quotas[yearGroup],
+				course.Quotas[yearGroup].Max,
+			))
+		}
+		var quotaRelease any
+		if !course.QuotaRelease.IsZero() {
+			quotaRelease = course.QuotaRelease
+		}
+		table.Rows = append(table.Rows, append([]any{
+			course.ID,
+			course.Title,
+			course.Type,
+			course.Group,
+			course.Teacher,
+			course.Location,
+			course.SectionID,
+			course.CourseID,
+			yearGroupsNumberToString(course.YearGroups),
+			course.Max,
+			selected,
+			remaining,
+		}, append(
+			sexSeats,
+			strings.Join(quotas, ", "),
+			quotaRelease,
+			formatStudentIDs(course.Students),
+			course.ExclusionSet,
+			strings.Join(course.Requires, " "),
+		)...))
+	}
+	return table
+}
+
+/*
+ * Write a spreadsheet with a summary of the courses, every choice, every
+ * student, those who have not finished, and then the roster of each course.
+ */
+func writeWorkbookXLSX(ctx context.Context, w io.Writer) error {
+	rosters, err := getRosters(ctx)
+	if err != nil {
+		return err
+	}
+	choices, err := choicesTable(ctx)
+	if err != nil {
+		return err
+	}
+	students, err := studentsTable(ctx)
+	if err != nil {
+		return err
+	}
+	incomplete, err := getIncompleteStudents(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	sheets := make([]xlsxSheetT, 0, 4+len(rosters))
+	sheets = append(
+		sheets,
+		summaryTable(rosters).sheet("Summary"),
+		choices.sheet("Choices"),
+		students.sheet("Students"),
+		incompleteTable(incomplete).sheet("Incomplete"),
+	)
+	sheets = append(sheets, rosterSheets(rosters)...)
+	return writeXLSX(w, sheets)
+}
+
+func handleExportWorkbook(
+	w http.ResponseWriter,
+	req *http.Request,
+) (string, int, error) {
+	_, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	var buf bytes.Buffer
+	err = writeWorkbookXLSX(req.Context(), &buf)
+	if err != nil {
+		return "", -1, err
+	}
+
+	w.Header().Set("Content-Type", xlsxContentType)
+	w.Header().Set("Content-Disposition", "attachment;filename=cca.xlsx")
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		return "", -1, errHTTPWrite
+	}
+	return "", -1, nil
+}
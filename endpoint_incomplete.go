@@ -0,0 +1,263 @@
+/*
+ * Students who have not finished choosing
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type incompleteStudentT struct {
+	Name      string
+	StudentID int64 /* 0 if unknown */
+	Email     string
+	YearGroup string /* empty if unknown */
+	Choices   int
+	Reasons   []string
+}
+
+/*
+ * Every student, expected or logged in, who has not confirmed their
+ * choices, with why, in the given year group or all of them if it is empty.
+ * Students who never logged in are in the year group the roster gives them,
+ * if any, so those it does not are only included when all year groups are.
+ */
+func getIncompleteStudents(ctx context.Context, yearGroup string) ([]incompleteStudentT, error) {
+	expectedList, err := db.GetExpectedStudents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	expected := expectedStudentsByID(expectedList)
+	users, err := db.GetUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("query users: %w", err)
+	}
+	choices, err := db.GetChoices(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("query choices: %w", err)
+	}
+
+	userChoices := make(map[string][]*courseT)
+	for _, choice := range choices {
+		_course, ok := courses.Load(choice.CourseID)
+		if !ok {
+			return nil, errNoSuchCourse
+		}
+		userChoices[choice.UserID] = append(userChoices[choice.UserID], _course.(*courseT))
+	}
+
+	/* Groups with a course open to each year group */
+	groupsOffered := make(map[string][]string)
+	for yg, bit := range yearGroupsNumberBits {
+		offered := make(map[string]struct{})
+		courses.Range(func(_, value interface{}) bool {
+			course := value.(*courseT)
+			if course.YearGroups&bit != 0 {
+				offered[course.Group] = struct{}{}
+			}
+			return true
+		})
+		groups := getKeysOfMap(offered)
+		slices.Sort(groups)
+		groupsOffered[yg] = groups
+	}
+
+	result := make([]incompleteStudentT, 0)
+	for _, user := range users {
+		studentID := userStudentID(user, expectedList, users)
+		delete(expected, studentID)
+		if user.Department == staffDepartment || user.Confirmed {
+			continue
+		}
+		if yearGroup != "" && user.Department != yearGroup {
+			continue
+		}
+
+		student := incompleteStudentT{
+			Name:      user.Name,
+			StudentID: studentID,
+			Email:     user.Email,
+			YearGroup: user.Department,
+			Choices:   len(userChoices[user.ID]),
+		} //exhaustruct:ignore
+		if student.Choices == 0 {
+			student.Reasons = []string{"no choices"}
+			result = append(result, student)
+			continue
+		}
+
+		types := make(userCourseTypesT)
+		groups := make(map[string]struct{})
+		for _, course := range userChoices[user.ID] {
+			types[course.Type]++
+			groups[course.Group] = struct{}{}
+		}
+		for _, courseType := range []string{sport, nonSport} {
+			minimum, err := getCourseTypeMinimumForYearGroup(user.Department, courseType)
+			if err != nil {
+				/* Not a year group we have requirements for */
+				continue
+			}
+			if types[courseType] < minimum {
+				student.Reasons = append(
+					student.Reasons,
+					fmt.Sprintf("missing %d %s", minimum-types[courseType], courseType),
+				)
+			}
+		}
+		met := len(student.Reasons) == 0
+		var empty []string
+		for _, group := range groupsOffered[user.Department] {
+			if _, ok := groups[group]; !ok {
+				empty = append(empty, group)
+			}
+		}
+		if len(empty) != 0 {
+			student.Reasons = append(student.Reasons, "no course in "+strings.Join(empty, ", "))
+		}
+		if met {
+			student.Reasons = append(student.Reasons, "not confirmed")
+		}
+		result = append(result, student)
+	}
+
+	for id, student := range expected {
+		if yearGroup != "" && student.YearGroup != yearGroup {
+			continue
+		}
+		result = append(result, incompleteStudentT{
+			Name:      student.Name,
+			StudentID: id,
+			Email:     studentEmail(id),
+			YearGroup: student.YearGroup,
+			Reasons:   []string{"never logged in"},
+		}) //exhaustruct:ignore
+	}
+
+	slices.SortFunc(result, func(a, b incompleteStudentT) int {
+		return cmp.Or(
+			cmp.Compare(yearGroupsNumberBits[a.YearGroup], yearGroupsNumberBits[b.YearGroup]),
+			cmp.Compare(a.Name, b.Name),
+			cmp.Compare(a.StudentID, b.StudentID),
+		)
+	})
+	return result, nil
+}
+
+func incompleteTable(students []incompleteStudentT) tableT {
+	table := tableT{
+		Header: []string{
+			"Student Name",
+			"Student ID",
+			"Email",
+			"Grade/Year",
+			"Choices",
+			"Reason",
+		},
+		Rows: make([][]any, 0, len(students)),
+	}
+	for _, student := range students {
+		table.Rows = append(table.Rows, []any{
+			student.Name,
+			studentIDCell(student.StudentID),
+			student.Email,
+			student.YearGroup,
+			student.Choices,
+			strings.Join(student.Reasons, "; "),
+		})
+	}
+	return table
+}
+
+/*
+ * The year group asked for by the "year" query parameter, if any.
+ */
+func yearGroupFromRequest(req *http.Request) (string, error) {
+	yearGroup := req.FormValue("year")
+	if yearGroup == "" {
+		return "", nil
+	}
+	if _, ok := yearGroupsNumberBits[yearGroup]; !ok {
+		return "", errNoSuchYearGroup
+	}
+	return yearGroup, nil
+}
+
+func handleIncomplete(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_, username, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", http.StatusUnauthorized, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+	yearGroup, err := yearGroupFromRequest(req)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
+	students, err := getIncompleteStudents(req.Context(), yearGroup)
+	if err != nil {
+		return "", -1, err
+	}
+
+	yearGroups := getKeysOfMap(yearGroupsNumberBits)
+	sortYearGroups(yearGroups)
+
+	err = tmpl.ExecuteTemplate(
+		w,
+		"incomplete",
+		struct {
+			Name       string
+			YearGroup  string
+			YearGroups []string
+			Students   []incompleteStudentT
+		}{
+			username,
+			yearGroup,
+			yearGroups,
+			students,
+		},
+	)
+	if err != nil {
+		return "", -1, wrapError(errCannotWriteTemplate, err)
+	}
+	return "", -1, nil
+}
+
+func handleExportIncomplete(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", http.StatusUnauthorized, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+	yearGroup, err := yearGroupFromRequest(req)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	format, err := exportFormat(req)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
+	students, err := getIncompleteStudents(req.Context(), yearGroup)
+	if err != nil {
+		return "", -1, err
+	}
+	err = writeTableDownload(w, "Incomplete", format, incompleteTable(students))
+	if err != nil {
+		return "", -1, err
+	}
+	return "", -1, nil
+}
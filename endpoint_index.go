@@ -15,7 +15,7 @@ import (
 )
 
 func handleIndex(w http.ResponseWriter, req *http.Request) (string, int, error) {
-	_, username, department, err := getUserInfoFromRequest(req)
+	userID, username, department, err := getUserInfoFromRequest(req)
 	if errors.Is(err, errNoCookie) || errors.Is(err, errNoSuchUser) {
 		authURL, err2 := generateAuthorizationURL()
 		if err2 != nil {
@@ -175,6 +175,14 @@ func handleIndex(w http.ResponseWriter, req *http.Request) (string, int, error)
 	if err != nil {
 		return "", -1, err
 	}
+	studentID, legalSex, err := getUserStudent(req.Context(), userID)
+	if err != nil {
+		return "", -1, err
+	}
+	yearGroupReq, err := getYearGroupReq(department)
+	if err != nil {
+		return "", -1, err
+	}
 
 	err = tmpl.ExecuteTemplate(
 		w,
@@ -182,19 +190,33 @@ func handleIndex(w http.ResponseWriter, req *http.Request) (string, int, error)
 		struct {
 			Name       string
 			Department string
+			StudentID  int64
+			LegalSex   string
 			Groups     *map[string]groupT
 			Required   struct {
 				Sport    int
 				NonSport int
 			}
+			Maximum struct { /* 0 if none */
+				Sport    int
+				NonSport int
+				Total    int
+			}
 		}{
 			username,
 			department,
+			studentID,
+			legalSex,
 			&_groups,
 			struct {
 				Sport    int
 				NonSport int
 			}{sportRequired, nonSportRequired},
+			struct {
+				Sport    int
+				NonSport int
+				Total    int
+			}{yearGroupReq.MaxSport, yearGroupReq.MaxNonSport, yearGroupReq.MaxTotal},
 		},
 	)
 	if err != nil {
@@ -204,6 +226,7 @@ func handleIndex(w http.ResponseWriter, req *http.Request) (string, int, error)
 }
 
 type student_ish struct {
+	StudentID  int64 /* 0 if unknown */
 	Name       string
 	Email      string
 	Department string
@@ -9,15 +9,14 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync/atomic"
-
-	"github.com/jackc/pgx/v5"
+	"time"
 )
 
 func handleNewCourses(w http.ResponseWriter, req *http.Request) (string, int, error) {
@@ -25,7 +24,7 @@ func handleNewCourses(w http.ResponseWriter, req *http.Request) (string, int, er
 		return "", http.StatusMethodNotAllowed, errPostOnly
 	}
 
-	_, _, department, err := getUserInfoFromRequest(req)
+	userID, _, department, err := getUserInfoFromRequest(req)
 	if err != nil {
 		return "", -1, err
 	}
@@ -33,14 +32,7 @@ func handleNewCourses(w http.ResponseWriter, req *http.Request) (string, int, er
 		return "", http.StatusForbidden, errStaffOnly
 	}
 
-	if !func() bool {
-		for _, v := range states {
-			if atomic.LoadUint32(v) != 0 {
-				return false
-			}
-		}
-		return true
-	}() {
+	if !studentAccessDisabled() {
 		return "", http.StatusBadRequest, errDisableStudentAccessFirst
 	}
 
@@ -51,33 +43,75 @@ func handleNewCourses(w http.ResponseWriter, req *http.Request) (string, int, er
 		return "", http.StatusBadRequest, wrapError(errFormNoFile, err)
 	}
 
-	if fileHeader.Header.Get("Content-Type") != "text/csv" {
+	if !checkUploadType(fileHeader) {
 		return "", http.StatusBadRequest, errNotACSV
 	}
 
-	csvReader := csv.NewReader(file)
+	err = importCourses(req.Context(), userID, file, fileHeader.Filename)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+
+	return "", -1, nil
+}
+
+/*
+ * Check that student access is disabled for every year group, as it must be
+ * while the courses are replaced.
+ */
+func studentAccessDisabled() bool {
+	for _, v := range states {
+		if atomic.LoadUint32(v) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Replace the courses with those in a CSV file or spreadsheet, and audit the
+ * import under the given actor.
+ */
+func importCourses(ctx context.Context, actor string, r io.Reader, filename string) error {
+	csvReader, err := newTableReader(r)
+	if err != nil {
+		return err
+	}
 	titleLine, err := csvReader.Read()
 	if err != nil {
-		return "", http.StatusBadRequest, wrapError(errCannotReadCSV, err)
+		return wrapError(errCannotReadCSV, err)
 	}
 	if titleLine == nil {
-		return "", -1, errUnexpectedNilCSVLine
-	}
-	if len(titleLine) != 9 {
-		return "", -1, wrapAny(
-			errBadCSVFormat,
-			"expecting 9 fields on the first line",
-		)
+		return errUnexpectedNilCSVLine
 	}
+	/*
+	 * Max F and Max M are optional, but come together. Quota columns are
+	 * optional, as are Quota Release, Students, Exclusion Set and Requires.
+	 */
 	var titleIndex, maxIndex, teacherIndex, locationIndex,
 		typeIndex, groupIndex, sectionIDIndex,
 		courseIDIndex, yearGroupsIndex int = -1, -1, -1, -1, -1, -1, -1, -1, -1
+	var maxFIndex, maxMIndex, quotaReleaseIndex int = -1, -1, -1
+	var studentsIndex, exclusionSetIndex, requiresIndex int = -1, -1, -1
+	quotaIndexes := make(map[string]int)
 	for i, v := range titleLine {
+		if yearGroup, ok := strings.CutPrefix(v, "Quota "); ok {
+			if _, ok := yearGroupsNumberBits[yearGroup]; ok {
+				quotaIndexes[yearGroup] = i
+				continue
+			}
+		}
 		switch v {
 		case "Title":
 			titleIndex = i
 		case "Max":
 			maxIndex = i
+		case "Max F":
+			maxFIndex = i
+		case "Max M":
+			maxMIndex = i
 		case "Teacher":
 			teacherIndex = i
 		case "Location":
@@ -92,106 +126,94 @@ func handleNewCourses(w http.ResponseWriter, req *http.Request) (string, int, er
 			courseIDIndex = i
 		case "Year Groups":
 			yearGroupsIndex = i
+		case "Quota Release":
+			quotaReleaseIndex = i
+		case "Students":
+			studentsIndex = i
+		case "Exclusion Set":
+			exclusionSetIndex = i
+		case "Requires":
+			requiresIndex = i
+		default:
+			return wrapAny(
+				errBadCSVFormat,
+				fmt.Sprintf("unknown column \"%s\" on the first line", v),
+			)
 		}
 	}
 
 	if titleIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(
+		return wrapAny(
 			errMissingCSVColumn,
 			"Title",
 		)
 	}
 	if maxIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(
+		return wrapAny(
 			errMissingCSVColumn,
 			"Max",
 		)
 	}
 	if teacherIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(
+		return wrapAny(
 			errMissingCSVColumn,
 			"Teacher",
 		)
 	}
 	if locationIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(
+		return wrapAny(
 			errMissingCSVColumn,
 			"Location",
 		)
 	}
 	if typeIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(
+		return wrapAny(
 			errMissingCSVColumn,
 			"Type",
 		)
 	}
 	if groupIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(
+		return wrapAny(
 			errMissingCSVColumn,
 			"Group",
 		)
 	}
 	if courseIDIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(
+		return wrapAny(
 			errMissingCSVColumn,
 			"Course ID",
 		)
 	}
 	if sectionIDIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(
+		return wrapAny(
 			errMissingCSVColumn,
 			"Section ID",
 		)
 	}
 	if yearGroupsIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(
+		return wrapAny(
 			errMissingCSVColumn,
 			"Year Groups",
 		)
 	}
-
-	lineNumber := 1
-	ok, statusCode, err := func(ctx context.Context) (
-		retBool bool,
-		retStatus int,
-		retErr error,
-	) {
-		tx, err := db.Begin(ctx)
-		if err != nil {
-			return false, -1, wrapError(errUnexpectedDBError, err)
-		}
-		defer func() {
-			err := tx.Rollback(ctx)
-			if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
-				retBool, retStatus, retErr = false, -1, wrapError(
-					errUnexpectedDBError,
-					err,
-				)
-				return
-			}
-		}()
-		_, err = tx.Exec(
-			ctx,
-			"DELETE FROM choices",
-		)
-		if err != nil {
-			return false, -1, wrapError(errUnexpectedDBError, err)
-		}
-		_, err = tx.Exec(
-			ctx,
-			"UPDATE users SET confirmed = false",
+	if maxFIndex == -1 && maxMIndex != -1 {
+		return wrapAny(
+			errMissingCSVColumn,
+			"Max F",
 		)
-		if err != nil {
-			return false, -1, wrapError(errUnexpectedDBError, err)
-		}
-		_, err = tx.Exec(
-			ctx,
-			"DELETE FROM courses",
+	}
+	if maxMIndex == -1 && maxFIndex != -1 {
+		return wrapAny(
+			errMissingCSVColumn,
+			"Max M",
 		)
-		if err != nil {
-			return false, -1, wrapError(errUnexpectedDBError, err)
-		}
+	}
 
+	err = func() error {
+		newCourses := make([]*courseT, 0)
+		courseIDs := make(map[string]struct{})
+		lineNumbers := make(map[*courseT]int)
+		lineNumber := 1
 		for {
 			lineNumber++
 			line, err := csvReader.Read()
@@ -199,19 +221,19 @@ func handleNewCourses(w http.ResponseWriter, req *http.Request) (string, int, er
 				if errors.Is(err, io.EOF) {
 					break
 				}
-				return false, -1, wrapError(
+				return wrapError(
 					errCannotReadCSV,
 					err,
 				)
 			}
 			if line == nil {
-				return false, -1, wrapError(
+				return wrapError(
 					errCannotReadCSV,
 					errUnexpectedNilCSVLine,
 				)
 			}
-			if len(line) != 9 {
-				return false, -1, wrapAny(
+			if len(line) != len(titleLine) {
+				return wrapAny(
 					errInsufficientFields,
 					fmt.Sprintf(
 						"line %d has a wrong number of items",
@@ -220,7 +242,7 @@ func handleNewCourses(w http.ResponseWriter, req *http.Request) (string, int, er
 				)
 			}
 			if !checkCourseType(line[typeIndex]) {
-				return false, -1, wrapAny(errInvalidCourseType,
+				return wrapAny(errInvalidCourseType,
 					fmt.Sprintf(
 						"line %d has invalid course type \"%s\"\nallowed course types: %s",
 						lineNumber,
@@ -233,7 +255,7 @@ func handleNewCourses(w http.ResponseWriter, req *http.Request) (string, int, er
 				)
 			}
 			if !checkCourseGroup(line[groupIndex]) {
-				return false, -1, wrapAny(errInvalidCourseGroup,
+				return wrapAny(errInvalidCourseGroup,
 					fmt.Sprintf(
 						"line %d has invalid course group \"%s\"\nallowed course groups: %s",
 						lineNumber,
@@ -247,49 +269,247 @@ func handleNewCourses(w http.ResponseWriter, req *http.Request) (string, int, er
 			}
 			yearGroupsSpec, err := yearGroupsStringToNumber(line[yearGroupsIndex])
 			if err != nil {
-				return false, -1, err
+				return err
 			}
-
-			_, err = tx.Exec(
-				ctx,
-				"INSERT INTO courses(nmax, title, teacher, location, ctype, cgroup, section_id, course_id, year_groups) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
-				line[maxIndex],
-				line[titleIndex],
-				line[teacherIndex],
-				line[locationIndex],
-				line[typeIndex],
-				line[groupIndex],
-				line[sectionIDIndex],
-				line[courseIDIndex],
-				yearGroupsSpec,
-			)
+			nmax, err := strconv.ParseUint(line[maxIndex], 10, 31)
 			if err != nil {
-				return false, -1, wrapError(
-					errUnexpectedDBError,
-					err,
+				return wrapAny(
+					errBadCSVFormat,
+					fmt.Sprintf(
+						"line %d, Max is not a number",
+						lineNumber,
+					),
+				)
+			}
+			var nmaxF, nmaxM uint64
+			if maxFIndex != -1 {
+				nmaxF, nmaxM, err = parseSexMaximums(
+					lineNumber,
+					line[maxFIndex],
+					line[maxMIndex],
+					nmax,
+				)
+				if err != nil {
+					return err
+				}
+			}
+			quotas, err := parseQuotas(lineNumber, line, quotaIndexes, yearGroupsSpec, nmax)
+			if err != nil {
+				return err
+			}
+			var quotaRelease time.Time
+			if quotaReleaseIndex != -1 && line[quotaReleaseIndex] != "" {
+				quotaRelease, err = time.ParseInLocation(
+					"2006-01-02T15:04",
+					line[quotaReleaseIndex],
+					loc,
 				)
+				if err != nil {
+					return wrapAny(
+						errBadCSVFormat,
+						fmt.Sprintf(
+							"line %d, Quota Release is not of the form 2006-01-02T15:04",
+							lineNumber,
+						),
+					)
+				}
+			}
+
+			var students map[int64]struct{}
+			if studentsIndex != -1 {
+				students, err = parseStudentIDs(line[studentsIndex])
+				if err != nil {
+					return wrapAny(
+						errBadCSVFormat,
+						fmt.Sprintf("line %d, %v", lineNumber, err),
+					)
+				}
+			}
+			var exclusionSet string
+			if exclusionSetIndex != -1 {
+				exclusionSet = strings.TrimSpace(line[exclusionSetIndex])
 			}
+			var requires []string
+			if requiresIndex != -1 {
+				requires = strings.Fields(line[requiresIndex])
+			}
+
+			course := &courseT{
+				Max:          uint32(nmax),
+				MaxF:         uint32(nmaxF),
+				MaxM:         uint32(nmaxM),
+				Quotas:       quotas,
+				QuotaRelease: quotaRelease,
+				Title:        line[titleIndex],
+				Teacher:      line[teacherIndex],
+				Location:     line[locationIndex],
+				Type:         line[typeIndex],
+				Group:        line[groupIndex],
+				SectionID:    line[sectionIDIndex],
+				CourseID:     line[courseIDIndex],
+				YearGroups:   yearGroupsSpec,
+				Students:     students,
+				ExclusionSet: exclusionSet,
+				Requires:     requires,
+			} //exhaustruct:ignore
+			newCourses = append(newCourses, course)
+			courseIDs[course.CourseID] = struct{}{}
+			lineNumbers[course] = lineNumber
 		}
-		err = tx.Commit(ctx)
-		if err != nil {
-			return false, -1, wrapError(errUnexpectedDBError, err)
+
+		/* Courses may only require others in the same file */
+		for _, course := range newCourses {
+			for _, required := range course.Requires {
+				if required == course.CourseID {
+					return wrapAny(
+						errBadCSVFormat,
+						fmt.Sprintf(
+							"line %d, the course requires itself",
+							lineNumbers[course],
+						),
+					)
+				}
+				if _, ok := courseIDs[required]; !ok {
+					return wrapAny(
+						errBadCSVFormat,
+						fmt.Sprintf(
+							"line %d, Requires has unknown Course ID \"%s\"",
+							lineNumbers[course],
+							required,
+						),
+					)
+				}
+			}
 		}
-		return true, -1, nil
-	}(req.Context())
-	if !ok {
-		return "", statusCode, err
-	}
 
-	courses.Range(func(key, _ interface{}) bool {
-		courses.Delete(key)
-		return true
-	})
-	err = setupCourses(req.Context())
+		return db.ReplaceCourses(ctx, newCourses, auditEntryT{
+			Actor:   actor,
+			Action:  auditImportCourses,
+			Outcome: auditOK,
+			Detail: fmt.Sprintf(
+				"%d courses from %s",
+				len(newCourses),
+				filename,
+			),
+		}) //exhaustruct:ignore
+	}()
 	if err != nil {
-		return "", -1, wrapError(errWhileSetttingUpCourseTablesAgain, err)
+		err2 := db.Audit(ctx, auditEntryT{
+			Actor:   actor,
+			Action:  auditImportCourses,
+			Outcome: auditRejected,
+			Detail:  filename + ": " + err.Error(),
+		}) //exhaustruct:ignore
+		if err2 != nil {
+			return wrapError(err, err2)
+		}
+		return err
 	}
 
-	http.Redirect(w, req, "/", http.StatusSeeOther)
+	return reloadCourses(ctx)
 
-	return "", -1, nil
+}
+
+/*
+ * Parse the Max F and Max M of a course with the given Max. Both blank means
+ * the course is not limited by legal sex; one blank means there is no limit
+ * for that legal sex beyond Max.
+ */
+func parseSexMaximums(lineNumber int, maxF, maxM string, nmax uint64) (uint64, uint64, error) {
+	if maxF == "" && maxM == "" {
+		return 0, 0, nil
+	}
+	parse := func(column, value string) (uint64, error) {
+		if value == "" {
+			return nmax, nil
+		}
+		n, err := strconv.ParseUint(value, 10, 31)
+		if err != nil {
+			return 0, wrapAny(
+				errBadCSVFormat,
+				fmt.Sprintf(
+					"line %d, %s is not a number",
+					lineNumber,
+					column,
+				),
+			)
+		}
+		return n, nil
+	}
+	nmaxF, err := parse("Max F", maxF)
+	if err != nil {
+		return 0, 0, err
+	}
+	nmaxM, err := parse("Max M", maxM)
+	if err != nil {
+		return 0, 0, err
+	}
+	if nmaxF == 0 && nmaxM == 0 {
+		return 0, 0, wrapAny(
+			errBadCSVFormat,
+			fmt.Sprintf(
+				"line %d, Max F and Max M are both 0",
+				lineNumber,
+			),
+		)
+	}
+	return nmaxF, nmaxM, nil
+}
+
+/*
+ * Parse the quotas of a course for the given year groups with the given Max,
+ * from the given columns of a line. Blank quotas are none. Quotas may only be
+ * given for year groups the course is for, and may not add up to more than
+ * Max.
+ */
+func parseQuotas(
+	lineNumber int,
+	line []string,
+	quotaIndexes map[string]int,
+	yearGroups uint8,
+	nmax uint64,
+) (map[string]*quotaT, error) {
+	var quotas map[string]*quotaT
+	var total uint64
+	for yearGroup, i := range quotaIndexes {
+		if line[i] == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(line[i], 10, 31)
+		if err != nil {
+			return nil, wrapAny(
+				errBadCSVFormat,
+				fmt.Sprintf(
+					"line %d, Quota %s is not a number",
+					lineNumber,
+					yearGroup,
+				),
+			)
+		}
+		if yearGroups&yearGroupsNumberBits[yearGroup] == 0 {
+			return nil, wrapAny(
+				errBadCSVFormat,
+				fmt.Sprintf(
+					"line %d, Quota %s is for a year group the course is not for",
+					lineNumber,
+					yearGroup,
+				),
+			)
+		}
+		if quotas == nil {
+			quotas = make(map[string]*quotaT)
+		}
+		quotas[yearGroup] = &quotaT{Selected: 0, Max: uint32(n)}
+		total += n
+	}
+	if total > nmax {
+		return nil, wrapAny(
+			errBadCSVFormat,
+			fmt.Sprintf(
+				"line %d, the quotas add up to more than Max",
+				lineNumber,
+			),
+		)
+	}
+	return quotas, nil
 }
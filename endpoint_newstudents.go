@@ -9,14 +9,12 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
-
-	"github.com/jackc/pgx/v5"
+	"strings"
 )
 
 func handleNewStudents(w http.ResponseWriter, req *http.Request) (string, int, error) {
@@ -24,7 +22,7 @@ func handleNewStudents(w http.ResponseWriter, req *http.Request) (string, int, e
 		return "", http.StatusMethodNotAllowed, errPostOnly
 	}
 
-	_, _, department, err := getUserInfoFromRequest(req)
+	userID, _, department, err := getUserInfoFromRequest(req)
 	if err != nil {
 		return "", -1, err
 	}
@@ -37,25 +35,43 @@ func handleNewStudents(w http.ResponseWriter, req *http.Request) (string, int, e
 		return "", http.StatusBadRequest, wrapError(errFormNoFile, err)
 	}
 
-	if fileHeader.Header.Get("Content-Type") != "text/csv" {
+	if !checkUploadType(fileHeader) {
 		return "", http.StatusBadRequest, errNotACSV
 	}
 
-	csvReader := csv.NewReader(file)
+	err = importStudents(req.Context(), userID, file, fileHeader.Filename)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+
+	return "", -1, nil
+}
+
+/*
+ * Replace the expected students with those in a CSV file or spreadsheet, and
+ * audit the import under the given actor.
+ */
+func importStudents(ctx context.Context, actor string, r io.Reader, filename string) error {
+	csvReader, err := newTableReader(r)
+	if err != nil {
+		return err
+	}
 	titleLine, err := csvReader.Read()
 	if err != nil {
-		return "", http.StatusBadRequest, wrapError(errCannotReadCSV, err)
+		return wrapError(errCannotReadCSV, err)
 	}
 	if titleLine == nil {
-		return "", -1, errUnexpectedNilCSVLine
+		return errUnexpectedNilCSVLine
 	}
-	if len(titleLine) != 3 {
-		return "", -1, wrapAny(
+	if len(titleLine) != 3 && len(titleLine) != 4 {
+		return wrapAny(
 			errBadCSVFormat,
-			"expecting 3 fields on the first line (Name, ID)",
+			"expecting 3 or 4 fields on the first line (Name, ID, Legal Sex, and optionally Year Group)",
 		)
 	}
-	var nameIndex, idIndex, legalSexIndex int = -1, -1, -1
+	var nameIndex, idIndex, legalSexIndex, yearGroupIndex int = -1, -1, -1, -1
 	for i, v := range titleLine {
 		switch v {
 		case "Name":
@@ -64,56 +80,39 @@ func handleNewStudents(w http.ResponseWriter, req *http.Request) (string, int, e
 			idIndex = i
 		case "Legal Sex":
 			legalSexIndex = i
+		case "Year Group", "Grade/Year":
+			yearGroupIndex = i
 		}
 	}
 
 	if nameIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(
+		return wrapAny(
 			errMissingCSVColumn,
 			"Name",
 		)
 	}
 	if idIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(
+		return wrapAny(
 			errMissingCSVColumn,
 			"ID",
 		)
 	}
 	if legalSexIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(
+		return wrapAny(
 			errMissingCSVColumn,
 			"Legal Sex",
 		)
 	}
-
-	lineNumber := 1
-	ok, statusCode, err := func(ctx context.Context) (
-		retBool bool,
-		retStatus int,
-		retErr error,
-	) {
-		tx, err := db.Begin(ctx)
-		if err != nil {
-			return false, -1, wrapError(errUnexpectedDBError, err)
-		}
-		defer func() {
-			err := tx.Rollback(ctx)
-			if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
-				retBool, retStatus, retErr = false, -1, wrapError(
-					errUnexpectedDBError,
-					err,
-				)
-				return
-			}
-		}()
-		_, err = tx.Exec(
-			ctx,
-			"DELETE FROM expected_students",
+	if len(titleLine) == 4 && yearGroupIndex == -1 {
+		return wrapAny(
+			errMissingCSVColumn,
+			"Year Group",
 		)
-		if err != nil {
-			return false, -1, wrapError(errUnexpectedDBError, err)
-		}
+	}
 
+	err = func() error {
+		students := make([]expectedStudentT, 0)
+		lineNumber := 1
 		for {
 			lineNumber++
 			line, err := csvReader.Read()
@@ -121,19 +120,19 @@ func handleNewStudents(w http.ResponseWriter, req *http.Request) (string, int, e
 				if errors.Is(err, io.EOF) {
 					break
 				}
-				return false, -1, wrapError(
+				return wrapError(
 					errCannotReadCSV,
 					err,
 				)
 			}
 			if line == nil {
-				return false, -1, wrapError(
+				return wrapError(
 					errCannotReadCSV,
 					errUnexpectedNilCSVLine,
 				)
 			}
-			if len(line) != 3 {
-				return false, -1, wrapAny(
+			if len(line) != len(titleLine) {
+				return wrapAny(
 					errInsufficientFields,
 					fmt.Sprintf(
 						"line %d has a wrong number of items",
@@ -144,7 +143,7 @@ func handleNewStudents(w http.ResponseWriter, req *http.Request) (string, int, e
 
 			id, err := strconv.ParseInt(line[idIndex], 10, 64)
 			if err != nil {
-				return false, -1, wrapAny(
+				return wrapAny(
 					errBadCSVFormat,
 					fmt.Sprintf(
 						"line %d, ID is not a number; make sure that you only submit clean numbers e.g. 12345 as the student ID, don't use s12345/S12345",
@@ -153,52 +152,64 @@ func handleNewStudents(w http.ResponseWriter, req *http.Request) (string, int, e
 				)
 			}
 
-			name := line[nameIndex]
-			legalSex := line[legalSexIndex]
-
-			_, err = tx.Exec(
-				ctx,
-				"INSERT INTO expected_students(name, id, legal_sex) VALUES ($1, $2, $3)",
-				name, id, legalSex,
-			)
-			if err != nil {
-				return false, -1, wrapError(
-					errUnexpectedDBError,
-					err,
-				)
+			/* The roster's year group overrules the sign-in token's */
+			var yearGroup string
+			if yearGroupIndex != -1 {
+				yearGroup = strings.TrimSpace(line[yearGroupIndex])
+				if _, ok := yearGroupsNumberBits[yearGroup]; yearGroup != "" && !ok {
+					return wrapAny(
+						errBadCSVFormat,
+						fmt.Sprintf(
+							"line %d, %q is not a year group",
+							lineNumber,
+							yearGroup,
+						),
+					)
+				}
 			}
+
+			students = append(students, expectedStudentT{
+				ID:        id,
+				Name:      line[nameIndex],
+				LegalSex:  line[legalSexIndex],
+				YearGroup: yearGroup,
+			})
 		}
-		err = tx.Commit(ctx)
-		if err != nil {
-			return false, -1, wrapError(errUnexpectedDBError, err)
+
+		return db.ReplaceExpectedStudents(ctx, students, auditEntryT{
+			Actor:   actor,
+			Action:  auditImportStudents,
+			Outcome: auditOK,
+			Detail: fmt.Sprintf(
+				"%d students from %s",
+				len(students),
+				filename,
+			),
+		}) //exhaustruct:ignore
+	}()
+	if err != nil {
+		err2 := db.Audit(ctx, auditEntryT{
+			Actor:   actor,
+			Action:  auditImportStudents,
+			Outcome: auditRejected,
+			Detail:  filename + ": " + err.Error(),
+		}) //exhaustruct:ignore
+		if err2 != nil {
+			return wrapError(err, err2)
 		}
-		return true, -1, nil
-	}(req.Context())
-	if !ok {
-		return "", statusCode, err
+		return err
 	}
+	return nil
 
-	http.Redirect(w, req, "/", http.StatusSeeOther)
-
-	return "", -1, nil
 }
 
-func queryNameID(ctx context.Context, query string, args ...any) (result map[int64]string, err error) {
-	result = make(map[int64]string)
-	var rows pgx.Rows
-
-	if rows, err = db.Query(ctx, query, args...); err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var name string
-		var id int64
-		if err = rows.Scan(&name, &id); err != nil {
-			return nil, err
-		}
-		result[id] = name
+/*
+ * Map the IDs of expected students to them.
+ */
+func expectedStudentsByID(students []expectedStudentT) map[int64]expectedStudentT {
+	result := make(map[int64]expectedStudentT, len(students))
+	for _, student := range students {
+		result[student.ID] = student
 	}
-	return result, rows.Err()
+	return result
 }
@@ -0,0 +1,34 @@
+/*
+ * Tests of importing students
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestImportStudentsHeader(t *testing.T) {
+	for _, tc := range []struct {
+		desc   string
+		header string
+		want   error
+	}{
+		{"too few columns", "Name,ID", errBadCSVFormat},
+		{"too many columns", "Name,ID,Legal Sex,Year Group,Notes", errBadCSVFormat},
+		{"no name", "Student,ID,Legal Sex", errMissingCSVColumn},
+		{"no legal sex", "Name,ID,Sex,Year Group", errMissingCSVColumn},
+		{"fourth column not the year group", "Name,ID,Legal Sex,Notes", errMissingCSVColumn},
+	} {
+		csv := tc.header + "\nAlice Chen,101,F,Y9\n"
+		err := importStudents(testContext(t), "", strings.NewReader(csv), "students.csv")
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.desc, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * Students whose sign-in disagrees with the roster
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type rosterProblemT struct {
+	Name            string
+	StudentID       int64 /* 0 if unknown */
+	Email           string
+	YearGroup       string /* as we have them */
+	Claimed         string /* as their sign-in token said */
+	RosterYearGroup string
+	Problems        []string
+}
+
+/*
+ * Every student who logged in but is not on the roster, has no number to
+ * look them up by, or whose year group is not what the roster says. There
+ * are none while the roster is empty.
+ */
+func getRosterProblems(ctx context.Context) ([]rosterProblemT, error) {
+	expectedList, err := db.GetExpectedStudents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]rosterProblemT, 0)
+	if len(expectedList) == 0 {
+		return result, nil
+	}
+	expected := expectedStudentsByID(expectedList)
+	users, err := db.GetUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("query users: %w", err)
+	}
+
+	for _, user := range users {
+		if user.Department == staffDepartment {
+			continue
+		}
+		problem := rosterProblemT{
+			Name:      user.Name,
+			StudentID: userStudentID(user, expectedList, users),
+			Email:     user.Email,
+			YearGroup: user.Department,
+			Claimed:   user.ClaimedDepartment,
+		} //exhaustruct:ignore
+		student, ok := expected[problem.StudentID]
+		switch {
+		case problem.StudentID == 0:
+			problem.Problems = []string{"no student number"}
+		case !ok:
+			problem.Problems = []string{"not on the roster"}
+		case student.YearGroup != "":
+			problem.RosterYearGroup = student.YearGroup
+			if problem.Claimed != "" && problem.Claimed != student.YearGroup {
+				problem.Problems = append(
+					problem.Problems,
+					fmt.Sprintf("signed in as %s, roster says %s", problem.Claimed, student.YearGroup),
+				)
+			}
+			if problem.YearGroup != student.YearGroup {
+				problem.Problems = append(
+					problem.Problems,
+					fmt.Sprintf("in %s, roster says %s", problem.YearGroup, student.YearGroup),
+				)
+			}
+		}
+		if len(problem.Problems) != 0 {
+			result = append(result, problem)
+		}
+	}
+
+	slices.SortFunc(result, func(a, b rosterProblemT) int {
+		return cmp.Or(
+			cmp.Compare(yearGroupsNumberBits[a.YearGroup], yearGroupsNumberBits[b.YearGroup]),
+			cmp.Compare(a.Name, b.Name),
+			cmp.Compare(a.StudentID, b.StudentID),
+		)
+	})
+	return result, nil
+}
+
+func rosterProblemsTable(problems []rosterProblemT) tableT {
+	table := tableT{
+		Header: []string{
+			"Student Name",
+			"Student ID",
+			"Email",
+			"Grade/Year",
+			"Signed In As",
+			"Roster Grade/Year",
+			"Problem",
+		},
+		Rows: make([][]any, 0, len(problems)),
+	}
+	for _, problem := range problems {
+		table.Rows = append(table.Rows, []any{
+			problem.Name,
+			studentIDCell(problem.StudentID),
+			problem.Email,
+			problem.YearGroup,
+			problem.Claimed,
+			problem.RosterYearGroup,
+			strings.Join(problem.Problems, "; "),
+		})
+	}
+	return table
+}
+
+func handleRosterCheck(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_, username, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", http.StatusUnauthorized, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	problems, err := getRosterProblems(req.Context())
+	if err != nil {
+		return "", -1, err
+	}
+
+	err = tmpl.ExecuteTemplate(
+		w,
+		"rostercheck",
+		struct {
+			Name           string
+			Problems       []rosterProblemT
+			RefuseUnlisted bool
+		}{
+			username,
+			problems,
+			config().Auth.Students.RefuseUnlisted,
+		},
+	)
+	if err != nil {
+		return "", -1, wrapError(errCannotWriteTemplate, err)
+	}
+	return "", -1, nil
+}
+
+func handleExportRosterCheck(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", http.StatusUnauthorized, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+	format, err := exportFormat(req)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
+	problems, err := getRosterProblems(req.Context())
+	if err != nil {
+		return "", -1, err
+	}
+	err = writeTableDownload(w, "RosterCheck", format, rosterProblemsTable(problems))
+	if err != nil {
+		return "", -1, err
+	}
+	return "", -1, nil
+}
@@ -36,7 +36,7 @@ func handleState(w http.ResponseWriter, req *http.Request) (string, int, error)
 		return "", http.StatusMethodNotAllowed, errMethodNotAllowed
 	}
 
-	_, _, department, err := getUserInfoFromRequest(req)
+	userID, _, department, err := getUserInfoFromRequest(req)
 	if err != nil {
 		return "", http.StatusUnauthorized, err
 	}
@@ -67,7 +67,7 @@ func handleState(w http.ResponseWriter, req *http.Request) (string, int, error)
 			if err != nil {
 				return "", http.StatusBadRequest, wrapError(errInvalidSchedule, err)
 			}
-			err = setSchedule(req.Context(), yeargroup, &newSchedule)
+			err = setSchedule(req.Context(), userID, yeargroup, &newSchedule)
 			if err != nil {
 				return "", http.StatusBadRequest, wrapError(errCannotSetSchedule, err)
 			}
@@ -78,7 +78,7 @@ func handleState(w http.ResponseWriter, req *http.Request) (string, int, error)
 			if err != nil {
 				return "", http.StatusBadRequest, wrapError(errInvalidState, err)
 			}
-			err = setState(req.Context(), yeargroup, uint32(newState))
+			err = setState(req.Context(), userID, yeargroup, uint32(newState))
 			if err != nil {
 				return "", http.StatusBadRequest, wrapError(errCannotSetState, err)
 			}
@@ -8,6 +8,7 @@
 package main
 
 import (
+	"errors"
 	"log/slog"
 	"net/http"
 	"sync/atomic"
@@ -21,6 +22,13 @@ import (
  * handled in handleConn.
  */
 func handleWs(w http.ResponseWriter, req *http.Request) {
+	/*
+	 * This must be before the connection is hijacked, while the server
+	 * still waits for us when shutting down.
+	 */
+	connWG.Add(1)
+	defer connWG.Done()
+
 	defer func() {
 		if e := recover(); e != nil {
 			slog.Error("panic", "arg", e)
@@ -66,7 +74,16 @@ func handleWs(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = handleConn(req.Context(), c, userID, department)
+	err = handleConn(
+		withAuditSource(req.Context(), "ws", remoteIP(req)),
+		c,
+		userID,
+		department,
+	)
+	if errors.Is(err, errShuttingDown) {
+		_ = c.Close(websocket.StatusServiceRestart, shutdownCloseReason)
+		return
+	}
 	if err != nil {
 		slog.Error(
 			"websocket",
@@ -21,6 +21,10 @@ var (
 	errCannotOpenConfig                 = errors.New("cannot open configuration file")
 	errCannotDecodeConfig               = errors.New("cannot decode configuration file")
 	errMissingConfigValue               = errors.New("missing configuration value")
+	errUnknownConfigValue               = errors.New("unknown configuration value")
+	errDuplicateConfigValue             = errors.New("configuration value given more than once")
+	errBadConfigValue                   = errors.New("bad configuration value")
+	errConfigValueOutOfRange            = errors.New("configuration value out of range")
 	errInvalidCourseType                = errors.New("invalid course type")
 	errInvalidCourseGroup               = errors.New("invalid course group")
 	errMultipleChoicesInOneGroup        = errors.New("multiple choices per group per user")
@@ -38,6 +42,10 @@ var (
 	errCannotSetSchedule                = errors.New("cannot set schedule")
 	errWebSocketWrite                   = errors.New("error writing to websocket")
 	errHTTPWrite                        = errors.New("error writing to http writer")
+	errCSVWrite                         = errors.New("error writing csv")
+	errXLSXWrite                        = errors.New("error writing xlsx")
+	errCannotReadXLSX                   = errors.New("cannot read xlsx")
+	errXLSXMissingPart                  = errors.New("xlsx file is missing a part")
 	errCannotCheckCookie                = errors.New("error checking cookie")
 	errNoCookie                         = errors.New("no cookie found")
 	errNoSuchUser                       = errors.New("no such user")
@@ -52,9 +60,10 @@ var (
 	errJWTExpired                       = errors.New("jwt token has expired or is not yet valid")
 	errJWTInvalid                       = errors.New("jwt token is somehow invalid")
 	errStaffOnly                        = errors.New("this page is only available to staff")
+	errNotOnRoster                      = errors.New("you are not on the list of students; please contact the school")
 	errDisableStudentAccessFirst        = errors.New("you must disable student access across all yeargroups before performing this operation")
 	errFormNoFile                       = errors.New("you need to select a file before submitting the form")
-	errNotACSV                          = errors.New("the file you uploaded is not a csv file")
+	errNotACSV                          = errors.New("the file you uploaded is not a csv or xlsx file")
 	errCannotReadCSV                    = errors.New("cannot read csv")
 	errBadCSVFormat                     = errors.New("bad csv format")
 	errMissingCSVColumn                 = errors.New("missing csv column")
@@ -62,10 +71,23 @@ var (
 	errWhileSetttingUpCourseTablesAgain = errors.New("error while setting up course tables again")
 	errCannotWriteTemplate              = errors.New("cannot write template")
 	errUnknownCommand                   = errors.New("unknown command")
+	errUnknownAction                    = errors.New("unknown action")
 	errBadNumberOfArguments             = errors.New("bad number of arguments")
 	errInvalidYearGroupOrCourseType     = errors.New("invalid year group or course type (something is broken)")
 	errYearGroupSpecString              = errors.New("invalid year group specification string")
 	errNotForYourYearGroup              = errors.New("this course is not part of your year group")
+	errBadNotification                  = errors.New("bad notification")
+	errBadMigrationName                 = errors.New("bad migration name")
+	errSchemaTooNew                     = errors.New("database schema is newer than this version of the program")
+	errSchemaTooOld                     = errors.New("database schema needs to be migrated")
+	errUnknownSubcommand                = errors.New("unknown subcommand")
+	errUniqueViolation                  = errors.New("unique constraint violated")
+	errCourseFull                       = errors.New("course is full")
+	errSexFull                          = errors.New("course is full for legal sex")
+	errLegalSexUnknown                  = errors.New("legal sex unknown")
+	errQuotaFull                        = errors.New("course is full for year group")
+	errSeatsHeld                        = errors.New("seats held for other year groups")
+	errNotChosen                        = errors.New("course not chosen")
 	// errInvalidCourseID                  = errors.New("invalid course id")
 )
 
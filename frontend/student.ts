@@ -30,6 +30,7 @@ document.addEventListener('DOMContentLoaded', (): void => {
 
 	setup_course_checkboxes();
 	setup_confirmation_buttons();
+	schedule_quota_releases();
 });
 
 function create_websocket_url(): string {
@@ -90,9 +91,31 @@ function update_course_counters(course_id: string, increment = true): void {
 	const current_value = parseInt(counter_element.textContent!);
 	counter_element.textContent = String(current_value + (increment ? 1 : -1));
 
+	update_remaining_allowances();
 	update_confirm_button_state();
 }
 
+/*
+ * Show how many more courses of each type, and altogether, this student may
+ * choose, where there is a maximum.
+ */
+function update_remaining_allowances(): void {
+	let total = 0;
+	['Sport', 'Non-sport'].forEach(course_type => {
+		const chosen = parseInt(document.getElementById(`${course_type}-chosen`)!.textContent!);
+		total += chosen;
+		update_remaining_allowance(`${course_type}-remaining`, chosen);
+	});
+	update_remaining_allowance('total-remaining', total);
+}
+
+function update_remaining_allowance(element_id: string, chosen: number): void {
+	const element = document.getElementById(element_id);
+	if (element) {
+		element.textContent = String(Math.max(parseInt(element.dataset.max!) - chosen, 0));
+	}
+}
+
 function update_confirmed_course_details(handle: string): void {
 	const elements = ['name', 'type', 'teacher', 'location'].reduce<Record<string, HTMLElement>>((acc, field) => {
 		acc[field] = document.getElementById(`confirmed-${field}-${handle}`)!;
@@ -138,9 +161,13 @@ function handle_course_selection(checkbox: HTMLInputElement): void {
 
 function setup_socket_handlers(): void {
 	socket.addEventListener('message', event => handle_socket_message(event));
-	socket.addEventListener('close', () => {
+	socket.addEventListener('close', event => {
 		toggle_elements(DOM_STATES.need_connection, false);
 		toggle_elements(DOM_STATES.broken_connection, true);
+		if (event.code === 1012) {
+			/* The server is restarting; spread out the reconnections */
+			setTimeout(() => window.location.reload(), 1000 + Math.random() * 4000);
+		}
 	});
 	socket.send('HELLO');
 }
@@ -165,13 +192,135 @@ function handle_course_removal(course_id: string): void {
 	update_course_counters(course_id, false);
 }
 
+function handle_course_max_updates(args: string[]): void {
+	for (let i = 0; i + 1 < args.length; i += 2) {
+		handle_course_max_update(args[i], args[i + 1]);
+	}
+}
+
 function handle_course_max_update(course_id: string, selected_count: string): void {
 	const selected_element = document.getElementById(`selected${course_id}`)!;
-	const max_element = document.getElementById(`max${course_id}`)!;
 	const checkbox = document.getElementById(`tick${course_id}`) as HTMLInputElement;
 
 	selected_element.textContent = selected_count;
-	checkbox.disabled = selected_count === max_element.textContent && !checkbox.checked;
+	checkbox.disabled = course_unavailable(course_id) && !checkbox.checked;
+}
+
+function handle_course_sex_updates(args: string[]): void {
+	for (let i = 0; i + 2 < args.length; i += 3) {
+		handle_course_sex_update(args[i], args[i + 1], args[i + 2]);
+	}
+}
+
+function handle_course_sex_update(course_id: string, female_count: string, male_count: string): void {
+	const female_element = document.getElementById(`selectedF${course_id}`);
+	const male_element = document.getElementById(`selectedM${course_id}`);
+	const checkbox = document.getElementById(`tick${course_id}`) as HTMLInputElement;
+	if (!female_element || !male_element) {
+		return;
+	}
+
+	female_element.textContent = female_count;
+	male_element.textContent = male_count;
+	checkbox.disabled = course_unavailable(course_id) && !checkbox.checked;
+}
+
+function handle_course_quota_updates(args: string[]): void {
+	const course_ids = new Set<string>();
+	for (let i = 0; i + 2 < args.length; i += 3) {
+		const quota_element = document.getElementById(`quota${args[i]}-${args[i + 1]}`);
+		if (quota_element) {
+			quota_element.textContent = args[i + 2];
+			course_ids.add(args[i]);
+		}
+	}
+	course_ids.forEach(course_id => {
+		const checkbox = document.getElementById(`tick${course_id}`) as HTMLInputElement;
+		checkbox.disabled = course_unavailable(course_id) && !checkbox.checked;
+	});
+}
+
+/*
+ * Whether this student cannot choose the course as things stand, because
+ * they are not invited to it or it is full for them.
+ */
+function course_unavailable(course_id: string): boolean {
+	const checkbox = document.getElementById(`tick${course_id}`) as HTMLInputElement;
+	return checkbox.dataset.notInvited !== undefined || course_full(course_id);
+}
+
+/*
+ * Whether the course has no seat left for this student, counting those set
+ * aside by legal sex and those held for other year groups, if any. Students
+ * whose legal sex is unknown cannot take seats set aside by legal sex.
+ */
+function course_full(course_id: string): boolean {
+	const selected = parseInt(document.getElementById(`selected${course_id}`)!.textContent!);
+	const max = parseInt(document.getElementById(`max${course_id}`)!.textContent!);
+	const checkbox = document.getElementById(`tick${course_id}`) as HTMLInputElement;
+	if (selected >= max) {
+		return true;
+	}
+	return course_full_for_legal_sex(course_id, checkbox) || course_full_for_year_group(course_id, checkbox, selected, max);
+}
+
+function course_full_for_legal_sex(course_id: string, checkbox: HTMLInputElement): boolean {
+	if (checkbox.dataset.maxF === undefined) {
+		return false;
+	}
+
+	const legal_sex = document.body.dataset.legalSex;
+	if (legal_sex !== 'F' && legal_sex !== 'M') {
+		return true;
+	}
+	const taken = parseInt(document.getElementById(`selected${legal_sex}${course_id}`)!.textContent!);
+	const limit = parseInt((legal_sex === 'F' ? checkbox.dataset.maxF : checkbox.dataset.maxM)!);
+	return taken >= limit;
+}
+
+function course_full_for_year_group(course_id: string, checkbox: HTMLInputElement, selected: number, max: number): boolean {
+	const release = checkbox.dataset.quotaRelease;
+	if (release !== undefined && Date.now() >= parseInt(release)) {
+		return false;
+	}
+
+	const year_group = document.body.dataset.yearGroup;
+	let own_quota_full = false;
+	let held = 0;
+	document.querySelectorAll(`#course${course_id} .quota-number`).forEach(q => {
+		const quota = q as HTMLElement;
+		const taken = parseInt(quota.textContent!);
+		const quota_max = parseInt(quota.dataset.max!);
+		if (quota.dataset.yearGroup === year_group) {
+			own_quota_full = taken >= quota_max;
+		} else if (taken < quota_max) {
+			held += quota_max - taken;
+		}
+	});
+	return own_quota_full || (held !== 0 && selected + held >= max);
+}
+
+/*
+ * Let students choose courses whose quotas are released while they are on
+ * the page.
+ */
+function schedule_quota_releases(): void {
+	document.querySelectorAll('.coursecheckbox').forEach(c => {
+		const checkbox = c as HTMLInputElement;
+		const release = checkbox.dataset.quotaRelease;
+		if (release === undefined) {
+			return;
+		}
+		const delay = parseInt(release) - Date.now();
+		if (delay <= 0 || delay > 0x7fffffff) {
+			return;
+		}
+		setTimeout(() => {
+			if (global_state === 1) {
+				checkbox.disabled = course_unavailable(checkbox.id.slice(4)) && !checkbox.checked;
+			}
+		}, delay);
+	});
 }
 
 function handle_course_rejection(course_id: string, reason: string): void {
@@ -182,12 +331,27 @@ function handle_course_rejection(course_id: string, reason: string): void {
 	(status_element as HTMLElement).style.color = 'red';
 	checkbox.checked = false;
 	checkbox.indeterminate = false;
-	if (reason === 'Full') {
+	if (
+		reason === 'Full' ||
+		reason.startsWith('Full for ') ||
+		reason.startsWith('The seats left are held') ||
+		reason === 'By invitation only'
+	) {
 		checkbox.disabled = true;
 	}
 	update_confirm_button_state();
 }
 
+function handle_unchoose_rejection(course_id: string, reason: string): void {
+	const status_element = document.getElementById(`coursestatus${course_id}`)!;
+	const checkbox = document.getElementById(`tick${course_id}`) as HTMLInputElement;
+
+	status_element.textContent = reason;
+	(status_element as HTMLElement).style.color = 'red';
+	checkbox.checked = true;
+	checkbox.indeterminate = false;
+}
+
 function handle_course_approval(course_id: string): void {
 	const status_element = document.getElementById(`coursestatus${course_id}`)!;
 	const checkbox = document.getElementById(`tick${course_id}`) as HTMLInputElement;
@@ -216,13 +380,8 @@ function handle_start_state(): void {
 
 	document.querySelectorAll('.courseitem').forEach(course => {
 		const checkbox = course.querySelector('.coursecheckbox') as HTMLInputElement;
-		const selected = course.querySelector('.selected-number')!;
-		const max = course.querySelector('.max-number')!;
 
-		checkbox.disabled = !(
-			selected.textContent !== max.textContent ||
-			checkbox.checked
-		);
+		checkbox.disabled = course_unavailable(checkbox.id.slice(4)) && !checkbox.checked;
 	});
 
 	update_confirm_button_state();
@@ -266,8 +425,11 @@ function handle_socket_message(event: MessageEvent): void {
 		'HI': () => handle_hi_message(...args),
 		'U': () => alert('Your session is broken or has expired. You are unauthenticated and the server will reject your commands.'),
 		'N': () => handle_course_removal(args[0]),
-		'M': () => handle_course_max_update(args[0], args[1]),
+		'M': () => handle_course_max_updates(args),
+		'Q': () => handle_course_sex_updates(args),
+		'P': () => handle_course_quota_updates(args),
 		'R': () => handle_course_rejection(args[0], args[1]),
+		'RN': () => handle_unchoose_rejection(args[0], args[1]),
 		'Y': () => handle_course_approval(args[0]),
 		'STOP': () => handle_stop_state(),
 		'START': () => handle_start_state(),
@@ -0,0 +1,411 @@
+/*
+ * Test harness
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+/*
+ * The tests run the real handlers against the memory store, with the
+ * broadcaster, listener and state poller running as they would in
+ * production. Everything in this package is global, so tests must not run
+ * in parallel with each other; each test replaces the courses, which also
+ * clears every choice, and uses its own users.
+ */
+
+const testTimeout = 5 * time.Second
+
+var (
+	testServer *httptest.Server
+	testUserID atomic.Int64
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+
+	var c configT
+	c.Perf.SendQ = 64
+	c.Perf.MessageArgumentsCap = 4
+	c.Perf.MessageBytesCap = 64
+	c.Perf.BroadcastInterval = 10
+	c.Req.Y9.Sport = 1
+	c.Req.Y9.NonSport = 1
+	c.Req.Y10.Sport = 1
+	c.Req.Y10.NonSport = 1
+	c.Req.Y11.Sport = 1
+	c.Req.Y11.NonSport = 1
+	c.Req.Y12.Sport = 1
+	c.Req.Y12.NonSport = 1
+	currentConfig.Store(&c)
+
+	db = newMemoryStore()
+	if err := setupInstanceID(); err != nil {
+		log.Fatalln(err)
+	}
+	var err error
+	tmpl, err = template.ParseFS(runFS, "templates/*")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := loadStateAndSchedule(); err != nil {
+		log.Fatalln(err)
+	}
+
+	go runBroadcaster()
+	go runListener()
+	go pollState()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", handleWs)
+	testServer = httptest.NewServer(mux)
+
+	code := m.Run()
+	testServer.Close()
+	os.Exit(code)
+}
+
+func testContext(t *testing.T) context.Context {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+type testCourseT struct {
+	Title string
+	Max   uint32
+	MaxF  uint32
+	MaxM  uint32
+	Type  string
+	Group string
+	/* Seats set aside for year groups, and when they are released */
+	Quotas       map[string]uint32
+	QuotaRelease time.Time
+	/* See eligibility.go */
+	CourseID     string
+	ExclusionSet string
+	Requires     []string
+}
+
+/*
+ * Replace every course and return their IDs by title.
+ */
+func setTestCourses(t *testing.T, list ...testCourseT) map[string]int {
+	t.Helper()
+	ctx := testContext(t)
+	newCourses := make([]*courseT, 0, len(list))
+	for _, c := range list {
+		var quotas map[string]*quotaT
+		for yearGroup, nmax := range c.Quotas {
+			if quotas == nil {
+				quotas = make(map[string]*quotaT)
+			}
+			quotas[yearGroup] = &quotaT{Max: nmax} //exhaustruct:ignore
+		}
+		newCourses = append(newCourses, &courseT{
+			Title:        c.Title,
+			Max:          c.Max,
+			MaxF:         c.MaxF,
+			MaxM:         c.MaxM,
+			Type:         c.Type,
+			Group:        c.Group,
+			YearGroups:   1 | 2 | 4 | 8,
+			Quotas:       quotas,
+			QuotaRelease: c.QuotaRelease,
+			CourseID:     c.CourseID,
+			ExclusionSet: c.ExclusionSet,
+			Requires:     c.Requires,
+		}) //exhaustruct:ignore
+	}
+	err := db.ReplaceCourses(ctx, newCourses, auditEntryT{
+		Action:  auditImportCourses,
+		Outcome: auditOK,
+	}) //exhaustruct:ignore
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadCourses(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]int, len(list))
+	courses.Range(func(_, value interface{}) bool {
+		course := value.(*courseT)
+		ids[course.Title] = course.ID
+		return true
+	})
+	return ids
+}
+
+/*
+ * Use the given requirements for a year group until the test ends.
+ */
+func setTestReq(t *testing.T, yeargroup string, req reqT) {
+	t.Helper()
+	old := config()
+	c := *old
+	switch yeargroup {
+	case "Y9":
+		c.Req.Y9 = req
+	case "Y10":
+		c.Req.Y10 = req
+	case "Y11":
+		c.Req.Y11 = req
+	case "Y12":
+		c.Req.Y12 = req
+	default:
+		t.Fatalf("no year group %s", yeargroup)
+	}
+	currentConfig.Store(&c)
+	t.Cleanup(func() {
+		currentConfig.Store(old)
+	})
+}
+
+func setTestState(t *testing.T, yeargroup string, state uint32) {
+	t.Helper()
+	if err := setState(testContext(t), "", yeargroup, state); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/*
+ * Create a user in the given year group and return its ID and session. Their
+ * student number is the number in their ID.
+ */
+func loginTestUser(t *testing.T, yeargroup string) (string, string) {
+	t.Helper()
+	n := testUserID.Add(1)
+	user := userT{
+		ID:         fmt.Sprintf("test-%d", n),
+		Name:       fmt.Sprintf("Student %d", n),
+		Email:      fmt.Sprintf("s%d@example.org", n),
+		Department: yeargroup,
+		Session:    fmt.Sprintf("session-%d", n),
+		Expr:       time.Now().Add(time.Hour).Unix(),
+		StudentID:  n,
+	} //exhaustruct:ignore
+	if err := db.UpsertUser(testContext(t), user); err != nil {
+		t.Fatal(err)
+	}
+	return user.ID, user.Session
+}
+
+/*
+ * Replace the expected students with the given users, by ID, with the given
+ * legal sexes, until the test ends. Users connect knowing their legal sex,
+ * so this should be called before they do.
+ */
+func setTestLegalSexes(t *testing.T, sexes map[string]string) {
+	t.Helper()
+	ctx := testContext(t)
+	list := make([]expectedStudentT, 0, len(sexes))
+	for userID, legalSex := range sexes {
+		user, err := db.GetUser(ctx, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, expectedStudentT{
+			ID:       user.StudentID,
+			Name:     user.Name,
+			LegalSex: legalSex,
+		}) //exhaustruct:ignore
+	}
+	entry := auditEntryT{
+		Action:  auditImportStudents,
+		Outcome: auditOK,
+	} //exhaustruct:ignore
+	if err := db.ReplaceExpectedStudents(ctx, list, entry); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.ReplaceExpectedStudents(context.Background(), nil, entry)
+	})
+}
+
+/*
+ * Count updates may come before or after the reply to a message, so next and
+ * waitSeats each keep what they read for the other.
+ */
+type testClientT struct {
+	t       *testing.T
+	c       *websocket.Conn
+	updates []string /* count updates next read and waitSeats has not */
+	replies []string /* other messages waitSeats read and next has not */
+}
+
+func dialTestClient(t *testing.T, session string) *testClientT {
+	t.Helper()
+	header := make(http.Header)
+	header.Set("Cookie", "session="+session)
+	c, _, err := websocket.Dial(
+		testContext(t),
+		"ws"+strings.TrimPrefix(testServer.URL, "http")+"/ws",
+		&websocket.DialOptions{
+			Subprotocols: []string{"cca1"},
+			HTTPHeader:   header,
+		}, //exhaustruct:ignore
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = c.CloseNow()
+	})
+	return &testClientT{t: t, c: c}
+}
+
+func (client *testClientT) send(msg string) {
+	client.t.Helper()
+	err := client.c.Write(testContext(client.t), websocket.MessageText, []byte(msg))
+	if err != nil {
+		client.t.Fatal(err)
+	}
+}
+
+/*
+ * Whether a message is one of those sending the seats taken in courses, which
+ * may come at any time.
+ */
+func isSeatsUpdate(msg string) bool {
+	return strings.HasPrefix(msg, "M ") ||
+		strings.HasPrefix(msg, "Q ") ||
+		strings.HasPrefix(msg, "P ")
+}
+
+/*
+ * Read the next message that is not a batched count update.
+ */
+func (client *testClientT) next() string {
+	client.t.Helper()
+	if len(client.replies) != 0 {
+		msg := client.replies[0]
+		client.replies = client.replies[1:]
+		return msg
+	}
+	for {
+		_, b, err := client.c.Read(testContext(client.t))
+		if err != nil {
+			client.t.Fatal(err)
+		}
+		msg := string(b)
+		if !isSeatsUpdate(msg) {
+			return msg
+		}
+		client.updates = append(client.updates, msg)
+	}
+}
+
+/*
+ * How many fields each course has in each kind of count update.
+ */
+var seatsUpdateFields = map[string]int{"M": 2, "Q": 3, "P": 3}
+
+/*
+ * Wait for a count update with all of the given fields, such as
+ * "P 3 Y9 1 3 Y10 0", whether or not next has already read it. Updates up to
+ * the one found are done with.
+ */
+func (client *testClientT) waitSeats(want string) {
+	client.t.Helper()
+	for i, msg := range client.updates {
+		if seatsUpdateHas(msg, want) {
+			client.updates = client.updates[i+1:]
+			return
+		}
+	}
+	client.updates = nil
+	for {
+		_, b, err := client.c.Read(testContext(client.t))
+		if err != nil {
+			client.t.Fatalf("waiting for %q: %v", want, err)
+		}
+		msg := string(b)
+		if !isSeatsUpdate(msg) {
+			client.replies = append(client.replies, msg)
+		} else if seatsUpdateHas(msg, want) {
+			return
+		}
+	}
+}
+
+func seatsUpdateHas(msg, want string) bool {
+	fields, wantFields := strings.Fields(msg), strings.Fields(want)
+	if len(fields) == 0 || fields[0] != wantFields[0] {
+		return false
+	}
+	n := seatsUpdateFields[fields[0]]
+	var groups [][]string
+	for rest := fields[1:]; len(rest) >= n; rest = rest[n:] {
+		groups = append(groups, rest[:n])
+	}
+	for rest := wantFields[1:]; len(rest) >= n; rest = rest[n:] {
+		if !slices.ContainsFunc(groups, func(group []string) bool {
+			return slices.Equal(group, rest[:n])
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Send a message and return the reply, without failing the test, so that it
+ * can be used from other goroutines.
+ */
+func (client *testClientT) roundTrip(ctx context.Context, msg string) (string, error) {
+	err := client.c.Write(ctx, websocket.MessageText, []byte(msg))
+	if err != nil {
+		return "", err
+	}
+	for {
+		_, b, err := client.c.Read(ctx)
+		if err != nil {
+			return "", err
+		}
+		if reply := string(b); !isSeatsUpdate(reply) {
+			return reply, nil
+		}
+	}
+}
+
+func (client *testClientT) expect(want string) {
+	client.t.Helper()
+	if got := client.next(); got != want {
+		client.t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+/*
+ * Send HELLO and check the reply, which ends with the user's choices.
+ */
+func (client *testClientT) hello(start string, confirmed string, choices string) {
+	client.t.Helper()
+	client.send("HELLO")
+	client.expect(start)
+	client.expect(confirmed)
+	client.expect("HI :" + choices)
+}
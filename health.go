@@ -0,0 +1,192 @@
+/*
+ * Health and readiness checks
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * /healthz tells the supervisor whether the process is alive, and /readyz
+ * tells the load balancer whether it should send us students. Both answer
+ * with a JSON object describing each check, and status 503 if any failed.
+ */
+
+const (
+	jwksRefreshInterval = time.Hour
+	/* Keys are only stale after several refreshes have failed */
+	jwksMaxAge      = 3 * jwksRefreshInterval
+	pollStateMaxAge = 10 * time.Second
+	readyzTimeout   = 2 * time.Second
+)
+
+/* Set once setup has finished; until then, only the checks are served */
+var ready atomic.Bool
+
+/* Unix nanoseconds of the last iteration of pollState */
+var pollStateLast atomic.Int64
+
+var jwksStatus struct {
+	lock        sync.Mutex
+	lastRefresh time.Time
+	lastError   string
+}
+
+/*
+ * The JWKS storage does not tell us when it refreshes successfully, so we
+ * watch its requests instead.
+ */
+type jwksTransportT struct {
+	http.RoundTripper
+}
+
+func (t jwksTransportT) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	jwksStatus.lock.Lock()
+	defer jwksStatus.lock.Unlock()
+	switch {
+	case err != nil:
+		jwksStatus.lastError = err.Error()
+	case resp.StatusCode != http.StatusOK:
+		jwksStatus.lastError = resp.Status
+	default:
+		jwksStatus.lastRefresh = time.Now()
+		jwksStatus.lastError = ""
+	}
+	return resp, err
+}
+
+func recordJwksError(_ context.Context, err error) {
+	jwksStatus.lock.Lock()
+	defer jwksStatus.lock.Unlock()
+	jwksStatus.lastError = err.Error()
+}
+
+type checkT struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	/* When the check last succeeded, for checks of background work */
+	Last       *time.Time `json:"last,omitempty"`
+	AgeSeconds *float64   `json:"age_seconds,omitempty"`
+	/* How long the check took, for checks that do something */
+	LatencySeconds *float64 `json:"latency_seconds,omitempty"`
+}
+
+type healthT struct {
+	Status string            `json:"status"`
+	Checks map[string]checkT `json:"checks"`
+}
+
+func ageCheck(last time.Time, maxAge time.Duration, what string) checkT {
+	if last.IsZero() {
+		return checkT{OK: false, Error: what + " has not run yet"} //exhaustruct:ignore
+	}
+	age := time.Since(last).Seconds()
+	check := checkT{OK: true, Last: &last, AgeSeconds: &age} //exhaustruct:ignore
+	if time.Since(last) > maxAge {
+		check.OK = false
+		check.Error = what + " is stale"
+	}
+	return check
+}
+
+func checkPollState() checkT {
+	var last time.Time
+	if ns := pollStateLast.Load(); ns != 0 {
+		last = time.Unix(0, ns)
+	}
+	return ageCheck(last, pollStateMaxAge, "pollState")
+}
+
+func checkJwks() checkT {
+	jwksStatus.lock.Lock()
+	last, lastError := jwksStatus.lastRefresh, jwksStatus.lastError
+	jwksStatus.lock.Unlock()
+	check := ageCheck(last, jwksMaxAge, "JWKS refresh")
+	if lastError != "" {
+		/* Still OK if the keys we have are recent enough */
+		check.Error = lastError
+	}
+	return check
+}
+
+func checkDatabase(ctx context.Context) checkT {
+	began := time.Now()
+	err := db.Ping(ctx)
+	latency := time.Since(began).Seconds()
+	if err != nil {
+		return checkT{OK: false, Error: err.Error(), LatencySeconds: &latency} //exhaustruct:ignore
+	}
+	return checkT{OK: true, LatencySeconds: &latency} //exhaustruct:ignore
+}
+
+func writeHealth(w http.ResponseWriter, checks map[string]checkT) {
+	health := healthT{Status: "ok", Checks: checks}
+	code := http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			health.Status = "fail"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(health)
+}
+
+/*
+ * We are alive as long as we can answer and, once set up, the state poller
+ * has not stalled; nothing external is checked, so that an outage of the
+ * database or the identity provider does not get us restarted.
+ */
+func handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	checks := make(map[string]checkT)
+	if ready.Load() {
+		checks["poll_state"] = checkPollState()
+	}
+	writeHealth(w, checks)
+}
+
+func refuseUntilReady(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !ready.Load() && req.URL.Path != "/healthz" && req.URL.Path != "/readyz" {
+			wstr(w, http.StatusServiceUnavailable, "We are still starting up. Please try again shortly.")
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func handleReadyz(w http.ResponseWriter, req *http.Request) {
+	if !ready.Load() {
+		writeHealth(w, map[string]checkT{
+			"setup": {OK: false, Error: "setup has not finished"}, //exhaustruct:ignore
+		})
+		return
+	}
+	if draining.Load() {
+		writeHealth(w, map[string]checkT{
+			"draining": {OK: false, Error: "shutting down"}, //exhaustruct:ignore
+		})
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), readyzTimeout)
+	defer cancel()
+	writeHealth(w, map[string]checkT{
+		"setup":      {OK: true}, //exhaustruct:ignore
+		"database":   checkDatabase(ctx),
+		"jwks":       checkJwks(),
+		"poll_state": checkPollState(),
+	})
+}
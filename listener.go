@@ -0,0 +1,240 @@
+/*
+ * Listener setup
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/*
+ * When we hand our listener over to a new process (see shutdown.go), the new
+ * process finds it as this file descriptor, and signals the old process,
+ * whose ID is in parentPIDEnv, to shut down once it is ready.
+ */
+const (
+	inheritedFDEnv = "CCA_LISTEN_FD"
+	parentPIDEnv   = "CCA_PARENT_PID"
+)
+
+var errBadInheritedFD = errors.New("bad inherited listener file descriptor")
+
+/*
+ * Whether we are taking over the listener of the process we are replacing.
+ */
+func listenerInherited() bool {
+	return os.Getenv(inheritedFDEnv) != ""
+}
+
+/*
+ * Open the listener described by the configuration, or take over the one
+ * passed to us by the process we are replacing. The first listener returned
+ * is the raw socket, which can be handed over; the second is the one to
+ * serve on, which may wrap the first in TLS.
+ */
+func openListener() (net.Listener, net.Listener, error) {
+	var raw net.Listener
+	var err error
+
+	if fdString := os.Getenv(inheritedFDEnv); fdString != "" {
+		fd, err := strconv.ParseUint(fdString, 10, 0)
+		if err != nil {
+			return nil, nil, wrapError(errBadInheritedFD, err)
+		}
+		f := os.NewFile(uintptr(fd), "inherited listener")
+		raw, err = net.FileListener(f)
+		if err != nil {
+			return nil, nil, wrapError(errBadInheritedFD, err)
+		}
+		_ = f.Close() /* FileListener made its own copy */
+		if ul, ok := raw.(*net.UnixListener); ok && config().Listen.Net == "unix" {
+			/* As the process we replaced would have on exit */
+			ul.SetUnlinkOnClose(true)
+		}
+		slog.Info("inherited listener", "fd", fd, "addr", raw.Addr())
+	} else {
+		slog.Info(
+			"listen",
+			"net", config().Listen.Net,
+			"addr", config().Listen.Addr,
+		)
+		switch config().Listen.Net {
+		case "systemd":
+			raw, err = systemdListener(config().Listen.Addr)
+		case "unix":
+			/* Checked by validateConfig */
+			mode, _ := strconv.ParseUint(config().Listen.Unix.Mode, 8, 32)
+			raw, err = listenUnix(
+				config().Listen.Addr,
+				fs.FileMode(mode),
+				config().Listen.Unix.Owner,
+				config().Listen.Unix.Group,
+			)
+		default:
+			raw, err = net.Listen(config().Listen.Net, config().Listen.Addr)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("establish listener: %w", err)
+		}
+	}
+
+	switch config().Listen.Trans {
+	case "plain":
+		return raw, raw, nil
+	case "tls":
+		err := loadCertificate()
+		if err != nil {
+			_ = raw.Close()
+			return nil, nil, fmt.Errorf("load TLS certificate and key: %w", err)
+		}
+		tlsconfig := &tls.Config{
+			GetCertificate: getCertificate,
+			MinVersion:     tls.VersionTLS13,
+		} //exhaustruct:ignore
+		return raw, tls.NewListener(raw, tlsconfig), nil
+	default:
+		_ = raw.Close()
+		return nil, nil, errors.New("listen.trans must be \"plain\" or \"tls\"")
+	}
+}
+
+/* The first file descriptor passed by systemd; see sd_listen_fds(3) */
+const systemdFirstFD = 3
+
+var (
+	errNoSystemdSockets = errors.New("no sockets passed by systemd")
+	errNoSuchSystemdFD  = errors.New("no socket with this name passed by systemd")
+	errUnixSocketInUse  = errors.New("another process is listening on this socket")
+)
+
+/*
+ * Use a socket passed by systemd socket activation. If there are several,
+ * name selects the one whose FileDescriptorName= matches; if name is empty,
+ * the first one is used.
+ */
+func systemdListener(name string) (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, errNoSystemdSockets
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds < 1 {
+		return nil, errNoSystemdSockets
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	/* So that whatever we start does not think they are meant for it */
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	i := 0
+	if name != "" {
+		i = slices.Index(names, name)
+		if i < 0 || i >= nfds {
+			return nil, wrapAny(errNoSuchSystemdFD, name)
+		}
+	}
+	f := os.NewFile(uintptr(systemdFirstFD+i), "systemd socket")
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	_ = f.Close()
+	return l, nil
+}
+
+/*
+ * Listen on a UNIX domain socket, removing the socket left behind by a
+ * process that has since died, and set its mode and owner so that only those
+ * meant to can connect. Empty owners and groups are left unchanged.
+ */
+func listenUnix(path string, mode fs.FileMode, owner, group string) (net.Listener, error) {
+	abstract := strings.HasPrefix(path, "@")
+	if !abstract {
+		err := removeStaleSocket(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if abstract {
+		return l, nil
+	}
+
+	err = os.Chmod(path, mode)
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	uid, gid := -1, -1
+	if owner != "" {
+		u, err := user.Lookup(owner)
+		if err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	if uid != -1 || gid != -1 {
+		err = os.Lchown(path, uid, gid)
+		if err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+/*
+ * A socket file that nobody accepts connections on was left behind by a
+ * previous run that did not exit cleanly, and would make net.Listen fail.
+ */
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode().Type() != fs.ModeSocket {
+		/* Not ours to remove; let net.Listen report it */
+		return nil
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		_ = conn.Close()
+		return wrapAny(errUnixSocketInUse, path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	slog.Info("removing stale socket", "path", path)
+	return os.Remove(path)
+}
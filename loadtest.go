@@ -0,0 +1,671 @@
+/*
+ * Selection day simulator
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+/*
+ * "cca loadtest" seeds simulated students into the database, with sessions
+ * so that they need not go through the identity provider, and has all of
+ * them connect to a running instance at once and choose, unchoose and
+ * confirm courses like a student would. It should only be run against a
+ * test deployment, as the simulated students and their choices are left in
+ * the database.
+ */
+
+var (
+	errLoadtestTimeout   = errors.New("timed out waiting for reply")
+	errLoadtestClosed    = errors.New("connection closed")
+	errUnexpectedReply   = errors.New("unexpected reply")
+	errCourseOverfilled  = errors.New("some courses were overfilled")
+	errOpenNeedsPostgres = errors.New("-open only reaches the server through PostgreSQL")
+	errNoMetricsURL      = errors.New("no metrics to read; set metrics.addr or metrics.token, or give -metrics")
+	errMetricNotFound    = errors.New("cca_sendq_dropped_total not found")
+)
+
+type loadtestOptionsT struct {
+	Students  int
+	YearGroup string
+	URL       string
+	Metrics   string
+	Think     time.Duration
+	Ramp      time.Duration
+	Timeout   time.Duration
+	Open      bool
+	Seed      uint64
+}
+
+type loadtestStatsT struct {
+	lock      sync.Mutex
+	latencies map[string][]time.Duration /* by verb */
+
+	connected   atomic.Int64
+	failed      atomic.Int64
+	started     atomic.Int64
+	missedStart atomic.Int64
+	chosen      atomic.Int64
+	full        atomic.Int64
+	conflict    atomic.Int64
+	refused     atomic.Int64 /* R for any other reason */
+	unchosen    atomic.Int64
+	confirmed   atomic.Int64
+	rejected    atomic.Int64 /* RC */
+	errors      atomic.Int64 /* E */
+
+	/* Messages the server dropped during the run, unless droppedErr */
+	dropped    uint64
+	droppedErr error
+
+	maxSeenLock sync.Mutex
+	maxSeen     map[int]uint32 /* the highest count in M messages */
+}
+
+func (stats *loadtestStatsT) record(verb string, d time.Duration) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.latencies[verb] = append(stats.latencies[verb], d)
+}
+
+func (stats *loadtestStatsT) seen(courseID int, selected uint32) {
+	stats.maxSeenLock.Lock()
+	defer stats.maxSeenLock.Unlock()
+	if selected > stats.maxSeen[courseID] {
+		stats.maxSeen[courseID] = selected
+	}
+}
+
+/*
+ * A connection of a simulated student. The reading goroutine handles count
+ * updates and state changes itself and passes everything else on as replies.
+ */
+type loadtestConnT struct {
+	c       *websocket.Conn
+	replies chan string
+	start   chan struct{}
+	closed  chan struct{}
+	initial []int /* choices from HI, left over from an earlier run */
+}
+
+func cmdLoadtest(args []string) error {
+	var opts loadtestOptionsT
+	flags := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	flags.IntVar(&opts.Students, "n", 100, "number of simulated students")
+	flags.StringVar(&opts.YearGroup, "yeargroup", "Y12", "year group of the simulated students")
+	flags.StringVar(&opts.URL, "url", "", "WebSocket URL (default: derived from the configured URL)")
+	flags.StringVar(&opts.Metrics, "metrics", "", "metrics URL (default: derived from the configured metrics listener or URL)")
+	flags.DurationVar(&opts.Think, "think", 500*time.Millisecond, "longest pause between the actions of a student")
+	flags.DurationVar(&opts.Ramp, "ramp", 0, "spread connections over this long instead of connecting at once")
+	flags.DurationVar(&opts.Timeout, "timeout", 30*time.Second, "how long to wait for each reply")
+	flags.BoolVar(&opts.Open, "open", false, "open selections for the year group once every student is connected")
+	flags.Uint64Var(&opts.Seed, "seed", uint64(time.Now().UnixNano()), "random seed")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 0 || opts.Students <= 0 {
+		return errBadNumberOfArguments
+	}
+	if _, ok := states[opts.YearGroup]; !ok {
+		return wrapAny(errNoSuchYearGroup, opts.YearGroup)
+	}
+	if opts.URL == "" {
+		opts.URL = strings.Replace(strings.TrimSuffix(config().URL, "/"), "http", "ws", 1) + "/ws"
+	}
+	if opts.Metrics == "" {
+		opts.Metrics = loadtestMetricsURL()
+	}
+
+	err = setupDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if opts.Open && db.Type() != "postgres" {
+		return errOpenNeedsPostgres
+	}
+	ctx := context.Background()
+
+	list, err := db.GetCourses(ctx)
+	if err != nil {
+		return err
+	}
+	var available []*courseT
+	for _, course := range list {
+		if course.YearGroups&yearGroupsNumberBits[opts.YearGroup] != 0 {
+			available = append(available, course)
+		}
+	}
+	if len(available) == 0 {
+		return wrapAny(errNoSuchCourse, "for "+opts.YearGroup)
+	}
+
+	sessions, err := seedLoadtestStudents(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	stats := &loadtestStatsT{
+		latencies: make(map[string][]time.Duration),
+		maxSeen:   make(map[int]uint32),
+	} //exhaustruct:ignore
+
+	fmt.Printf("simulating %d students of %s against %s\n", opts.Students, opts.YearGroup, opts.URL)
+	droppedBefore, droppedErr := scrapeSendqDropped(ctx, opts)
+	began := time.Now()
+
+	conns := make([]*loadtestConnT, opts.Students)
+	var wg sync.WaitGroup
+	for i, session := range sessions {
+		if opts.Ramp > 0 {
+			time.Sleep(opts.Ramp / time.Duration(opts.Students))
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := dialLoadtest(ctx, opts, session, stats)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "student %d: %v\n", i, err)
+				stats.failed.Add(1)
+				return
+			}
+			stats.connected.Add(1)
+			conns[i] = conn
+		}()
+	}
+	wg.Wait()
+
+	if opts.Open {
+		err = db.SetState(ctx, opts.YearGroup, 2, auditEntryT{
+			Action:  auditSetState,
+			Outcome: auditOK,
+			Detail:  opts.YearGroup + " 2 (load test)",
+		}) //exhaustruct:ignore
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, conn := range conns {
+		if conn == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				_ = conn.c.CloseNow()
+			}()
+			rng := rand.New(rand.NewPCG(opts.Seed, uint64(i))) //#nosec G404
+			err := simulateStudent(ctx, opts, conn, available, stats, rng)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "student %d: %v\n", i, err)
+				stats.failed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(began)
+
+	stats.droppedErr = droppedErr
+	if droppedErr == nil {
+		var droppedAfter uint64
+		droppedAfter, stats.droppedErr = scrapeSendqDropped(ctx, opts)
+		/* The counter restarts from 0 if the server does */
+		stats.dropped = droppedAfter - min(droppedBefore, droppedAfter)
+	}
+
+	return reportLoadtest(ctx, opts, stats, elapsed)
+}
+
+/*
+ * The metrics of the instance under test, which are served without a token
+ * on the metrics listener if there is one, or otherwise with the token on
+ * the main one.
+ */
+func loadtestMetricsURL() string {
+	if config().Metrics.Addr != "" && config().Metrics.Net == "tcp" {
+		addr := config().Metrics.Addr
+		if strings.HasPrefix(addr, ":") {
+			addr = "localhost" + addr
+		}
+		return "http://" + addr + "/metrics"
+	}
+	if config().Metrics.Token != "" {
+		return strings.TrimSuffix(config().URL, "/") + "/metrics"
+	}
+	return ""
+}
+
+/*
+ * Read how many messages the instance under test has dropped because a send
+ * queue was full since it started.
+ */
+func scrapeSendqDropped(ctx context.Context, opts loadtestOptionsT) (uint64, error) {
+	if opts.Metrics == "" {
+		return 0, errNoMetricsURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, opts.Metrics, nil)
+	if err != nil {
+		return 0, err
+	}
+	if token := config().Metrics.Token; token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: opts.Timeout} //exhaustruct:ignore
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, wrapAny(errUnexpectedReply, resp.Status)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "cca_sendq_dropped_total "); ok {
+			return strconv.ParseUint(value, 10, 64)
+		}
+	}
+	return 0, cmp.Or(scanner.Err(), errMetricNotFound)
+}
+
+func seedLoadtestStudents(ctx context.Context, opts loadtestOptionsT) ([]string, error) {
+	sessions := make([]string, 0, opts.Students)
+	expr := time.Now().Add(24 * time.Hour).Unix()
+	for i := range opts.Students {
+		session, err := randomString(20)
+		if err != nil {
+			return nil, err
+		}
+		err = db.UpsertUser(ctx, userT{
+			ID:         fmt.Sprintf("loadtest-%d", i),
+			Name:       fmt.Sprintf("Load Test %d", i),
+			Email:      fmt.Sprintf("loadtest-%d@loadtest.invalid", i),
+			Department: opts.YearGroup,
+			Session:    session,
+			Expr:       expr,
+		}) //exhaustruct:ignore
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func dialLoadtest(
+	ctx context.Context,
+	opts loadtestOptionsT,
+	session string,
+	stats *loadtestStatsT,
+) (*loadtestConnT, error) {
+	header := make(http.Header)
+	header.Set("Cookie", "session="+session)
+	dialCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+	began := time.Now()
+	c, _, err := websocket.Dial(dialCtx, opts.URL, &websocket.DialOptions{
+		Subprotocols: []string{"cca1"},
+		HTTPHeader:   header,
+	}) //exhaustruct:ignore
+	if err != nil {
+		return nil, err
+	}
+	stats.record("connect", time.Since(began))
+
+	conn := &loadtestConnT{
+		c:       c,
+		replies: make(chan string, 16),
+		start:   make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+	go conn.read(ctx, stats)
+
+	_, err = conn.request(ctx, opts, stats, "HELLO")
+	for err == nil {
+		var reply string
+		reply, err = conn.await(opts)
+		if after, ok := strings.CutPrefix(reply, "HI :"); ok {
+			for _, id := range strings.Split(after, ",") {
+				courseID, err := strconv.Atoi(id)
+				if err == nil {
+					conn.initial = append(conn.initial, courseID)
+				}
+			}
+			return conn, nil
+		}
+	}
+	_ = c.CloseNow()
+	return nil, err
+}
+
+func (conn *loadtestConnT) read(ctx context.Context, stats *loadtestStatsT) {
+	defer close(conn.closed)
+	for {
+		_, b, err := conn.c.Read(ctx)
+		if err != nil {
+			return
+		}
+		mar := strings.Split(string(b), " ")
+		switch mar[0] {
+		case "M":
+			for i := 1; i+1 < len(mar); i += 2 {
+				courseID, err1 := strconv.Atoi(mar[i])
+				selected, err2 := strconv.ParseUint(mar[i+1], 10, 32)
+				if err1 == nil && err2 == nil {
+					stats.seen(courseID, uint32(selected))
+				}
+			}
+		case "Q", "P":
+			/*
+			 * Seats taken by legal sex and under quotas, which are
+			 * no reply to anything
+			 */
+		case "START":
+			select {
+			case conn.start <- struct{}{}:
+			default:
+			}
+		case "STOP":
+		default:
+			select {
+			case conn.replies <- string(b):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+/*
+ * Send a message and wait for the reply, recording the latency under the
+ * verb of the message.
+ */
+func (conn *loadtestConnT) request(
+	ctx context.Context,
+	opts loadtestOptionsT,
+	stats *loadtestStatsT,
+	msg string,
+) (string, error) {
+	began := time.Now()
+	err := conn.c.Write(ctx, websocket.MessageText, []byte(msg))
+	if err != nil {
+		return "", err
+	}
+	timer := time.NewTimer(opts.Timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-conn.replies:
+		stats.record(strings.SplitN(msg, " ", 2)[0], time.Since(began))
+		if strings.HasPrefix(reply, "E ") {
+			stats.errors.Add(1)
+		}
+		return reply, nil
+	case <-conn.closed:
+		return "", errLoadtestClosed
+	case <-timer.C:
+		return "", wrapAny(errLoadtestTimeout, msg)
+	}
+}
+
+/*
+ * Behave roughly like a student: choose courses of the types still needed,
+ * sometimes change one's mind, and confirm once the requirements are met.
+ */
+func simulateStudent(
+	ctx context.Context,
+	opts loadtestOptionsT,
+	conn *loadtestConnT,
+	available []*courseT,
+	stats *loadtestStatsT,
+	rng *rand.Rand,
+) error {
+	think := func() {
+		if opts.Think > 0 {
+			time.Sleep(time.Duration(rng.Int64N(int64(opts.Think))))
+		}
+	}
+
+	/* HELLO told us START already if selections were open */
+	timer := time.NewTimer(opts.Timeout)
+	select {
+	case <-conn.start:
+		timer.Stop()
+	case <-conn.closed:
+		timer.Stop()
+		return errLoadtestClosed
+	case <-timer.C:
+		stats.missedStart.Add(1)
+		return nil
+	}
+	stats.started.Add(1)
+
+	chosen := make(map[int]*courseT)
+	groups := make(map[string]struct{})
+	types := make(map[string]int)
+	refused := make(map[int]struct{})
+	for _, course := range available {
+		if slices.Contains(conn.initial, course.ID) {
+			chosen[course.ID] = course
+			groups[course.Group] = struct{}{}
+			types[course.Type]++
+		}
+	}
+
+	for {
+		think()
+
+		if len(chosen) > 0 && rng.IntN(8) == 0 {
+			ids := getKeysOfMap(chosen)
+			slices.Sort(ids)
+			course := chosen[ids[rng.IntN(len(ids))]]
+			reply, err := conn.request(ctx, opts, stats, "N "+strconv.Itoa(course.ID))
+			if err != nil {
+				return err
+			}
+			if reply == "N "+strconv.Itoa(course.ID) {
+				stats.unchosen.Add(1)
+				delete(chosen, course.ID)
+				delete(groups, course.Group)
+				types[course.Type]--
+				/* Do not pick it straight away again */
+				refused[course.ID] = struct{}{}
+			}
+			continue
+		}
+
+		satisfied := true
+		var candidates []*courseT
+		for _, course := range available {
+			if _, ok := groups[course.Group]; ok {
+				continue
+			}
+			if _, ok := refused[course.ID]; ok {
+				continue
+			}
+			minimum, err := getCourseTypeMinimumForYearGroup(opts.YearGroup, course.Type)
+			if err != nil {
+				return err
+			}
+			if types[course.Type] < minimum {
+				candidates = append(candidates, course)
+			}
+		}
+		for courseType := range courseTypes {
+			minimum, err := getCourseTypeMinimumForYearGroup(opts.YearGroup, courseType)
+			if err != nil {
+				return err
+			}
+			if types[courseType] < minimum {
+				satisfied = false
+			}
+		}
+
+		if satisfied {
+			reply, err := conn.request(ctx, opts, stats, "YC")
+			if err != nil {
+				return err
+			}
+			if reply == "YC" {
+				stats.confirmed.Add(1)
+			} else if strings.HasPrefix(reply, "RC ") {
+				stats.rejected.Add(1)
+			}
+			return nil
+		}
+		if len(candidates) == 0 {
+			/* Everything we could still take is full */
+			return nil
+		}
+
+		course := candidates[rng.IntN(len(candidates))]
+		id := strconv.Itoa(course.ID)
+		reply, err := conn.request(ctx, opts, stats, "Y "+id)
+		if err != nil {
+			return err
+		}
+		switch reply {
+		case "Y " + id:
+			stats.chosen.Add(1)
+			chosen[course.ID] = course
+			groups[course.Group] = struct{}{}
+			types[course.Type]++
+		case "R " + id + " :Full":
+			stats.full.Add(1)
+			refused[course.ID] = struct{}{}
+		case "R " + id + " :Group conflict":
+			stats.conflict.Add(1)
+			refused[course.ID] = struct{}{}
+		default:
+			if !strings.HasPrefix(reply, "R "+id+" :") {
+				return wrapAny(errUnexpectedReply, reply)
+			}
+			/* Seats set aside for others, eligibility rules and the like */
+			stats.refused.Add(1)
+			refused[course.ID] = struct{}{}
+		}
+	}
+}
+
+func (conn *loadtestConnT) await(opts loadtestOptionsT) (string, error) {
+	timer := time.NewTimer(opts.Timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-conn.replies:
+		return reply, nil
+	case <-conn.closed:
+		return "", errLoadtestClosed
+	case <-timer.C:
+		return "", errLoadtestTimeout
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+func reportLoadtest(
+	ctx context.Context,
+	opts loadtestOptionsT,
+	stats *loadtestStatsT,
+	elapsed time.Duration,
+) error {
+	fmt.Printf("finished in %v\n\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("connected      %d of %d (%d failed)\n", stats.connected.Load(), opts.Students, stats.failed.Load())
+	fmt.Printf("started        %d (%d never received START)\n", stats.started.Load(), stats.missedStart.Load())
+	attempts := stats.chosen.Load() + stats.full.Load() + stats.conflict.Load() + stats.refused.Load()
+	fullRate := 0.0
+	if attempts > 0 {
+		fullRate = 100 * float64(stats.full.Load()) / float64(attempts)
+	}
+	fmt.Printf("Y              %d accepted, %d full (%.1f%%), %d group conflicts, %d otherwise refused\n",
+		stats.chosen.Load(), stats.full.Load(), fullRate, stats.conflict.Load(), stats.refused.Load())
+	fmt.Printf("N              %d\n", stats.unchosen.Load())
+	fmt.Printf("YC             %d confirmed, %d rejected\n", stats.confirmed.Load(), stats.rejected.Load())
+	fmt.Printf("E              %d\n", stats.errors.Load())
+	if stats.droppedErr != nil {
+		fmt.Printf("sendq dropped  unknown (%v)\n\n", stats.droppedErr)
+	} else {
+		fmt.Printf("sendq dropped  %d\n\n", stats.dropped)
+	}
+
+	stats.lock.Lock()
+	verbs := getKeysOfMap(stats.latencies)
+	slices.Sort(verbs)
+	fmt.Printf("%-8s %8s %10s %10s %10s %10s\n", "latency", "count", "p50", "p90", "p99", "max")
+	for _, verb := range verbs {
+		l := stats.latencies[verb]
+		slices.Sort(l)
+		fmt.Printf("%-8s %8d %10v %10v %10v %10v\n", verb, len(l),
+			percentile(l, 0.5).Round(time.Microsecond),
+			percentile(l, 0.9).Round(time.Microsecond),
+			percentile(l, 0.99).Round(time.Microsecond),
+			l[len(l)-1].Round(time.Microsecond))
+	}
+	stats.lock.Unlock()
+	fmt.Println()
+
+	/*
+	 * Students only learn about dropped messages by not receiving them, so
+	 * missing START above is the symptom; the dropped count above is of
+	 * every connection to the instance, including those of real students.
+	 */
+	if stats.missedStart.Load() > 0 || stats.dropped > 0 {
+		fmt.Println("messages were dropped; consider raising perf.sendq")
+	}
+
+	list, err := db.GetCourses(ctx)
+	if err != nil {
+		return err
+	}
+	choices, err := db.GetChoices(ctx)
+	if err != nil {
+		return err
+	}
+	counted := make(map[int]uint32)
+	for _, choice := range choices {
+		counted[choice.CourseID]++
+	}
+	overfilled := 0
+	stats.maxSeenLock.Lock()
+	defer stats.maxSeenLock.Unlock()
+	for _, course := range list {
+		seen := stats.maxSeen[course.ID]
+		if seen > course.Max || course.Selected > course.Max || counted[course.ID] > course.Max {
+			overfilled++
+			fmt.Printf("OVERFILLED %d %s: max %d, highest announced %d, selected %d, choices %d\n",
+				course.ID, course.Title, course.Max, seen, course.Selected, counted[course.ID])
+		}
+	}
+	if overfilled == 0 {
+		fmt.Println("no course ever exceeded its maximum")
+		return nil
+	}
+	return errCourseOverfilled
+}
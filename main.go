@@ -9,14 +9,13 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"embed"
+	"errors"
 	"flag"
 	"html/template"
 	"io/fs"
 	"log"
 	"log/slog"
-	"net"
 	"net/http"
 	"time"
 )
@@ -52,6 +51,17 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	if flag.NArg() != 0 {
+		subcommand, ok := subcommands[flag.Arg(0)]
+		if !ok {
+			log.Fatalln(wrapAny(errUnknownSubcommand, flag.Arg(0)))
+		}
+		if err := subcommand(flag.Args()[1:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	slog.Info("setting up templates")
 	tmpl, err = template.ParseFS(runFS, "templates/*")
 	if err != nil {
@@ -105,63 +115,69 @@ func main() {
 
 	slog.Info("registering handlers")
 	http.HandleFunc("/ws", handleWs)
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
 	setHandler("/{$}", handleIndex)
 	setHandler("/export/choices", handleExportChoices)
 	setHandler("/export/students", handleExportStudents)
+	setHandler("/export/rosters", handleExportRosters)
+	setHandler("/export/workbook", handleExportWorkbook)
+	setHandler("/export/incomplete", handleExportIncomplete)
+	setHandler("/incomplete", handleIncomplete)
+	setHandler("/export/rostercheck", handleExportRosterCheck)
+	setHandler("/rostercheck", handleRosterCheck)
+	setHandler("/attendance", handleAttendance)
+	setHandler("/export/audit", handleExportAudit)
 	setHandler("/auth", handleAuth)
 	setHandler("/state", handleState)
 	setHandler("/newcourses", handleNewCourses)
 	setHandler("/newstudents", handleNewStudents)
+	setHandler("/diagnostics", handleDiagnostics)
+	setHandler("/audit", handleAudit)
+	if config().Metrics.Token != "" {
+		setHandler("/metrics", handleMetrics)
+	}
 
-	var l net.Listener
-
-	switch config.Listen.Trans {
-	case "plain":
-		slog.Info(
-			"plain",
-			"net", config.Listen.Net,
-			"addr", config.Listen.Addr,
-		)
-		l, err = net.Listen(config.Listen.Net, config.Listen.Addr)
-		if err != nil {
-			log.Fatalf(
-				"Failed to establish plain listener: %v\n",
-				err,
-			)
-		}
-	case "tls":
-		cer, err := tls.LoadX509KeyPair(
-			config.Listen.TLS.Cert,
-			config.Listen.TLS.Key,
-		)
-		if err != nil {
-			log.Fatalf(
-				"Failed to load TLS certificate and key: %v\n",
-				err,
-			)
-		}
-		tlsconfig := &tls.Config{
-			Certificates: []tls.Certificate{cer},
-			MinVersion:   tls.VersionTLS13,
-		} //exhaustruct:ignore
-		slog.Info(
-			"tls",
-			"net", config.Listen.Net,
-			"addr", config.Listen.Addr,
-		)
-		l, err = tls.Listen(
-			config.Listen.Net,
-			config.Listen.Addr,
-			tlsconfig,
-		)
-		if err != nil {
-			log.Fatalf(
-				"Failed to establish TLS listener: %v\n",
-				err,
-			)
-		}
-	default:
-		log.Fatalln("listen.trans must be \"plain\" or \"tls\"")
+	if config().Listen.Proto != "http" {
+		log.Fatalln("Unsupported protocol")
+	}
+
+	setupExecutablePath()
+
+	rawL, l, err := openListener()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	/*
+	 * On a fresh listener, serve right away so that /healthz and /readyz
+	 * can answer while we set up; everything else is refused until we are
+	 * ready. A listener handed over to us is still served by the process
+	 * we are replacing, which keeps accepting from it until we accept
+	 * too, so we leave it to that process until we are ready rather than
+	 * refuse students in the meantime.
+	 */
+	srv := &http.Server{
+		Handler: refuseUntilReady(http.DefaultServeMux),
+		ReadHeaderTimeout: time.Duration(
+			config().Perf.ReadHeaderTimeout,
+		) * time.Second,
+	} //exhaustruct:ignore
+	serveErr := make(chan error, 1)
+	serve := func() {
+		slog.Info("serving http")
+		go func() {
+			serveErr <- srv.Serve(l)
+		}()
+	}
+	inherited := listenerInherited()
+	if !inherited {
+		serve()
+	}
+
+	slog.Info("setting up instance ID")
+	if err := setupInstanceID(); err != nil {
+		log.Fatalln(err)
 	}
 
 	slog.Info("setting up database")
@@ -169,6 +185,11 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	slog.Info("checking database schema")
+	if err := setupSchema(context.Background()); err != nil {
+		log.Fatalln(err)
+	}
+
 	slog.Info("loading state")
 	if err := loadStateAndSchedule(); err != nil {
 		log.Fatalln(err)
@@ -180,6 +201,11 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	slog.Info("reconciling selected counts")
+	if _, err := reconcileCounts(context.Background(), ""); err != nil {
+		log.Fatalln(err)
+	}
+
 	slog.Info("setting up JWKS")
 	if err := setupJwks(); err != nil {
 		log.Fatalln(err)
@@ -187,18 +213,43 @@ func main() {
 
 	go pollState()
 
-	if config.Listen.Proto == "http" {
-		slog.Info("serving http")
-		srv := &http.Server{
-			ReadHeaderTimeout: time.Duration(
-				config.Perf.ReadHeaderTimeout,
-			) * time.Second,
-		} //exhaustruct:ignore
-		err = srv.Serve(l)
-	} else {
-		log.Fatalln("Unsupported protocol")
+	go runBroadcaster()
+
+	go runListener()
+
+	if config().Perf.ReconcileInterval > 0 {
+		go runReconciler()
 	}
-	if err != nil {
+
+	if config().Listen.Trans == "tls" {
+		go watchCertificate()
+	}
+
+	if config().Admin.Socket != "" {
+		slog.Info("admin socket", "path", config().Admin.Socket)
+		go runAdminSocket()
+	}
+
+	if config().Metrics.Addr != "" {
+		slog.Info("metrics", "net", config().Metrics.Net, "addr", config().Metrics.Addr)
+		go runMetricsListener()
+	}
+
+	shutdownDone := make(chan struct{})
+	go handleSignals(srv, rawL, shutdownDone)
+
+	ready.Store(true)
+	if inherited {
+		serve()
+	}
+	slog.Info("ready")
+
+	finishHandoff()
+
+	err = <-serveErr
+	if !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalln(err)
 	}
+	<-shutdownDone
+	slog.Info("shut down")
 }
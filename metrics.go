@@ -0,0 +1,279 @@
+/*
+ * Prometheus metrics
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/*
+ * We write the Prometheus text format ourselves rather than pulling in the
+ * client library, as we only have a handful of counters and histograms, all
+ * of whose labels are known in advance. Everything else is read from the
+ * rest of the program when scraped.
+ */
+
+var errBadMetricsToken = errors.New("bad metrics token")
+
+/* In seconds */
+var latencyBuckets = []float64{
+	0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5,
+}
+
+type histogramT struct {
+	buckets [13]atomic.Uint64 /* one more than latencyBuckets, for +Inf */
+	sum     atomic.Int64      /* nanoseconds */
+}
+
+func (h *histogramT) observe(d time.Duration) {
+	seconds := d.Seconds()
+	i, _ := slices.BinarySearch(latencyBuckets, seconds)
+	h.buckets[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+type commandMetricsT struct {
+	latency histogramT
+}
+
+/*
+ * Only the verbs handleConn knows are counted, so that clients cannot make
+ * up labels.
+ */
+var commandMetrics = map[string]*commandMetricsT{
+	"HELLO": {},
+	"Y":     {},
+	"N":     {},
+	"YC":    {},
+	"NC":    {},
+}
+
+func observeCommand(verb string, d time.Duration) {
+	if m, ok := commandMetrics[verb]; ok {
+		m.latency.observe(d)
+	}
+}
+
+const (
+	rejectFull          = "full"
+	rejectGroupConflict = "group_conflict"
+	rejectNotOpen       = "not_open"
+	rejectYearGroup     = "year_group"
+	rejectRequirements  = "requirements"
+	rejectSexFull       = "sex_full"
+	rejectSexUnknown    = "sex_unknown"
+	rejectQuotaFull     = "quota_full"
+	rejectSeatsHeld     = "seats_held"
+	rejectNotInvited    = "not_invited"
+	rejectExcluded      = "excluded"
+	rejectRequires      = "requires"
+	rejectRequired      = "required"
+	rejectTypeMaximum   = "type_maximum"
+	rejectTotalMaximum  = "total_maximum"
+)
+
+var rejections = map[string]*atomic.Uint64{
+	rejectFull:          {},
+	rejectGroupConflict: {},
+	rejectNotOpen:       {},
+	rejectYearGroup:     {},
+	rejectRequirements:  {},
+	rejectSexFull:       {},
+	rejectSexUnknown:    {},
+	rejectQuotaFull:     {},
+	rejectSeatsHeld:     {},
+	rejectNotInvited:    {},
+	rejectExcluded:      {},
+	rejectRequires:      {},
+	rejectRequired:      {},
+	rejectTypeMaximum:   {},
+	rejectTotalMaximum:  {},
+}
+
+func countRejection(reason string) {
+	if c, ok := rejections[reason]; ok {
+		c.Add(1)
+	}
+}
+
+var (
+	usemSets      atomic.Uint64
+	usemCoalesced atomic.Uint64
+)
+
+/*
+ * Serve /metrics on the main listener, for scrapers that present the token.
+ */
+func handleMetrics(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config().Metrics.Token)) != 1 {
+		return "", http.StatusUnauthorized, errBadMetricsToken
+	}
+	writeMetricsResponse(w)
+	return "", -1, nil
+}
+
+func writeMetricsResponse(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	writeMetrics(bw)
+	_ = bw.Flush()
+}
+
+/*
+ * Serve /metrics without a token on the separate metrics listener, if one is
+ * configured. This should be run in its own goroutine.
+ */
+func runMetricsListener() {
+	l, err := net.Listen(config().Metrics.Net, config().Metrics.Addr)
+	/*
+	 * After a handoff, the old process keeps the address until it has
+	 * drained.
+	 */
+	for errors.Is(err, syscall.EADDRINUSE) {
+		time.Sleep(time.Second)
+		l, err = net.Listen(config().Metrics.Net, config().Metrics.Addr)
+	}
+	if err != nil {
+		slog.Error("metrics listener", "error", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		writeMetricsResponse(w)
+	})
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: time.Duration(config().Perf.ReadHeaderTimeout) * time.Second,
+	} //exhaustruct:ignore
+	err = srv.Serve(l)
+	slog.Error("metrics listener", "error", err)
+}
+
+func writeMetric(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeMetrics(w io.Writer) {
+	yeargroups := getKeysOfMap(states)
+	slices.Sort(yeargroups)
+
+	writeMetric(w, "cca_websocket_connections", "gauge", "Connected WebSockets by year group.")
+	for _, yeargroup := range yeargroups {
+		n := 0
+		chanPool[yeargroup].Range(func(_, _ interface{}) bool {
+			n++
+			return true
+		})
+		fmt.Fprintf(w, "cca_websocket_connections{yeargroup=%s} %d\n", labelValue(yeargroup), n)
+	}
+
+	writeMetric(w, "cca_state", "gauge", "Selection state by year group: 0 disabled, 1 read-only, 2 open, 3 scheduled.")
+	for _, yeargroup := range yeargroups {
+		fmt.Fprintf(w, "cca_state{yeargroup=%s} %d\n", labelValue(yeargroup), atomic.LoadUint32(states[yeargroup]))
+	}
+
+	verbs := getKeysOfMap(commandMetrics)
+	slices.Sort(verbs)
+	writeMetric(w, "cca_command_duration_seconds", "histogram", "Time taken to handle WebSocket commands, by verb.")
+	for _, verb := range verbs {
+		h := &commandMetrics[verb].latency
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.buckets[i].Load()
+			fmt.Fprintf(w, "cca_command_duration_seconds_bucket{verb=%s,le=%s} %d\n",
+				labelValue(verb), labelValue(formatFloat(le)), cumulative)
+		}
+		cumulative += h.buckets[len(latencyBuckets)].Load()
+		fmt.Fprintf(w, "cca_command_duration_seconds_bucket{verb=%s,le=\"+Inf\"} %d\n", labelValue(verb), cumulative)
+		fmt.Fprintf(w, "cca_command_duration_seconds_sum{verb=%s} %s\n",
+			labelValue(verb), formatFloat(time.Duration(h.sum.Load()).Seconds()))
+		fmt.Fprintf(w, "cca_command_duration_seconds_count{verb=%s} %d\n", labelValue(verb), cumulative)
+	}
+
+	reasons := getKeysOfMap(rejections)
+	slices.Sort(reasons)
+	writeMetric(w, "cca_rejections_total", "counter", "Rejected commands, by reason.")
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "cca_rejections_total{reason=%s} %d\n", labelValue(reason), rejections[reason].Load())
+	}
+
+	writeMetric(w, "cca_sendq_dropped_total", "counter", "Messages dropped because the send queue of a connection was full.")
+	fmt.Fprintf(w, "cca_sendq_dropped_total %d\n", sendqDropped.Load())
+
+	writeMetric(w, "cca_usem_sets_total", "counter", "Count update signals sent to connections.")
+	fmt.Fprintf(w, "cca_usem_sets_total %d\n", usemSets.Load())
+	writeMetric(w, "cca_usem_coalesced_total", "counter", "Count update signals coalesced with one still pending.")
+	fmt.Fprintf(w, "cca_usem_coalesced_total %d\n", usemCoalesced.Load())
+
+	if db != nil {
+		stats := db.Stats()
+		writeMetric(w, "cca_db_connections", "gauge", "Database connections by state.")
+		fmt.Fprintf(w, "cca_db_connections{state=\"in_use\"} %d\n", stats.InUse)
+		fmt.Fprintf(w, "cca_db_connections{state=\"idle\"} %d\n", stats.Idle)
+		writeMetric(w, "cca_db_connections_max", "gauge", "Maximum number of database connections.")
+		fmt.Fprintf(w, "cca_db_connections_max %d\n", stats.Max)
+		writeMetric(w, "cca_db_waits_total", "counter", "Database connection acquisitions that had to wait.")
+		fmt.Fprintf(w, "cca_db_waits_total %d\n", stats.Waits)
+		writeMetric(w, "cca_db_wait_seconds_total", "counter", "Time spent acquiring database connections.")
+		fmt.Fprintf(w, "cca_db_wait_seconds_total %s\n", formatFloat(stats.WaitTime.Seconds()))
+	}
+
+	var list []*courseT
+	courses.Range(func(_, value interface{}) bool {
+		if course, ok := value.(*courseT); ok {
+			list = append(list, course)
+		}
+		return true
+	})
+	slices.SortFunc(list, func(a, b *courseT) int {
+		return a.ID - b.ID
+	})
+	writeMetric(w, "cca_course_selected", "gauge", "Students in each course.")
+	for _, course := range list {
+		fmt.Fprintf(w, "cca_course_selected{course=\"%d\",title=%s} %d\n",
+			course.ID, labelValue(course.Title), atomic.LoadUint32(&course.Selected))
+	}
+	writeMetric(w, "cca_course_max", "gauge", "Maximum number of students in each course.")
+	for _, course := range list {
+		fmt.Fprintf(w, "cca_course_max{course=\"%d\",title=%s} %d\n",
+			course.ID, labelValue(course.Title), course.Max)
+	}
+	writeMetric(w, "cca_course_fill_ratio", "gauge", "Fraction of each course's seats taken.")
+	for _, course := range list {
+		ratio := 1.0
+		if course.Max > 0 {
+			ratio = float64(atomic.LoadUint32(&course.Selected)) / float64(course.Max)
+		}
+		fmt.Fprintf(w, "cca_course_fill_ratio{course=\"%d\",title=%s} %s\n",
+			course.ID, labelValue(course.Title), formatFloat(ratio))
+	}
+}
@@ -0,0 +1,172 @@
+/*
+ * Database schema migrations
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Migrations are SQL files named NNNN_description.sql, numbered from 1
+ * without gaps, and applied in order. Each is applied in its own transaction
+ * together with a row in schema_version recording it, so a failed migration
+ * leaves no trace. Migrations must never be edited after they are released;
+ * add a new one instead.
+ */
+
+//go:embed sql/postgres/*.sql sql/sqlite/*.sql
+var migrationsFS embed.FS
+
+type migrationT struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+/*
+ * Each backend has its own migrations in sql/<type>, as their dialects
+ * differ, so their version numbers are independent.
+ */
+func loadMigrations() ([]migrationT, error) {
+	dir := path.Join("sql", db.Type())
+	entries, err := fs.ReadDir(migrationsFS, dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		/* The memory store has no schema to speak of */
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read migrations: %w", err)
+	}
+	migrations := make([]migrationT, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		before, _, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errBadMigrationName, name)
+		}
+		version, err := strconv.Atoi(before)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errBadMigrationName, name)
+		}
+		b, err := fs.ReadFile(migrationsFS, path.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("read migration %s: %w", name, err)
+		}
+		migrations = append(migrations, migrationT{
+			Version: version,
+			Name:    name,
+			SQL:     string(b),
+		})
+	}
+	slices.SortFunc(migrations, func(a, b migrationT) int {
+		return a.Version - b.Version
+	})
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("%w: expected version %d but found %s", errBadMigrationName, i+1, m.Name)
+		}
+	}
+	return migrations, nil
+}
+
+/*
+ * Report the current and latest schema versions, failing if the database is
+ * newer than this binary knows about.
+ */
+func checkSchemaVersion(ctx context.Context) (current, latest int, retErr error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, 0, err
+	}
+	latest = len(migrations)
+
+	current, err = db.SchemaVersion(ctx)
+	if err != nil {
+		return 0, latest, err
+	}
+	if current > latest {
+		return current, latest, fmt.Errorf(
+			"%w: database is at version %d, but we only know up to %d",
+			errSchemaTooNew,
+			current,
+			latest,
+		)
+	}
+	return current, latest, nil
+}
+
+/*
+ * Apply every pending migration.
+ */
+func migrate(ctx context.Context) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		applied, err := db.ApplyMigration(ctx, m)
+		if err != nil {
+			return err
+		}
+		if applied {
+			slog.Info("applied migration", "version", m.Version, "name", m.Name)
+		}
+	}
+	return nil
+}
+
+/*
+ * This must be run during setup, after setupDatabase and before anything
+ * else touches the database.
+ */
+func setupSchema(ctx context.Context) error {
+	current, latest, err := checkSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if current == latest {
+		return nil
+	}
+	if !config().DB.AutoMigrate {
+		return fmt.Errorf(
+			"%w: database is at version %d, but we need %d; run \"cca migrate\" or set db.auto_migrate",
+			errSchemaTooOld,
+			current,
+			latest,
+		)
+	}
+	return migrate(ctx)
+}
+
+/*
+ * The "migrate" subcommand applies pending migrations and exits.
+ */
+func cmdMigrate(args []string) error {
+	if len(args) != 0 {
+		return errBadNumberOfArguments
+	}
+	err := setupDatabase()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	current, latest, err := checkSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("schema version", "current", current, "latest", latest)
+	return migrate(ctx)
+}
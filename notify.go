@@ -0,0 +1,253 @@
+/*
+ * Cross-instance events
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Several instances may share one PostgreSQL database. The database is
+ * authoritative for seat counts and states; everything held in memory is a
+ * cache that is kept up to date through notifications on notifyChannel,
+ * delivered with LISTEN/NOTIFY. SQLite databases are never shared, so the
+ * SQLite store only delivers notifications to ourselves.
+ *
+ * Each payload is of the form "<instance> <verb> [args...]", where instance
+ * is the random ID of the instance that sent it. The verbs are:
+ *
+ *    M <course> <selected> <female> <male> [<yeargroup> <selected> ...]
+ *                            the seats taken in a course changed, with
+ *                            those under each quota, if any
+ *    S <yeargroup>           the state or schedule of a year group changed
+ *    C                       the course list was replaced
+ *    L <user>                the user connected, so other connections of
+ *                            theirs must be closed
+ *
+ * Seat counts are applied regardless of which instance sent them, because the
+ * sending instance does not update its own cache; the rest are ignored when
+ * they come from ourselves, as they have already been applied locally.
+ *
+ * The store sends these itself whenever it commits a change that needs one.
+ */
+
+const notifyChannel = "cca"
+
+var instanceID string
+
+func setupInstanceID() error {
+	var err error
+	instanceID, err = randomString(4)
+	return err
+}
+
+func notificationPayload(verb string, args ...string) string {
+	payload := instanceID + " " + verb
+	if len(args) != 0 {
+		payload += " " + strings.Join(args, " ")
+	}
+	return payload
+}
+
+/*
+ * Stores whose database cannot be shared by several instances embed this to
+ * deliver notifications to ourselves, as the listener would receive them
+ * from PostgreSQL. Notifications sent while nobody is listening are dropped;
+ * that only happens during setup, which reads everything from the database
+ * afterwards anyway.
+ */
+type localNotifierT struct {
+	handleLock sync.Mutex
+	handle     func(ctx context.Context, payload string)
+}
+
+func (n *localNotifierT) deliver(ctx context.Context, payloads []string) {
+	n.handleLock.Lock()
+	handle := n.handle
+	n.handleLock.Unlock()
+	if handle == nil {
+		return
+	}
+	for _, payload := range payloads {
+		handle(ctx, payload)
+	}
+}
+
+func (n *localNotifierT) Listen(
+	ctx context.Context,
+	handle func(ctx context.Context, payload string),
+) error {
+	n.handleLock.Lock()
+	n.handle = handle
+	n.handleLock.Unlock()
+	<-ctx.Done()
+	n.handleLock.Lock()
+	n.handle = nil
+	n.handleLock.Unlock()
+	return ctx.Err()
+}
+
+func (n *localNotifierT) Notify(ctx context.Context, verb string, args ...string) error {
+	n.deliver(ctx, []string{notificationPayload(verb, args...)})
+	return nil
+}
+
+/*
+ * Listen for notifications forever. This should be run in its own goroutine
+ * after setup is complete. If the listening connection breaks, we reconnect
+ * and resynchronize everything we cache, since notifications sent while we
+ * weren't listening are lost.
+ */
+func runListener() {
+	for {
+		err := listen(context.Background())
+		slog.Error("listen", "error", err)
+		time.Sleep(time.Second)
+		err = resyncFromDatabase(context.Background())
+		if err != nil {
+			slog.Error("resync", "error", err)
+		}
+	}
+}
+
+func listen(ctx context.Context) error {
+	return db.Listen(ctx, func(ctx context.Context, payload string) {
+		defer func() {
+			if e := recover(); e != nil {
+				slog.Error("panic", "arg", e)
+			}
+		}()
+		err := handleNotification(ctx, payload)
+		if err != nil {
+			slog.Error(
+				"notification",
+				"payload", payload,
+				"error", err,
+			)
+		}
+	})
+}
+
+func handleNotification(ctx context.Context, payload string) error {
+	fields := strings.Split(payload, " ")
+	if len(fields) < 2 {
+		return errBadNotification
+	}
+	origin, verb, args := fields[0], fields[1], fields[2:]
+
+	if verb == "M" {
+		if len(args) < 4 || len(args)%2 != 0 {
+			return errBadNotification
+		}
+		courseID, err := strconv.Atoi(args[0])
+		if err != nil {
+			return wrapError(errBadNotification, err)
+		}
+		var counts [3]uint32
+		for i, arg := range args[1:4] {
+			count, err := strconv.ParseUint(arg, 10, 32)
+			if err != nil {
+				return wrapError(errBadNotification, err)
+			}
+			counts[i] = uint32(count)
+		}
+		seats := seatsT{Total: counts[0], F: counts[1], M: counts[2]} //exhaustruct:ignore
+		for i := 4; i < len(args); i += 2 {
+			count, err := strconv.ParseUint(args[i+1], 10, 32)
+			if err != nil {
+				return wrapError(errBadNotification, err)
+			}
+			if seats.Quotas == nil {
+				seats.Quotas = make(map[string]uint32)
+			}
+			seats.Quotas[args[i]] = uint32(count)
+		}
+		_course, ok := courses.Load(courseID)
+		if !ok {
+			/* The course list may have just been replaced */
+			return nil
+		}
+		course, ok := _course.(*courseT)
+		if !ok {
+			return errType
+		}
+		course.storeSeats(seats)
+		propagateSelectedUpdate(course)
+		return nil
+	}
+
+	if origin == instanceID {
+		return nil
+	}
+
+	switch verb {
+	case "S":
+		if len(args) != 1 {
+			return errBadNotification
+		}
+		return reloadStateAndSchedule(ctx, args[0])
+	case "C":
+		return reloadCourses(ctx)
+	case "L":
+		if len(args) != 1 {
+			return errBadNotification
+		}
+		cancelConnection(args[0])
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown verb %s", errBadNotification, verb)
+	}
+}
+
+/*
+ * Reload everything that other instances could have changed behind our back.
+ */
+func resyncFromDatabase(ctx context.Context) error {
+	for yeargroup := range states {
+		err := reloadStateAndSchedule(ctx, yeargroup)
+		if err != nil {
+			return err
+		}
+	}
+	return reloadCourses(ctx)
+}
+
+func reloadCourses(ctx context.Context) error {
+	err := setupCourses(ctx)
+	if err != nil {
+		return wrapError(errWhileSetttingUpCourseTablesAgain, err)
+	}
+	courses.Range(func(_, value interface{}) bool {
+		course, ok := value.(*courseT)
+		if ok {
+			propagateSelectedUpdate(course)
+		}
+		return true
+	})
+	return nil
+}
+
+/*
+ * Cancel the connection of a user on this instance, if there is one.
+ */
+func cancelConnection(userID string) {
+	_cancel, ok := cancelPool.Load(userID)
+	if !ok {
+		return
+	}
+	cancel, ok := _cancel.(*context.CancelFunc)
+	if ok && cancel != nil {
+		(*cancel)()
+	}
+}
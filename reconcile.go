@@ -0,0 +1,132 @@
+/*
+ * Reconcile selected counts with the choices table
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * The choices table is the ground truth. The selected column of courses and
+ * the counts cached in memory are derived from it and could drift if there is
+ * a bug, or if someone edits the database by hand. The reconciler recounts
+ * every course and fixes whatever disagrees.
+ */
+
+type discrepancyT struct {
+	CourseID int
+	Title    string
+	Choices  seatsT /* rows in choices */
+	Column   seatsT /* courses.selected and so on */
+	Memory   seatsT /* courseT.Selected and so on */
+}
+
+type reconcileReportT struct {
+	Time          time.Time
+	Duration      time.Duration
+	Courses       int
+	Discrepancies []discrepancyT
+	Err           error
+}
+
+var lastReconcile atomic.Pointer[reconcileReportT]
+
+/*
+ * The actor is the ID of the user who asked for reconciliation, for the audit
+ * log, or an empty string if it is run periodically.
+ */
+func reconcileCounts(ctx context.Context, actor string) (report reconcileReportT, retErr error) {
+	report.Time = time.Now()
+	defer func() {
+		report.Duration = time.Since(report.Time)
+		report.Err = retErr
+		lastReconcile.Store(&report)
+	}()
+
+	err := db.Recount(ctx, func(id int, title string, choices, column seatsT) (auditEntryT, bool) {
+		report.Courses++
+		var memory seatsT
+		_course, ok := courses.Load(id)
+		course, _ := _course.(*courseT)
+		if ok && course != nil {
+			memory = course.loadSeats()
+		}
+		if choices.equal(column) && choices.equal(memory) {
+			return auditEntryT{}, false //exhaustruct:ignore
+		}
+		d := discrepancyT{
+			CourseID: id,
+			Title:    title,
+			Choices:  choices,
+			Column:   column,
+			Memory:   memory,
+		}
+		slog.Warn(
+			"reconcile",
+			"course", d.CourseID,
+			"choices", d.Choices,
+			"column", d.Column,
+			"memory", d.Memory,
+		)
+		report.Discrepancies = append(report.Discrepancies, d)
+
+		/*
+		 * Changes to the course are held off until the store commits,
+		 * so nobody can commit a newer count before ours. The
+		 * notification tells every other instance, since their caches
+		 * may have drifted in the same way as ours; it also corrects
+		 * us again if an older notification overwrites the value we
+		 * store here.
+		 */
+		if course != nil {
+			course.storeSeats(choices)
+			propagateSelectedUpdate(course)
+		}
+		return auditEntryT{
+			Actor:    actor,
+			CourseID: id,
+			Action:   auditReconcile,
+			Outcome:  auditOK,
+			Detail: fmt.Sprintf(
+				"choices %s, column %s, memory %s",
+				d.Choices,
+				d.Column,
+				d.Memory,
+			),
+		}, true //exhaustruct:ignore
+	})
+	if err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+/*
+ * Run the reconciler periodically forever. This should be run in its own
+ * goroutine.
+ */
+func runReconciler() {
+	for {
+		time.Sleep(time.Duration(config().Perf.ReconcileInterval) * time.Second)
+		func() {
+			defer func() {
+				if e := recover(); e != nil {
+					slog.Error("panic", "arg", e)
+				}
+			}()
+			_, err := reconcileCounts(context.Background(), "")
+			if err != nil {
+				slog.Error("reconcile", "error", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ * Limits on the seats in a course
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Legal sexes as in expected_students, and how we refer to students of each
+ * when telling them a course is full for them.
+ */
+var legalSexNouns = map[string]string{"F": "female students", "M": "male students"}
+
+/*
+ * For the diagnostics page, the audit log and the like.
+ */
+func (seats seatsT) String() string {
+	if len(seats.Quotas) == 0 {
+		return fmt.Sprintf("%d (F %d, M %d)", seats.Total, seats.F, seats.M)
+	}
+	yearGroups := getKeysOfMap(seats.Quotas)
+	sortYearGroups(yearGroups)
+	quotas := make([]string, 0, len(yearGroups))
+	for _, yearGroup := range yearGroups {
+		quotas = append(quotas, fmt.Sprintf("%s %d", yearGroup, seats.Quotas[yearGroup]))
+	}
+	return fmt.Sprintf(
+		"%d (F %d, M %d; %s)",
+		seats.Total,
+		seats.F,
+		seats.M,
+		strings.Join(quotas, ", "),
+	)
+}
+
+func (seats seatsT) equal(other seatsT) bool {
+	return seats.Total == other.Total &&
+		seats.F == other.F &&
+		seats.M == other.M &&
+		maps.Equal(seats.Quotas, other.Quotas)
+}
+
+/*
+ * Whether some seats in the course are set aside by legal sex, for mixed
+ * teams and the like. Students whose legal sex is unknown cannot choose
+ * such courses.
+ */
+func (course *courseT) sexLimited() bool {
+	return course.MaxF != 0 || course.MaxM != 0
+}
+
+func (course *courseT) loadSeats() seatsT {
+	return seatsT{
+		Total:  atomic.LoadUint32(&course.Selected),
+		F:      atomic.LoadUint32(&course.SelectedF),
+		M:      atomic.LoadUint32(&course.SelectedM),
+		Quotas: quotaSeats(course.Quotas),
+	}
+}
+
+/*
+ * The seats taken under each of the given quotas, or nil if there are none.
+ */
+func quotaSeats(quotas map[string]*quotaT) map[string]uint32 {
+	if len(quotas) == 0 {
+		return nil
+	}
+	result := make(map[string]uint32, len(quotas))
+	for yearGroup, quota := range quotas {
+		result[yearGroup] = atomic.LoadUint32(&quota.Selected)
+	}
+	return result
+}
+
+/*
+ * Counts for year groups the course has no quota for are ignored.
+ */
+func (course *courseT) storeSeats(seats seatsT) {
+	atomic.StoreUint32(&course.Selected, seats.Total)
+	atomic.StoreUint32(&course.SelectedF, seats.F)
+	atomic.StoreUint32(&course.SelectedM, seats.M)
+	for yearGroup, quota := range course.Quotas {
+		atomic.StoreUint32(&quota.Selected, seats.Quotas[yearGroup])
+	}
+}
+
+/*
+ * Whether the quotas of the course, if any, no longer apply at the given
+ * time.
+ */
+func (course *courseT) quotasReleased(now time.Time) bool {
+	return !course.QuotaRelease.IsZero() && !now.Before(course.QuotaRelease)
+}
+
+/*
+ * Whether a student in the given year group may take another seat in a
+ * course with the given seats taken, as far as its quotas go, and why not if
+ * not. Until they are released, a year group with a quota may take no more
+ * seats than it, and the seats of other year groups' quotas that they have
+ * not taken yet are held for them. The SQL stores check this after taking
+ * the seat, while the course is locked, and take it back if not.
+ */
+func checkQuotas(course *courseT, seats seatsT, yearGroup string, now time.Time) error {
+	if len(course.Quotas) == 0 || course.quotasReleased(now) {
+		return nil
+	}
+	if quota, ok := course.Quotas[yearGroup]; ok && seats.Quotas[yearGroup] >= quota.Max {
+		return wrapAny(errQuotaFull, yearGroup)
+	}
+	var held uint32
+	for other, quota := range course.Quotas {
+		if other != yearGroup && seats.Quotas[other] < quota.Max {
+			held += quota.Max - seats.Quotas[other]
+		}
+	}
+	if seats.Total+held >= course.Max {
+		return errSeatsHeld
+	}
+	return nil
+}
+
+/*
+ * Whether a student of the given legal sex, which is empty if unknown, may
+ * take another seat in a course with the given seats taken, and why not if
+ * not. The SQL stores check this in the statement that takes the seat, and
+ * only use this to work out why it took none.
+ */
+func checkSeats(course *courseT, seats seatsT, legalSex string) error {
+	if seats.Total >= course.Max {
+		return errCourseFull
+	}
+	if !course.sexLimited() {
+		return nil
+	}
+	var taken, limit uint32
+	switch legalSex {
+	case "F":
+		taken, limit = seats.F, course.MaxF
+	case "M":
+		taken, limit = seats.M, course.MaxM
+	default:
+		return errLegalSexUnknown
+	}
+	if taken >= limit {
+		return wrapAny(errSexFull, legalSex)
+	}
+	return nil
+}
+
+/*
+ * For the SQL stores, check the quotas of a course in which they have just
+ * taken a seat for a student in the given year group, given its maximum, its
+ * quotas and when they are released as they were before, and the seats taken
+ * altogether afterwards. The quota of the year group, if any, is updated to
+ * count the new seat.
+ */
+func checkTakenQuota(
+	nmax uint32,
+	quotas map[string]*quotaT,
+	quotaRelease int64,
+	total uint32,
+	yearGroup string,
+) error {
+	course := courseT{
+		Max:          nmax,
+		Quotas:       quotas,
+		QuotaRelease: unixOrZero(quotaRelease),
+	} //exhaustruct:ignore
+	before := seatsT{Total: total - 1, Quotas: quotaSeats(quotas)} //exhaustruct:ignore
+	err := checkQuotas(&course, before, yearGroup, time.Now())
+	if err != nil {
+		return err
+	}
+	if quota, ok := quotas[yearGroup]; ok {
+		quota.Selected++
+	}
+	return nil
+}
+
+/*
+ * The arguments of the M notification for a course, which are its ID, the
+ * seats taken altogether, by female students and by male students, and then
+ * each year group with a quota followed by the seats taken under it.
+ */
+func seatsArgs(courseID int, seats seatsT) []string {
+	args := []string{
+		strconv.Itoa(courseID),
+		strconv.FormatUint(uint64(seats.Total), 10),
+		strconv.FormatUint(uint64(seats.F), 10),
+		strconv.FormatUint(uint64(seats.M), 10),
+	}
+	yearGroups := getKeysOfMap(seats.Quotas)
+	sortYearGroups(yearGroups)
+	for _, yearGroup := range yearGroups {
+		args = append(args, yearGroup, strconv.FormatUint(uint64(seats.Quotas[yearGroup]), 10))
+	}
+	return args
+}
@@ -10,8 +10,6 @@ package main
 import (
 	"errors"
 	"net/http"
-
-	"github.com/jackc/pgx/v5"
 )
 
 func getUserInfoFromRequest(req *http.Request) (userID,
@@ -28,18 +26,10 @@ func getUserInfoFromRequest(req *http.Request) (userID,
 		return
 	}
 
-	err = db.QueryRow(
-		req.Context(),
-		"SELECT id, name, department FROM users WHERE session = $1",
-		sessionCookie.Value,
-	).Scan(&userID, &username, &department)
+	user, err := db.GetUserBySession(req.Context(), sessionCookie.Value)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			retErr = errNoSuchUser
-			return
-		}
-		retErr = wrapError(errUnexpectedDBError, err)
+		retErr = err
 		return
 	}
-	return
+	return user.ID, user.Name, user.Department, nil
 }
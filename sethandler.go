@@ -24,6 +24,9 @@ func setHandler(pattern string, handler func(
 			}
 		}()
 
+		req = req.WithContext(
+			withAuditSource(req.Context(), "http", remoteIP(req)),
+		)
 		msg, statusCode, err := handler(w, req)
 		if err != nil {
 			if statusCode == -1 || statusCode == 0 {
@@ -0,0 +1,192 @@
+/*
+ * Graceful shutdown and listener handoff
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/*
+ * On SIGTERM or SIGINT, we stop accepting connections, finish the HTTP
+ * requests in flight, and then close every WebSocket connection with
+ * StatusServiceRestart once its current message has been handled, so that
+ * no transaction is cut short and clients know to reconnect. Whatever is
+ * left when perf.drain_timeout runs out is abandoned.
+ *
+ * On SIGUSR2, we start a new copy of ourselves that inherits the listening
+ * socket. Once it is ready, it sends us SIGTERM, and we drain as above while
+ * it accepts the connections, so a new binary can be deployed without
+ * refusing anyone.
+ *
+ * SIGHUP reloads the configuration and the TLS certificate; see
+ * config_reload.go and certificate.go.
+ */
+
+var errShuttingDown = errors.New("server shutting down")
+
+const shutdownCloseReason = "Server restarting, please reconnect"
+
+/* Canceled when WebSocket connections should close */
+var shutdownCtx, beginShutdown = context.WithCancel(context.Background())
+
+/* Set once we have started shutting down, which fails readiness */
+var draining atomic.Bool
+
+/* Every WebSocket connection being handled */
+var connWG sync.WaitGroup
+
+/*
+ * The executable we were started from, looked up at startup so that a
+ * handoff runs whatever has since been installed at the same path.
+ */
+var executablePath string
+
+func setupExecutablePath() {
+	var err error
+	executablePath, err = exec.LookPath(os.Args[0])
+	if err != nil {
+		executablePath = os.Args[0]
+	}
+}
+
+/*
+ * Handle signals until we shut down, which closes done. This should be run
+ * in its own goroutine.
+ */
+func handleSignals(srv *http.Server, raw net.Listener, done chan<- struct{}) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2, syscall.SIGHUP)
+	for sig := range ch {
+		switch sig {
+		case syscall.SIGHUP:
+			reloadConfig(context.Background(), "")
+			if config().Listen.Trans == "tls" {
+				reloadCertificate()
+			}
+		case syscall.SIGUSR2:
+			err := handoff(raw)
+			if err != nil {
+				slog.Error("handoff", "error", err)
+			}
+		default:
+			signal.Stop(ch)
+			shutdown(srv)
+			close(done)
+			return
+		}
+	}
+}
+
+func shutdown(srv *http.Server) {
+	slog.Info("shutting down")
+	draining.Store(true)
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		time.Duration(config().Perf.DrainTimeout)*time.Second,
+	)
+	defer cancel()
+
+	/* This does not wait for hijacked connections, i.e. WebSockets */
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		slog.Error("shutdown", "error", err)
+	}
+
+	beginShutdown()
+	drained := make(chan struct{})
+	go func() {
+		connWG.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		slog.Info("connections drained")
+	case <-ctx.Done():
+		slog.Warn("drain timed out")
+	}
+
+	if db != nil {
+		db.Close()
+	}
+}
+
+/*
+ * Start a new copy of ourselves with the listening socket.
+ */
+func handoff(raw net.Listener) error {
+	filer, ok := raw.(interface{ File() (*os.File, error) })
+	if !ok {
+		return errType
+	}
+	f, err := filer.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cmd := exec.Command(executablePath, os.Args[1:]...) //#nosec G204
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{f} /* which becomes file descriptor 3 */
+	cmd.Env = append(
+		os.Environ(),
+		inheritedFDEnv+"=3",
+		parentPIDEnv+"="+strconv.Itoa(os.Getpid()),
+	)
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	slog.Info("handoff", "pid", cmd.Process.Pid)
+	if ul, ok := raw.(*net.UnixListener); ok {
+		/* The socket file is the new process's now */
+		ul.SetUnlinkOnClose(false)
+	}
+	go func() {
+		err := cmd.Wait()
+		slog.Warn("handoff process exited", "pid", cmd.Process.Pid, "error", err)
+	}()
+	return nil
+}
+
+/*
+ * If we were started by handoff, tell the old process that we are ready to
+ * take over.
+ */
+func finishHandoff() {
+	pidString := os.Getenv(parentPIDEnv)
+	if pidString == "" {
+		return
+	}
+	_ = os.Unsetenv(parentPIDEnv)
+	_ = os.Unsetenv(inheritedFDEnv)
+	pid, err := strconv.Atoi(pidString)
+	if err != nil {
+		slog.Error("handoff", "error", err)
+		return
+	}
+	err = syscall.Kill(pid, syscall.SIGTERM)
+	if err != nil {
+		slog.Error("handoff", "error", err)
+		return
+	}
+	slog.Info("took over", "from", pid)
+}
@@ -1,5 +1,9 @@
 DROP TABLE choices;
+DROP TABLE quotas;
 DROP TABLE users;
 DROP TABLE courses;
 DROP TABLE misc;
 DROP TABLE states;
+DROP TABLE audit;
+DROP TABLE expected_students;
+DROP TABLE schema_version;
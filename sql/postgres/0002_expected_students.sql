@@ -0,0 +1,7 @@
+-- The old sql/schema.sql could not create this table, as its CHECK referred
+-- to a column that does not exist.
+CREATE TABLE IF NOT EXISTS expected_students (
+	id INT PRIMARY KEY NOT NULL,
+	name TEXT NOT NULL,
+	legal_sex TEXT NOT NULL CHECK (legal_sex IN ('F', 'M'))
+);
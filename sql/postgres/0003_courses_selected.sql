@@ -0,0 +1,2 @@
+ALTER TABLE courses ADD COLUMN IF NOT EXISTS selected INTEGER NOT NULL DEFAULT 0;
+UPDATE courses SET selected = (SELECT COUNT(*) FROM choices WHERE courseid = courses.id);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS audit (
+	id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+	time BIGINT NOT NULL, -- microseconds
+	actor TEXT NOT NULL, -- user ID, empty for the system itself
+	target TEXT NOT NULL, -- user ID of the affected student, if any
+	courseid INTEGER, -- not a foreign key, courses may be replaced
+	action TEXT NOT NULL,
+	source TEXT NOT NULL, -- ws, http or system
+	ip TEXT NOT NULL,
+	outcome TEXT NOT NULL, -- ok, rejected or noop
+	detail TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_actor ON audit (actor);
+CREATE INDEX IF NOT EXISTS audit_target ON audit (target);
+CREATE INDEX IF NOT EXISTS audit_courseid ON audit (courseid);
@@ -0,0 +1,3 @@
+-- The student's number, as worked out when they last logged in, or NULL for
+-- staff and anyone whose number could not be worked out.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS student_id BIGINT;
@@ -0,0 +1,5 @@
+-- The year group each expected student is in, which is authoritative when
+-- given, and the year group their sign-in token said they were in, so that
+-- the two can be compared.
+ALTER TABLE expected_students ADD COLUMN IF NOT EXISTS year_group TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS claimed_department TEXT;
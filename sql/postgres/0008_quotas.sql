@@ -0,0 +1,15 @@
+-- Optional quotas of the seats in a course for year groups, which hold the
+-- seats for them until the course's quota_release, in Unix seconds, or for
+-- good if it is 0, and the year group of the student who made each choice as
+-- it was when they made it, which the counts are made from.
+CREATE TABLE IF NOT EXISTS quotas (
+	courseid INTEGER NOT NULL,
+	FOREIGN KEY(courseid) REFERENCES courses(id),
+	yeargroup TEXT NOT NULL,
+	nmax INTEGER NOT NULL,
+	selected INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (courseid, yeargroup)
+);
+ALTER TABLE courses ADD COLUMN IF NOT EXISTS quota_release BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE choices ADD COLUMN IF NOT EXISTS year_group TEXT;
+UPDATE choices SET year_group = (SELECT department FROM users WHERE users.id = choices.userid);
@@ -0,0 +1,8 @@
+-- Optional rules on who may choose a course beyond its year groups: the
+-- student numbers of those invited, space-separated, or empty if anyone may;
+-- the name of a set of courses of which students may choose only one, or
+-- empty if none; and the space-separated course IDs of courses that must be
+-- chosen first.
+ALTER TABLE courses ADD COLUMN IF NOT EXISTS students TEXT NOT NULL DEFAULT '';
+ALTER TABLE courses ADD COLUMN IF NOT EXISTS exclusion_set TEXT NOT NULL DEFAULT '';
+ALTER TABLE courses ADD COLUMN IF NOT EXISTS requires TEXT NOT NULL DEFAULT '';
@@ -1,6 +1,10 @@
+-- The complete current PostgreSQL schema, for reference. CCASS creates and
+-- upgrades its tables itself through the migrations in sql/postgres and
+-- sql/sqlite; see the admin handbook.
 CREATE TABLE courses (
 	id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
 	nmax INTEGER NOT NULL,
+	selected INTEGER NOT NULL DEFAULT 0,
 	title TEXT NOT NULL,
 	teacher TEXT NOT NULL,
 	location TEXT NOT NULL,
@@ -8,7 +12,23 @@ CREATE TABLE courses (
 	cgroup TEXT NOT NULL,
 	course_id TEXT NOT NULL,
 	section_id TEXT NOT NULL,
-	year_groups SMALLINT NOT NULL
+	year_groups SMALLINT NOT NULL,
+	nmax_f INTEGER NOT NULL DEFAULT 0, -- both 0 if not limited by legal sex
+	nmax_m INTEGER NOT NULL DEFAULT 0,
+	selected_f INTEGER NOT NULL DEFAULT 0,
+	selected_m INTEGER NOT NULL DEFAULT 0,
+	quota_release BIGINT NOT NULL DEFAULT 0, -- seconds, 0 if quotas are never released
+	students TEXT NOT NULL DEFAULT '', -- numbers of those invited, empty if anyone may choose it
+	exclusion_set TEXT NOT NULL DEFAULT '', -- only one course in a set may be chosen
+	requires TEXT NOT NULL DEFAULT '' -- course IDs of courses that must be chosen first
+);
+CREATE TABLE quotas (
+	courseid INTEGER NOT NULL,
+	FOREIGN KEY(courseid) REFERENCES courses(id),
+	yeargroup TEXT NOT NULL,
+	nmax INTEGER NOT NULL,
+	selected INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (courseid, yeargroup)
 );
 CREATE TABLE users (
 	id TEXT PRIMARY KEY NOT NULL, -- should be UUID
@@ -17,12 +37,15 @@ CREATE TABLE users (
 	department TEXT NOT NULL,
 	session TEXT,
 	expr BIGINT, -- seconds
-	confirmed BOOLEAN NOT NULL
+	confirmed BOOLEAN NOT NULL,
+	student_id BIGINT, -- NULL for staff and anyone whose number is unknown
+	claimed_department TEXT -- as the sign-in token said, if it said
 );
 CREATE TABLE expected_students (
 	id INT PRIMARY KEY NOT NULL,
 	name TEXT NOT NULL,
-	legal_sex TEXT NOT NULL CHECK (type IN ('F', 'M')) -- ouch
+	legal_sex TEXT NOT NULL CHECK (legal_sex IN ('F', 'M')),
+	year_group TEXT -- authoritative if not NULL
 );
 CREATE TABLE choices (
 	PRIMARY KEY (userid, courseid),
@@ -31,6 +54,8 @@ CREATE TABLE choices (
 	FOREIGN KEY(userid) REFERENCES users(id),
 	courseid INTEGER NOT NULL,
 	FOREIGN KEY(courseid) REFERENCES courses(id),
+	legal_sex TEXT, -- as it was when chosen, NULL if unknown
+	year_group TEXT, -- as it was when chosen
 	UNIQUE (userid, courseid)
 );
 CREATE TABLE misc (
@@ -42,3 +67,18 @@ CREATE TABLE states (
 	state INTEGER NOT NULL,
 	schedule TIMESTAMP WITHOUT TIME ZONE NOT NULL
 );
+CREATE TABLE audit (
+	id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+	time BIGINT NOT NULL, -- microseconds
+	actor TEXT NOT NULL, -- user ID, empty for the system itself
+	target TEXT NOT NULL, -- user ID of the affected student, if any
+	courseid INTEGER, -- not a foreign key, courses may be replaced
+	action TEXT NOT NULL,
+	source TEXT NOT NULL, -- ws, http or system
+	ip TEXT NOT NULL,
+	outcome TEXT NOT NULL, -- ok, rejected or noop
+	detail TEXT NOT NULL
+);
+CREATE INDEX audit_actor ON audit (actor);
+CREATE INDEX audit_target ON audit (target);
+CREATE INDEX audit_courseid ON audit (courseid);
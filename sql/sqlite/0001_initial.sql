@@ -0,0 +1,59 @@
+-- SQLite databases start at the schema PostgreSQL reached with its first
+-- four migrations.
+CREATE TABLE courses (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	nmax INTEGER NOT NULL,
+	selected INTEGER NOT NULL DEFAULT 0,
+	title TEXT NOT NULL,
+	teacher TEXT NOT NULL,
+	location TEXT NOT NULL,
+	ctype TEXT NOT NULL,
+	cgroup TEXT NOT NULL,
+	course_id TEXT NOT NULL,
+	section_id TEXT NOT NULL,
+	year_groups INTEGER NOT NULL
+);
+CREATE TABLE users (
+	id TEXT PRIMARY KEY NOT NULL,
+	name TEXT NOT NULL,
+	email TEXT NOT NULL,
+	department TEXT NOT NULL,
+	session TEXT,
+	expr INTEGER, -- seconds
+	confirmed BOOLEAN NOT NULL
+);
+CREATE TABLE choices (
+	seltime INTEGER NOT NULL, -- microseconds
+	userid TEXT NOT NULL REFERENCES users(id),
+	courseid INTEGER NOT NULL REFERENCES courses(id),
+	PRIMARY KEY (userid, courseid)
+);
+CREATE TABLE misc (
+	key TEXT PRIMARY KEY NOT NULL,
+	value INTEGER NOT NULL
+);
+CREATE TABLE states (
+	yeargroup TEXT PRIMARY KEY NOT NULL,
+	state INTEGER NOT NULL,
+	schedule INTEGER NOT NULL -- Unix seconds
+);
+CREATE TABLE expected_students (
+	id INTEGER PRIMARY KEY NOT NULL,
+	name TEXT NOT NULL,
+	legal_sex TEXT NOT NULL CHECK (legal_sex IN ('F', 'M'))
+);
+CREATE TABLE audit (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time INTEGER NOT NULL, -- microseconds
+	actor TEXT NOT NULL,
+	target TEXT NOT NULL,
+	courseid INTEGER,
+	action TEXT NOT NULL,
+	source TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	outcome TEXT NOT NULL,
+	detail TEXT NOT NULL
+);
+CREATE INDEX audit_actor ON audit (actor);
+CREATE INDEX audit_target ON audit (target);
+CREATE INDEX audit_courseid ON audit (courseid);
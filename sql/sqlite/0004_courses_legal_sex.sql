@@ -0,0 +1,16 @@
+-- Optional limits on the seats in a course for each legal sex, which are both
+-- 0 if there are none, with the seats taken by each, and the legal sex of the student who made each choice
+-- as it was when they made it, which the counts are made from.
+ALTER TABLE courses ADD COLUMN nmax_f INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE courses ADD COLUMN nmax_m INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE courses ADD COLUMN selected_f INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE courses ADD COLUMN selected_m INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE choices ADD COLUMN legal_sex TEXT;
+UPDATE choices SET legal_sex = (
+	SELECT expected_students.legal_sex FROM users
+	JOIN expected_students ON expected_students.id = users.student_id
+	WHERE users.id = choices.userid
+);
+UPDATE courses SET
+	selected_f = (SELECT COUNT(*) FROM choices WHERE courseid = courses.id AND legal_sex = 'F'),
+	selected_m = (SELECT COUNT(*) FROM choices WHERE courseid = courses.id AND legal_sex = 'M');
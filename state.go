@@ -9,12 +9,10 @@ package main
 
 import (
 	"context"
-	"errors"
 	"log/slog"
+	"strconv"
 	"sync/atomic"
 	"time"
-
-	"github.com/jackc/pgx/v5"
 )
 
 /*
@@ -39,29 +37,9 @@ var schedules = map[string]*atomic.Pointer[time.Time]{
 
 func loadStateAndSchedule() error {
 	for yeargroup := range states {
-		var state uint32
-		var schedule time.Time
-		err := db.QueryRow(
-			context.Background(),
-			"SELECT state, schedule FROM states WHERE yeargroup = $1",
-			yeargroup,
-		).Scan(&state, &schedule)
+		state, schedule, err := db.LoadState(context.Background(), yeargroup)
 		if err != nil {
-			if errors.Is(err, pgx.ErrNoRows) {
-				state = 0
-				_, err := db.Exec(
-					context.Background(),
-					"INSERT INTO states(yeargroup, state, schedule) VALUES ($1, $2, $3)",
-					yeargroup,
-					state,
-					time.Time{},
-				)
-				if err != nil {
-					return wrapError(errUnexpectedDBError, err)
-				}
-			} else {
-				return wrapError(errUnexpectedDBError, err)
-			}
+			return err
 		}
 		_state, ok := states[yeargroup]
 		if !ok {
@@ -77,43 +55,53 @@ func loadStateAndSchedule() error {
 	return nil
 }
 
-func saveStateValue(ctx context.Context, yeargroup string, newState uint32) error {
-	_, err := db.Exec(
+func saveStateValue(ctx context.Context, actor string, yeargroup string, newState uint32) error {
+	return db.SetState(
 		ctx,
-		"UPDATE states SET state = $2 WHERE yeargroup = $1",
 		yeargroup,
 		newState,
+		auditEntryT{
+			Actor:   actor,
+			Action:  auditSetState,
+			Outcome: auditOK,
+			Detail:  yeargroup + " " + strconv.FormatUint(uint64(newState), 10),
+		}, //exhaustruct:ignore
 	)
-	if err != nil {
-		return wrapError(errUnexpectedDBError, err)
-	}
-	return nil
 }
 
-func saveScheduleValue(ctx context.Context, yeargroup string, newSchedule *time.Time) error {
-	_, err := db.Exec(
+func saveScheduleValue(ctx context.Context, actor string, yeargroup string, newSchedule *time.Time) error {
+	return db.SetSchedule(
 		ctx,
-		"UPDATE states SET schedule = $2 WHERE yeargroup = $1",
 		yeargroup,
 		*newSchedule,
+		auditEntryT{
+			Actor:   actor,
+			Action:  auditSetSchedule,
+			Outcome: auditOK,
+			Detail:  yeargroup + " " + newSchedule.Format("2006-01-02T15:04"),
+		}, //exhaustruct:ignore
 	)
-	if err != nil {
-		return wrapError(errUnexpectedDBError, err)
-	}
-	return nil
 }
 
-func setSchedule(ctx context.Context, yeargroup string, newSchedule *time.Time) error {
+/*
+ * The actor is the ID of the user making the change, for the audit log, or
+ * an empty string if the system is making the change by itself.
+ */
+func setSchedule(ctx context.Context, actor string, yeargroup string, newSchedule *time.Time) error {
 	_schedule, ok := schedules[yeargroup]
 	if !ok {
 		return errNoSuchYearGroup
 	}
+	if old := _schedule.Load(); old != nil && old.Equal(*newSchedule) {
+		return nil
+	}
 	_schedule.Store(newSchedule)
-	return saveScheduleValue(ctx, yeargroup, newSchedule)
+	return saveScheduleValue(ctx, actor, yeargroup, newSchedule)
 }
 
 func pollState() {
 	for {
+		pollStateLast.Store(time.Now().UnixNano())
 		time.Sleep(time.Second)
 		for yeargroup, _state := range states {
 			if atomic.LoadUint32(_state) == 3 {
@@ -123,7 +111,7 @@ func pollState() {
 				}
 				schedule := _schedule.Load()
 				if time.Now().After(*schedule) {
-					err := setState(context.Background(), yeargroup, 2)
+					err := openScheduled(context.Background(), yeargroup)
 					if err != nil {
 						slog.Error("schedule setting failed", "yeargroup", yeargroup)
 					}
@@ -133,32 +121,84 @@ func pollState() {
 	}
 }
 
-func setState(ctx context.Context, yeargroup string, newState uint32) error {
-	switch newState {
-	case 0:
-	case 1:
-		err := propagate(yeargroup, "STOP") /* TODO: propagate by year group */
-		if err != nil {
-			return err
-		}
-	case 2:
-		err := propagate(yeargroup, "START")
-		if err != nil {
-			return err
-		}
-	case 3:
-		// TODO XXX: Implement this!
-	default:
+/*
+ * Enable a year group whose schedule has passed. Every instance polls the
+ * schedule, but only the one that finds it still scheduled in the database
+ * writes it; the rest load whatever the database now says.
+ */
+func openScheduled(ctx context.Context, yeargroup string) error {
+	opened, err := db.OpenScheduled(
+		ctx,
+		yeargroup,
+		auditEntryT{
+			Action:  auditSetState,
+			Outcome: auditOK,
+			Detail:  yeargroup + " 2",
+		}, //exhaustruct:ignore
+	)
+	if err != nil {
+		return err
+	}
+	if !opened {
+		return reloadStateAndSchedule(ctx, yeargroup)
+	}
+	return applyState(yeargroup, 2)
+}
+
+func setState(ctx context.Context, actor string, yeargroup string, newState uint32) error {
+	if newState > 3 {
 		return errInvalidState
 	}
-	err := saveStateValue(ctx, yeargroup, newState)
+	_state, ok := states[yeargroup]
+	if !ok {
+		return errNoSuchYearGroup
+	}
+	if atomic.LoadUint32(_state) == newState {
+		return nil
+	}
+	err := saveStateValue(ctx, actor, yeargroup, newState)
 	if err != nil {
 		return err
 	}
+	return applyState(yeargroup, newState)
+}
+
+/*
+ * Update the in-memory state and tell connected students about it, if it has
+ * changed. This does not touch the database.
+ */
+func applyState(yeargroup string, newState uint32) error {
 	_state, ok := states[yeargroup]
 	if !ok {
 		return errNoSuchYearGroup
 	}
-	atomic.StoreUint32(_state, newState)
+	if atomic.SwapUint32(_state, newState) == newState {
+		return nil
+	}
+	switch newState {
+	case 1:
+		return propagate(yeargroup, "STOP")
+	case 2:
+		return propagate(yeargroup, "START")
+	case 3:
+		// TODO XXX: Implement this!
+	}
 	return nil
 }
+
+/*
+ * Re-read the state and schedule of a year group from the database, after
+ * another instance has changed it.
+ */
+func reloadStateAndSchedule(ctx context.Context, yeargroup string) error {
+	_schedule, ok := schedules[yeargroup]
+	if !ok {
+		return errNoSuchYearGroup
+	}
+	state, schedule, err := db.LoadState(ctx, yeargroup)
+	if err != nil {
+		return err
+	}
+	_schedule.Store(&schedule)
+	return applyState(yeargroup, state)
+}
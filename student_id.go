@@ -0,0 +1,235 @@
+/*
+ * Working out students' numbers
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+/*
+ * A student's number is what expected_students and the school's other
+ * systems know them by. When they log in, we take it from the claim named by
+ * auth.students.claim if there is one, or otherwise from their email address
+ * if it is in auth.students.domain and its local part matches
+ * auth.students.pattern, or otherwise from the expected student of the same
+ * name if there is exactly one. Staff have none, and neither does anyone
+ * else we cannot work one out for, rather than one made up from whatever
+ * their address happens to be.
+ *
+ * Names are not unique to students, so we only go by the name for addresses
+ * in auth.students.domain, which must be set for this, and never give a
+ * number that another user already has. Everyone logs in at once when
+ * selections open, so getUsers, which returns every user, is only called
+ * when it comes to that.
+ */
+func resolveStudentID(
+	claim any,
+	userID, email, name string,
+	expected []expectedStudentT,
+	getUsers func() ([]userT, error),
+) (int64, error) {
+	if id := studentIDFromClaim(claim); id != 0 {
+		return id, nil
+	}
+	if id := studentIDFromEmail(email); id != 0 {
+		return id, nil
+	}
+	id := studentIDFromName(email, name, expected)
+	if id == 0 {
+		return 0, nil
+	}
+	users, err := getUsers()
+	if err != nil {
+		return 0, err
+	}
+	if studentIDClaimed(id, userID, users) {
+		return 0, nil
+	}
+	return id, nil
+}
+
+/*
+ * The number of a user, working it out for those who last logged in before
+ * we stored it.
+ */
+func userStudentID(user userT, expected []expectedStudentT, users []userT) int64 {
+	if user.StudentID != 0 || user.Department == staffDepartment {
+		return user.StudentID
+	}
+	if id := studentIDFromEmail(user.Email); id != 0 {
+		return id
+	}
+	id := studentIDFromName(user.Email, user.Name, expected)
+	if id == 0 || studentIDClaimed(id, user.ID, users) {
+		return 0
+	}
+	return id
+}
+
+/*
+ * The number of a user, or 0 if unknown, and their legal sex if they are on
+ * the expected students list, or otherwise an empty string.
+ */
+func getUserStudent(ctx context.Context, userID string) (int64, string, error) {
+	user, err := db.GetUser(ctx, userID)
+	if err != nil {
+		return 0, "", err
+	}
+	expected, err := db.GetExpectedStudents(ctx)
+	if err != nil {
+		return 0, "", err
+	}
+	/* As userStudentID, without reading every user unless we must */
+	studentID := user.StudentID
+	if studentID == 0 && user.Department != staffDepartment {
+		studentID, err = resolveStudentID(
+			nil,
+			user.ID,
+			user.Email,
+			user.Name,
+			expected,
+			func() ([]userT, error) {
+				return db.GetUsers(ctx)
+			},
+		)
+		if err != nil {
+			return 0, "", err
+		}
+	}
+	if studentID == 0 {
+		return 0, "", nil
+	}
+	for _, student := range expected {
+		if student.ID == studentID {
+			return studentID, student.LegalSex, nil
+		}
+	}
+	return studentID, "", nil
+}
+
+/*
+ * Claims may be numbers or strings, which may look like the local part of
+ * an email address.
+ */
+func studentIDFromClaim(claim any) int64 {
+	switch v := claim.(type) {
+	case float64:
+		if v > 0 && v == float64(int64(v)) {
+			return int64(v)
+		}
+	case string:
+		v = strings.TrimSpace(v)
+		if id, err := strconv.ParseInt(v, 10, 64); err == nil && id > 0 {
+			return id
+		}
+		return studentIDFromPattern(v)
+	}
+	return 0
+}
+
+func studentIDFromEmail(email string) int64 {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok {
+		return 0
+	}
+	students := config().Auth.Students
+	if students.Domain != "" && !strings.EqualFold(domain, students.Domain) {
+		return 0
+	}
+	return studentIDFromPattern(local)
+}
+
+/*
+ * Whether an email address is in auth.students.domain, which is never the
+ * case if it is not set.
+ */
+func inStudentDomain(email string) bool {
+	_, domain, ok := strings.Cut(email, "@")
+	students := config().Auth.Students
+	return ok && students.Domain != "" && strings.EqualFold(domain, students.Domain)
+}
+
+func studentIDFromPattern(s string) int64 {
+	re := config().Auth.Students.PatternRegexp
+	if re == nil {
+		return 0
+	}
+	match := re.FindStringSubmatch(s)
+	if match == nil {
+		return 0
+	}
+	id, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil || id <= 0 {
+		return 0
+	}
+	return id
+}
+
+/*
+ * The number of the only expected student with the name, for addresses in
+ * auth.students.domain, or 0 if there is none.
+ */
+func studentIDFromName(email, name string, expected []expectedStudentT) int64 {
+	if strings.TrimSpace(name) == "" || !inStudentDomain(email) {
+		return 0
+	}
+	var found int64
+	for _, student := range expected {
+		if !strings.EqualFold(strings.TrimSpace(student.Name), strings.TrimSpace(name)) {
+			continue
+		}
+		if found != 0 {
+			return 0
+		}
+		found = student.ID
+	}
+	return found
+}
+
+/*
+ * Whether a user other than the one with the given ID has the number, going
+ * by what is stored or their address.
+ */
+func studentIDClaimed(id int64, userID string, users []userT) bool {
+	for _, user := range users {
+		if user.ID == userID {
+			continue
+		}
+		if user.StudentID == id || (user.StudentID == 0 &&
+			user.Department != staffDepartment &&
+			studentIDFromEmail(user.Email) == id) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * The email address of the student with the given number, from
+ * auth.students.email, for those who have never logged in, or an empty
+ * string if there is no such address.
+ */
+func studentEmail(id int64) string {
+	template := config().Auth.Students.Email
+	if template == "" || id == 0 {
+		return ""
+	}
+	return strings.Replace(template, "%d", strconv.FormatInt(id, 10), 1)
+}
+
+/*
+ * The student number as a spreadsheet cell, which is empty if there is none.
+ */
+func studentIDCell(id int64) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
@@ -0,0 +1,152 @@
+/*
+ * Tests of working out students' numbers
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+/*
+ * Use the given student domain, and the default pattern, until the test
+ * ends. Tests that call this may not run in parallel.
+ */
+func setTestStudentDomain(t *testing.T, domain string) {
+	t.Helper()
+	old := config()
+	c := *old
+	c.Auth.Students.Domain = domain
+	c.Auth.Students.PatternRegexp = regexp.MustCompile(`^[sS]([0-9]+)$`)
+	currentConfig.Store(&c)
+	t.Cleanup(func() {
+		currentConfig.Store(old)
+	})
+}
+
+func TestResolveStudentID(t *testing.T) {
+	expected := []expectedStudentT{
+		{ID: 101, Name: "Alice Chen"},
+		{ID: 102, Name: "Bob Li"},
+		{ID: 103, Name: "Bob Li"},
+		{ID: 104, Name: "Carol Wu"},
+		{ID: 105, Name: "Dan Xu"},
+	} //exhaustruct:ignore
+	users := []userT{
+		{ID: "carol", Email: "carol.wu@stu.example.org", StudentID: 104},
+		{ID: "dan", Email: "s105@stu.example.org"},
+		{ID: "alice", Email: "alice.chen@stu.example.org"},
+	} //exhaustruct:ignore
+
+	for _, tc := range []struct {
+		desc     string
+		domain   string
+		claim    any
+		userID   string
+		email    string
+		name     string
+		want     int64
+		getUsers bool /* whether every user must be read */
+	}{
+		{"claim", "stu.example.org", "s200", "x", "x@stu.example.org", "Alice Chen", 200, false},
+		{"email", "stu.example.org", nil, "x", "s201@stu.example.org", "Alice Chen", 201, false},
+		{"email in another domain", "stu.example.org", nil, "x", "s201@example.org", "", 0, false},
+		{"name", "stu.example.org", nil, "alice", "alice.chen@stu.example.org", " alice chen ", 101, true},
+		{"name in another domain", "stu.example.org", nil, "alice", "alice.chen@example.org", "Alice Chen", 0, false},
+		{"name without a student domain", "", nil, "alice", "alice.chen@stu.example.org", "Alice Chen", 0, false},
+		{"name of two students", "stu.example.org", nil, "bob", "bob.li@stu.example.org", "Bob Li", 0, false},
+		{"name of a number stored for another", "stu.example.org", nil, "mallory", "carol@stu.example.org", "Carol Wu", 0, true},
+		{"name of a number in another's address", "stu.example.org", nil, "mallory", "dan@stu.example.org", "Dan Xu", 0, true},
+		{"name of nobody", "stu.example.org", nil, "x", "x@stu.example.org", "Eve", 0, false},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			setTestStudentDomain(t, tc.domain)
+			read := false
+			got, err := resolveStudentID(
+				tc.claim,
+				tc.userID,
+				tc.email,
+				tc.name,
+				expected,
+				func() ([]userT, error) {
+					read = true
+					return users, nil
+				},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %d, want %d", got, tc.want)
+			}
+			if read != tc.getUsers {
+				t.Errorf("read every user: %t, want %t", read, tc.getUsers)
+			}
+		})
+	}
+}
+
+func TestUserStudentID(t *testing.T) {
+	setTestStudentDomain(t, "stu.example.org")
+	expected := []expectedStudentT{
+		{ID: 101, Name: "Alice Chen"},
+	} //exhaustruct:ignore
+	alice := userT{
+		ID:    "alice",
+		Name:  "Alice Chen",
+		Email: "alice.chen@stu.example.org",
+	} //exhaustruct:ignore
+	other := userT{
+		ID:    "other",
+		Name:  "Alice Chen",
+		Email: "ac@stu.example.org",
+	} //exhaustruct:ignore
+	staff := userT{
+		ID:         "staff",
+		Name:       "Alice Chen",
+		Email:      "s101@stu.example.org",
+		Department: staffDepartment,
+	} //exhaustruct:ignore
+
+	users := []userT{alice, staff}
+	if got := userStudentID(alice, expected, users); got != 101 {
+		t.Errorf("alice: got %d, want 101", got)
+	}
+	if got := userStudentID(staff, expected, users); got != 0 {
+		t.Errorf("staff: got %d, want 0", got)
+	}
+
+	/* Once alice has the number, another of the same name may not */
+	alice.StudentID = 101
+	users = []userT{alice, other}
+	if got := userStudentID(other, expected, users); got != 0 {
+		t.Errorf("other: got %d, want 0", got)
+	}
+}
+
+func TestStudentEmail(t *testing.T) {
+	old := config()
+	c := *old
+	t.Cleanup(func() {
+		currentConfig.Store(old)
+	})
+
+	c.Auth.Students.Email = "s%d@ykpaoschool.cn"
+	currentConfig.Store(&c)
+	if got := studentEmail(12345); got != "s12345@ykpaoschool.cn" {
+		t.Errorf("got %q", got)
+	}
+	if got := studentEmail(0); got != "" {
+		t.Errorf("no number: got %q", got)
+	}
+
+	c.Auth.Students.Email = ""
+	currentConfig.Store(&c)
+	if got := studentEmail(12345); got != "" {
+		t.Errorf("no template: got %q", got)
+	}
+}
@@ -0,0 +1,210 @@
+/*
+ * Tables imported from and exported to CSV files and spreadsheets
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+/*
+ * Reads one row at a time, as *csv.Reader does.
+ */
+type tableReaderT interface {
+	Read() ([]string, error)
+}
+
+type xlsxTableReaderT struct {
+	rows [][]string
+}
+
+func (r *xlsxTableReaderT) Read() ([]string, error) {
+	if len(r.rows) == 0 {
+		return nil, io.EOF
+	}
+	row := r.rows[0]
+	r.rows = r.rows[1:]
+	return row, nil
+}
+
+/*
+ * Read a table from either a CSV file or a spreadsheet, going by what it
+ * contains rather than what it claims to be. For a spreadsheet, the table
+ * is its first sheet.
+ */
+func newTableReader(r io.Reader) (tableReaderT, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, wrapError(errCannotReadCSV, err)
+	}
+	if isXLSX(data) {
+		rows, err := readXLSX(data)
+		if err != nil {
+			return nil, err
+		}
+		return &xlsxTableReaderT{rows: rows}, nil
+	}
+	/* As written by Excel, and by our own exports */
+	data = bytes.TrimPrefix(data, utf8BOM)
+	return csv.NewReader(bytes.NewReader(data)), nil
+}
+
+/*
+ * Browsers report whatever the operating system associates with the file's
+ * extension, which on Windows is often Excel's own type even for CSV files,
+ * so we accept anything with a suitable type or extension and then look at
+ * the contents.
+ */
+var uploadContentTypes = map[string]struct{}{
+	"text/csv":                 {},
+	"application/csv":          {},
+	"text/plain":               {},
+	"application/vnd.ms-excel": {},
+	xlsxContentType:            {},
+}
+
+func checkUploadType(fileHeader *multipart.FileHeader) bool {
+	switch strings.ToLower(filepath.Ext(fileHeader.Filename)) {
+	case ".csv", ".xlsx":
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(fileHeader.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	_, ok := uploadContentTypes[mediaType]
+	return ok
+}
+
+/*
+ * A table to export. Cells are typed as for xlsxSheetT, so that a
+ * spreadsheet has numbers, booleans and times where they belong.
+ */
+type tableT struct {
+	Header []string
+	Rows   [][]any
+}
+
+func (t tableT) sheet(name string) xlsxSheetT {
+	rows := make([][]any, 0, len(t.Rows)+1)
+	header := make([]any, len(t.Header))
+	for i, v := range t.Header {
+		header[i] = v
+	}
+	rows = append(rows, header)
+	rows = append(rows, t.Rows...)
+	return xlsxSheetT{Name: name, Rows: rows}
+}
+
+/*
+ * Write a table as CSV, with a byte order mark so that Excel reads it as
+ * UTF-8.
+ */
+func writeTableCSV(w io.Writer, t tableT) error {
+	_, err := w.Write(utf8BOM)
+	if err != nil {
+		return wrapError(errCSVWrite, err)
+	}
+	csvWriter := csv.NewWriter(w)
+	err = csvWriter.Write(t.Header)
+	if err != nil {
+		return wrapError(errCSVWrite, err)
+	}
+	line := make([]string, 0, len(t.Header))
+	for _, row := range t.Rows {
+		line = line[:0]
+		for _, cell := range row {
+			line = append(line, csvCell(cell))
+		}
+		err = csvWriter.Write(line)
+		if err != nil {
+			return wrapError(errCSVWrite, err)
+		}
+	}
+	csvWriter.Flush()
+	err = csvWriter.Error()
+	if err != nil {
+		return wrapError(errCSVWrite, err)
+	}
+	return nil
+}
+
+func csvCell(cell any) string {
+	switch v := cell.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.In(loc).Format("2006-01-02 15:04:05.000000")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+/*
+ * Which format the "format" query parameter asks for: "csv", the default, or
+ * "xlsx".
+ */
+func exportFormat(req *http.Request) (string, error) {
+	switch format := req.FormValue("format"); format {
+	case "", "csv":
+		return "csv", nil
+	case "xlsx":
+		return "xlsx", nil
+	default:
+		return "", wrapAny(errInvalidForm, "unknown format "+format)
+	}
+}
+
+/*
+ * Write a table as a download named after the given name, with a sheet of
+ * the same name if it is a spreadsheet.
+ */
+func writeTableDownload(w http.ResponseWriter, name, format string, t tableT) error {
+	var buf bytes.Buffer
+	var err error
+	var contentType string
+	switch format {
+	case "xlsx":
+		err = writeXLSX(&buf, []xlsxSheetT{t.sheet(name)})
+		contentType = xlsxContentType
+	default:
+		err = writeTableCSV(&buf, t)
+		contentType = "text/csv; charset=utf-8"
+	}
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set(
+		"Content-Disposition",
+		"attachment;filename=cca_"+strings.ToLower(name)+"."+format,
+	)
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		return errHTTPWrite
+	}
+	return nil
+}
@@ -24,6 +24,8 @@ func (s *usemT) init() {
 func (s *usemT) set() {
 	select {
 	case s.ch <- struct{}{}:
+		usemSets.Add(1)
 	default:
+		usemCoalesced.Add(1)
 	}
 }
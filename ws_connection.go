@@ -22,13 +22,6 @@ type errbytesT struct {
 	bytes *[]byte
 }
 
-var usemCount int64 /* atomic */
-
-/*
- * This is more appropriately typed as uint64, but it needs to be cast to int64
- * later anyway due to time.Duration, so let's just use int64.
- */
-
 /*
  * The actual logic in handling the connection, after authentication has been
  * completed.
@@ -38,7 +31,7 @@ func handleConn(
 	c *websocket.Conn,
 	userID string,
 	department string,
-) (reterr error) {
+) error {
 	_state, ok := states[department]
 	if !ok {
 		return errNoSuchYearGroup
@@ -47,7 +40,7 @@ func handleConn(
 		return errStudentAccessDisabled
 	}
 
-	send := make(chan string, config.Perf.SendQ)
+	send := make(chan string, config().Perf.SendQ)
 	chanSubPool, ok := chanPool[department]
 	if !ok {
 		return errNoSuchYearGroup
@@ -67,89 +60,37 @@ func handleConn(
 	}
 	cancelPool.Store(userID, &newCancel)
 
+	/* Close the user's connections on other instances too */
+	err := db.Notify(ctx, "L", userID)
+	if err != nil {
+		newCancel()
+		return err
+	}
+
 	defer func() {
 		cancelPool.CompareAndDelete(userID, &newCancel)
 	}()
 
 	/* TODO: Tell the user their current choices here. Deprecate HELLO. */
 
-	usems := make(map[int]*usemT)
-
-	atomic.AddInt64(&usemCount, int64(atomic.LoadUint32(&numCourses)))
-	var err error
-	courses.Range(func(key, value interface{}) bool {
-		courseID, ok := key.(int)
-		if !ok {
-			err = errType
-			return false
-		}
-		course, ok := value.(*courseT)
-		if !ok {
-			err = errType
-			return false
-		}
-		usem := &usemT{} //exhaustruct:ignore
-		usem.init()
-		course.Usems.Store(userID, usem)
-		usems[courseID] = usem
-		return true
-	})
-
-	defer func() {
-		courses.Range(func(key, value interface{}) bool {
-			_ = key
-			course, ok := value.(*courseT)
-			if !ok {
-				reterr = errType
-				return false
-			}
-			course.Usems.Delete(userID)
-			return true
-		})
-		atomic.AddInt64(&usemCount, -int64(atomic.LoadUint32(&numCourses)))
-	}()
-
-	usemParent := make(chan int)
-	for courseID, usem := range usems {
-		go func() {
-			defer func() {
-				if e := recover(); e != nil {
-					slog.Error("panic", "arg", e)
-				}
-			}()
-
-			for {
-				select {
-				case <-newCtx.Done():
-					return
-				case <-usem.ch:
-					select {
-					case <-newCtx.Done():
-						return
-					case usemParent <- courseID:
-					}
-				}
-				time.Sleep(
-					time.Duration(
-						atomic.LoadInt64(&usemCount)>>
-							config.Perf.UsemDelayShiftBits,
-					) * time.Millisecond,
-				)
-			}
-		}()
-	}
+	pending := newPendingCourses()
+	pendingPool.Store(userID, pending)
+	defer pendingPool.CompareAndDelete(userID, pending)
 
 	var userCourseGroups userCourseGroupsT = make(map[string]struct{})
-	var userCourseTypes userCourseTypesT = make(map[string]int)
-	err = populateUserCourseTypesAndGroups(
+	err = populateUserCourseGroups(
 		newCtx,
-		&userCourseTypes,
 		&userCourseGroups,
 		userID,
 	)
 	if err != nil {
 		return err
 	}
+	/* The roster is not expected to change while students choose */
+	studentID, legalSex, err := getUserStudent(newCtx, userID)
+	if err != nil {
+		return err
+	}
 
 	/*
 	 * Later we need to select from recv and send and perform the
@@ -226,6 +167,12 @@ func handleConn(
 				errWsHandlerContextCanceled,
 				newCtx.Err(),
 			)
+		case <-shutdownCtx.Done():
+			/*
+			 * Only checked between messages, so that whatever we
+			 * are in the middle of handling is finished first.
+			 */
+			return errShuttingDown
 		case sendText := <-send:
 			select {
 			case <-newCtx.Done():
@@ -240,7 +187,7 @@ func handleConn(
 			if err != nil {
 				return err
 			}
-		case courseID := <-usemParent:
+		case <-pending.usem.ch:
 			select {
 			case <-newCtx.Done():
 				return wrapError(
@@ -250,7 +197,7 @@ func handleConn(
 			default:
 			}
 
-			err := sendSelectedUpdate(newCtx, c, courseID)
+			err := sendSelectedUpdates(newCtx, c, pending.take())
 			if err != nil {
 				return wrapError(
 					errCannotSend,
@@ -288,6 +235,7 @@ func handleConn(
 				 */
 			}
 			mar = splitMsg(errbytes.bytes)
+			began := time.Now()
 			switch mar[0] {
 			case "HELLO":
 				err := messageHello(
@@ -307,8 +255,9 @@ func handleConn(
 					mar,
 					userID,
 					department,
+					studentID,
+					legalSex,
 					&userCourseGroups,
-					&userCourseTypes,
 				)
 				if err != nil {
 					return err
@@ -321,7 +270,6 @@ func handleConn(
 					userID,
 					department,
 					&userCourseGroups,
-					&userCourseTypes,
 				)
 				if err != nil {
 					return err
@@ -333,7 +281,7 @@ func handleConn(
 					mar,
 					userID,
 					department,
-					&userCourseTypes,
+					studentID,
 				)
 				if err != nil {
 					return err
@@ -352,6 +300,7 @@ func handleConn(
 			default:
 				return wrapAny(errUnknownCommand, mar[0])
 			}
+			observeCommand(mar[0], time.Since(began))
 		}
 	}
 }
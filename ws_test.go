@@ -0,0 +1,535 @@
+/*
+ * End-to-end tests of the cca1 protocol
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOverfillRace(t *testing.T) {
+	const nmax = 5
+	const students = 40
+
+	ids := setTestCourses(t, testCourseT{Title: "Chess", Max: nmax, Type: nonSport, Group: mw1})
+	id := strconv.Itoa(ids["Chess"])
+	setTestState(t, "Y11", 2)
+
+	clients := make([]*testClientT, 0, students)
+	for range students {
+		_, session := loginTestUser(t, "Y11")
+		client := dialTestClient(t, session)
+		client.hello("START", "NC", "")
+		clients = append(clients, client)
+	}
+
+	ctx := testContext(t)
+	replies := make(chan string, students)
+	errs := make(chan error, students)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for _, client := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			reply, err := client.roundTrip(ctx, "Y "+id)
+			if err != nil {
+				errs <- err
+				return
+			}
+			replies <- reply
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(replies)
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+	accepted := 0
+	for reply := range replies {
+		switch reply {
+		case "Y " + id:
+			accepted++
+		case "R " + id + " :Full":
+		default:
+			t.Errorf("unexpected reply %q", reply)
+		}
+	}
+	if accepted != nmax {
+		t.Errorf("%d students got the course, want %d", accepted, nmax)
+	}
+
+	list, err := db.GetCourses(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list[0].Selected != nmax {
+		t.Errorf("selected is %d, want %d", list[0].Selected, nmax)
+	}
+	/* The last count delivered must be that of the last commit */
+	_course, _ := courses.Load(ids["Chess"])
+	if seats := _course.(*courseT).loadSeats(); seats.Total != nmax {
+		t.Errorf("cached selected is %d, want %d", seats.Total, nmax)
+	}
+	choices, err := db.GetChoices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(choices) != nmax {
+		t.Errorf("%d choices recorded, want %d", len(choices), nmax)
+	}
+}
+
+func TestGroupConflict(t *testing.T) {
+	ids := setTestCourses(t,
+		testCourseT{Title: "Chess", Max: 10, Type: nonSport, Group: mw1},
+		testCourseT{Title: "Drama", Max: 10, Type: nonSport, Group: mw1},
+		testCourseT{Title: "Tennis", Max: 10, Type: sport, Group: tt1},
+	)
+	chess := strconv.Itoa(ids["Chess"])
+	drama := strconv.Itoa(ids["Drama"])
+	tennis := strconv.Itoa(ids["Tennis"])
+	setTestState(t, "Y10", 2)
+
+	_, session := loginTestUser(t, "Y10")
+	client := dialTestClient(t, session)
+	client.hello("START", "NC", "")
+
+	client.send("Y " + chess)
+	client.expect("Y " + chess)
+	client.send("Y " + drama)
+	client.expect("R " + drama + " :Group conflict")
+	client.send("Y " + tennis)
+	client.expect("Y " + tennis)
+
+	client.send("N " + chess)
+	client.expect("N " + chess)
+	client.send("Y " + drama)
+	client.expect("Y " + drama)
+
+	/* A new connection sees the same choices and groups */
+	client = dialTestClient(t, session)
+	client.hello("START", "NC", strings.Join(sortedIDs(drama, tennis), ","))
+	client.send("Y " + chess)
+	client.expect("R " + chess + " :Group conflict")
+}
+
+func sortedIDs(a, b string) []string {
+	x, _ := strconv.Atoi(a)
+	y, _ := strconv.Atoi(b)
+	if x > y {
+		return []string{b, a}
+	}
+	return []string{a, b}
+}
+
+func TestLegalSexLimits(t *testing.T) {
+	ids := setTestCourses(t, testCourseT{
+		Title: "Mixed Doubles",
+		Max:   4,
+		MaxF:  1,
+		MaxM:  2,
+		Type:  sport,
+		Group: tt1,
+	})
+	id := strconv.Itoa(ids["Mixed Doubles"])
+	setTestState(t, "Y11", 2)
+
+	f1, f1Session := loginTestUser(t, "Y11")
+	f2, f2Session := loginTestUser(t, "Y11")
+	m1, m1Session := loginTestUser(t, "Y11")
+	_, unknownSession := loginTestUser(t, "Y11")
+	setTestLegalSexes(t, map[string]string{f1: "F", f2: "F", m1: "M"})
+
+	clients := make(map[string]*testClientT)
+	for name, session := range map[string]string{
+		"f1":      f1Session,
+		"f2":      f2Session,
+		"m1":      m1Session,
+		"unknown": unknownSession,
+	} {
+		clients[name] = dialTestClient(t, session)
+		clients[name].hello("START", "NC", "")
+	}
+
+	clients["f1"].send("Y " + id)
+	clients["f1"].expect("Y " + id)
+	/* The course has seats left, but none for female students */
+	clients["f2"].send("Y " + id)
+	clients["f2"].expect("R " + id + " :Full for female students")
+	clients["unknown"].send("Y " + id)
+	clients["unknown"].expect("R " + id + " :Seats are set aside by legal sex, but yours is not on record")
+	clients["m1"].send("Y " + id)
+	clients["m1"].expect("Y " + id)
+	checkTestSeats(t, ids["Mixed Doubles"], 2, 1, 1)
+
+	clients["f1"].send("N " + id)
+	clients["f1"].expect("N " + id)
+	checkTestSeats(t, ids["Mixed Doubles"], 1, 0, 1)
+	clients["f2"].waitSeats("Q " + id + " 0 1")
+	clients["f2"].send("Y " + id)
+	clients["f2"].expect("Y " + id)
+	checkTestSeats(t, ids["Mixed Doubles"], 2, 1, 1)
+}
+
+/*
+ * Check the seats taken in a course in the database.
+ */
+func checkTestSeats(t *testing.T, id int, total, f, m uint32) {
+	t.Helper()
+	list, err := db.GetCourses(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, course := range list {
+		if course.ID != id {
+			continue
+		}
+		if course.Selected != total || course.SelectedF != f || course.SelectedM != m {
+			t.Fatalf(
+				"seats are %d (F %d, M %d), want %d (F %d, M %d)",
+				course.Selected, course.SelectedF, course.SelectedM,
+				total, f, m,
+			)
+		}
+		return
+	}
+	t.Fatalf("no course %d", id)
+}
+
+func TestQuotas(t *testing.T) {
+	release := time.Now().Add(2 * time.Second)
+	ids := setTestCourses(t, testCourseT{
+		Title:        "Orchestra",
+		Max:          4,
+		Type:         nonSport,
+		Group:        mw1,
+		Quotas:       map[string]uint32{"Y9": 1, "Y10": 1},
+		QuotaRelease: release,
+	})
+	id := strconv.Itoa(ids["Orchestra"])
+	for _, yearGroup := range []string{"Y9", "Y11"} {
+		setTestState(t, yearGroup, 2)
+	}
+
+	clients := make([]*testClientT, 0, 5)
+	for _, yearGroup := range []string{"Y9", "Y9", "Y11", "Y11", "Y11"} {
+		_, session := loginTestUser(t, yearGroup)
+		client := dialTestClient(t, session)
+		client.hello("START", "NC", "")
+		clients = append(clients, client)
+	}
+
+	clients[0].send("Y " + id)
+	clients[0].expect("Y " + id)
+	clients[1].send("Y " + id)
+	clients[1].expect("R " + id + " :Full for Y9")
+	clients[2].send("Y " + id)
+	clients[2].expect("Y " + id)
+	clients[3].send("Y " + id)
+	clients[3].expect("Y " + id)
+	/* One seat is left, but it is Year 10's */
+	clients[4].send("Y " + id)
+	clients[4].expect(
+		"R " + id + " :The seats left are held for other year groups until " +
+			release.In(loc).Format("2006-01-02 15:04"),
+	)
+	clients[4].waitSeats("P " + id + " Y9 1 " + id + " Y10 0")
+
+	/* Once released, Year 9 may take more than its quota */
+	time.Sleep(time.Until(release))
+	clients[1].send("Y " + id)
+	clients[1].expect("Y " + id)
+	clients[4].send("Y " + id)
+	clients[4].expect("R " + id + " :Full")
+	clients[0].waitSeats("M " + id + " 4")
+	clients[0].waitSeats("P " + id + " Y9 2 " + id + " Y10 0")
+}
+
+/*
+ * The seats taken under quotas that the reconciler fixes are sent to
+ * students as they are in the database.
+ */
+func TestReconcileQuotas(t *testing.T) {
+	ids := setTestCourses(t, testCourseT{
+		Title:  "Orchestra",
+		Max:    5,
+		Type:   nonSport,
+		Group:  mw1,
+		Quotas: map[string]uint32{"Y9": 2, "Y10": 1},
+	})
+	id := strconv.Itoa(ids["Orchestra"])
+	setTestState(t, "Y9", 2)
+
+	_, session := loginTestUser(t, "Y9")
+	client := dialTestClient(t, session)
+	client.hello("START", "NC", "")
+	client.send("Y " + id)
+	client.expect("Y " + id)
+	client.waitSeats("P " + id + " Y9 1 " + id + " Y10 0")
+
+	_course, _ := courses.Load(ids["Orchestra"])
+	course := _course.(*courseT)
+	course.storeSeats(seatsT{
+		Total:  3,
+		Quotas: map[string]uint32{"Y9": 2, "Y10": 1},
+	}) //exhaustruct:ignore
+	propagateSelectedUpdate(course)
+	client.waitSeats("P " + id + " Y9 2 " + id + " Y10 1")
+
+	report, err := reconcileCounts(testContext(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Discrepancies) != 1 {
+		t.Fatalf("%d discrepancies, want 1", len(report.Discrepancies))
+	}
+	list, err := db.GetCourses(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "P"
+	for _, yearGroup := range list[0].QuotaYearGroups() {
+		want += fmt.Sprintf(" %s %s %d", id, yearGroup, list[0].Quotas[yearGroup].Selected)
+	}
+	if want != "P "+id+" Y9 1 "+id+" Y10 0" {
+		t.Fatalf("database has %q", want)
+	}
+	client.waitSeats("M " + id + " 1")
+	client.waitSeats(want)
+}
+
+func TestEligibility(t *testing.T) {
+	ids := setTestCourses(t,
+		testCourseT{
+			Title: "MUN Monday", Max: 10, Type: nonSport, Group: mw1,
+			CourseID: "MUN", ExclusionSet: "MUN",
+		},
+		testCourseT{
+			Title: "MUN Tuesday", Max: 10, Type: nonSport, Group: tt1,
+			CourseID: "MUN", ExclusionSet: "MUN",
+		},
+		testCourseT{
+			Title: "Crisis", Max: 10, Type: nonSport, Group: mw2,
+			CourseID: "CRISIS", Requires: []string{"MUN"},
+		},
+		testCourseT{Title: "Tennis", Max: 10, Type: sport, Group: tt2},
+	)
+	monday := strconv.Itoa(ids["MUN Monday"])
+	tuesday := strconv.Itoa(ids["MUN Tuesday"])
+	crisis := strconv.Itoa(ids["Crisis"])
+	tennis := strconv.Itoa(ids["Tennis"])
+	setTestState(t, "Y12", 2)
+
+	userID, session := loginTestUser(t, "Y12")
+	client := dialTestClient(t, session)
+	client.hello("START", "NC", "")
+
+	client.send("Y " + crisis)
+	client.expect("R " + crisis + " :Choose MUN Monday first")
+	client.send("Y " + monday)
+	client.expect("Y " + monday)
+	client.send("Y " + tuesday)
+	client.expect("R " + tuesday + " :Cannot be taken with MUN Monday")
+	client.send("Y " + crisis)
+	client.expect("Y " + crisis)
+	client.send("N " + monday)
+	client.expect("RN " + monday + " :Crisis requires this")
+	client.send("Y " + tennis)
+	client.expect("Y " + tennis)
+
+	/*
+	 * Choices made from another connection at the same time are checked
+	 * without each other, which we stand in for by going around the
+	 * connection, and are caught when confirming.
+	 */
+	ctx := testContext(t)
+	if _, _, err := db.Choose(ctx, userID, ids["MUN Tuesday"], "", "Y12"); err != nil {
+		t.Fatal(err)
+	}
+	client.send("YC")
+	client.expect("RC :Cannot confirm choices: MUN Monday: Cannot be taken with MUN Tuesday")
+	if _, _, err := db.Unchoose(ctx, userID, ids["MUN Tuesday"]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.Unchoose(ctx, userID, ids["MUN Monday"]); err != nil {
+		t.Fatal(err)
+	}
+	client.send("YC")
+	client.expect("RC :Cannot confirm choices: Crisis: Choose MUN Monday first")
+
+	client = dialTestClient(t, session)
+	client.hello("START", "NC", strings.Join(sortedIDs(crisis, tennis), ","))
+	client.send("Y " + tuesday)
+	client.expect("Y " + tuesday)
+	client.send("YC")
+	client.expect("YC")
+}
+
+func TestMaximums(t *testing.T) {
+	ids := setTestCourses(t,
+		testCourseT{Title: "Tennis", Max: 10, Type: sport, Group: mw1},
+		testCourseT{Title: "Swimming", Max: 10, Type: sport, Group: tt1},
+		testCourseT{Title: "Chess", Max: 10, Type: nonSport, Group: mw2},
+		testCourseT{Title: "Drama", Max: 10, Type: nonSport, Group: tt2},
+		testCourseT{Title: "Art", Max: 10, Type: nonSport, Group: mw3},
+	)
+	tennis := strconv.Itoa(ids["Tennis"])
+	swimming := strconv.Itoa(ids["Swimming"])
+	chess := strconv.Itoa(ids["Chess"])
+	drama := strconv.Itoa(ids["Drama"])
+	art := strconv.Itoa(ids["Art"])
+	setTestReq(t, "Y10", reqT{
+		Sport:       1,
+		NonSport:    1,
+		MaxSport:    1,
+		MaxNonSport: 2,
+		MaxTotal:    2,
+	})
+	setTestState(t, "Y10", 2)
+
+	userID, session := loginTestUser(t, "Y10")
+	client := dialTestClient(t, session)
+	client.hello("START", "NC", "")
+
+	client.send("Y " + tennis)
+	client.expect("Y " + tennis)
+	client.send("Y " + swimming)
+	client.expect("R " + swimming + " :You may choose at most 1 of type Sport")
+	client.send("Y " + chess)
+	client.expect("Y " + chess)
+	client.send("Y " + drama)
+	client.expect("R " + drama + " :You may choose at most 2 courses")
+
+	/*
+	 * Choices made from another connection, which we stand in for by
+	 * going around this one, count as soon as they are made, and those
+	 * made at the same time are caught when confirming.
+	 */
+	ctx := testContext(t)
+	if _, _, err := db.Choose(ctx, userID, ids["Drama"], "", "Y10"); err != nil {
+		t.Fatal(err)
+	}
+	client.send("Y " + art)
+	client.expect("R " + art + " :You may choose at most 2 of type Non-sport")
+	client.send("YC")
+	client.expect("RC :Cannot confirm choices: You chose 3 out of at most 2 courses")
+
+	if _, _, err := db.Unchoose(ctx, userID, ids["Drama"]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.Choose(ctx, userID, ids["Swimming"], "", "Y10"); err != nil {
+		t.Fatal(err)
+	}
+	client.send("YC")
+	client.expect("RC :Cannot confirm choices: You chose 2 out of at most 1 of type Sport")
+
+	if _, _, err := db.Unchoose(ctx, userID, ids["Swimming"]); err != nil {
+		t.Fatal(err)
+	}
+	client.send("YC")
+	client.expect("YC")
+}
+
+func TestConfirm(t *testing.T) {
+	ids := setTestCourses(t,
+		testCourseT{Title: "Chess", Max: 10, Type: nonSport, Group: mw1},
+		testCourseT{Title: "Tennis", Max: 10, Type: sport, Group: tt1},
+	)
+	chess := strconv.Itoa(ids["Chess"])
+	tennis := strconv.Itoa(ids["Tennis"])
+	setTestState(t, "Y9", 2)
+
+	userID, session := loginTestUser(t, "Y9")
+	client := dialTestClient(t, session)
+	client.hello("START", "NC", "")
+
+	client.send("Y " + tennis)
+	client.expect("Y " + tennis)
+	client.send("YC")
+	if reply := client.next(); !strings.HasPrefix(reply, "RC :") {
+		t.Fatalf("got %q, want a rejection", reply)
+	}
+
+	client.send("Y " + chess)
+	client.expect("Y " + chess)
+	client.send("YC")
+	client.expect("YC")
+
+	confirmed, err := getConfirmedStatus(testContext(t), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !confirmed {
+		t.Fatal("user is not confirmed in the database")
+	}
+
+	client = dialTestClient(t, session)
+	client.hello("START", "YC", strings.Join(sortedIDs(chess, tennis), ","))
+	client.send("NC")
+	client.expect("NC")
+
+	/* Confirming is only possible while selections are open */
+	setTestState(t, "Y9", 1)
+	client.expect("STOP")
+	client.send("YC")
+	client.expect("E :Course selections are not open")
+}
+
+func TestStateTransitions(t *testing.T) {
+	ids := setTestCourses(t, testCourseT{Title: "Chess", Max: 10, Type: nonSport, Group: mw1})
+	chess := strconv.Itoa(ids["Chess"])
+	setTestState(t, "Y12", 1)
+
+	_, session := loginTestUser(t, "Y12")
+	client := dialTestClient(t, session)
+	client.hello("STOP", "NC", "")
+	client.send("Y " + chess)
+	client.expect("E :Course selections are not open")
+
+	setTestState(t, "Y12", 2)
+	client.expect("START")
+	client.send("Y " + chess)
+	client.expect("Y " + chess)
+
+	setTestState(t, "Y12", 1)
+	client.expect("STOP")
+
+	/* A scheduled year group opens once the schedule passes */
+	schedule := time.Now().Add(time.Second)
+	if err := setSchedule(testContext(t), "", "Y12", &schedule); err != nil {
+		t.Fatal(err)
+	}
+	setTestState(t, "Y12", 3)
+	client.expect("START")
+
+	/* Another instance reaching the schedule finds it already open */
+	opened, err := db.OpenScheduled(testContext(t), "Y12", auditEntryT{}) //exhaustruct:ignore
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened {
+		t.Error("opened a year group that was already open")
+	}
+
+	/* Disabling access ends the connection on its next message */
+	setTestState(t, "Y12", 0)
+	client.send("HELLO")
+	client.expect("E :" + errStudentAccessDisabled.Error())
+
+	client = dialTestClient(t, session)
+	client.expect("E :" + errStudentAccessDisabled.Error())
+}
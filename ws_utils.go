@@ -9,7 +9,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log/slog"
 	"sync/atomic"
 
@@ -46,8 +45,8 @@ import (
  * line to be treated as a single argument.
  */
 func splitMsg(b *[]byte) []string {
-	mar := make([]string, 0, config.Perf.MessageArgumentsCap)
-	elem := make([]byte, 0, config.Perf.MessageBytesCap)
+	mar := make([]string, 0, config().Perf.MessageArgumentsCap)
+	elem := make([]byte, 0, config().Perf.MessageBytesCap)
 	for i, c := range *b {
 		switch c {
 		case ' ':
@@ -57,7 +56,7 @@ func splitMsg(b *[]byte) []string {
 				goto endl
 			}
 			mar = append(mar, string(elem))
-			elem = make([]byte, 0, config.Perf.MessageBytesCap)
+			elem = make([]byte, 0, config().Perf.MessageBytesCap)
 		default:
 			elem = append(elem, c)
 		}
@@ -67,45 +66,19 @@ endl:
 	return mar
 }
 
+/*
+ * Mark the course as dirty so that the broadcaster includes its count in the
+ * next batch sent to every connection.
+ */
 func propagateSelectedUpdate(course *courseT) {
-	course.Usems.Range(func(key, value interface{}) bool {
-		_ = key
-		usem, ok := value.(*usemT)
-		if !ok {
-			slog.Error(errType.Error())
-			return false
-		}
-		usem.set()
-		return true
-	})
+	markCourseDirty(course.ID)
 }
 
-func sendSelectedUpdate(
-	ctx context.Context,
-	conn *websocket.Conn,
-	courseID int,
-) error {
-	_course, ok := courses.Load(courseID)
-	if !ok {
-		return fmt.Errorf("%w: %d", errNoSuchCourse, courseID)
-	}
-	course, ok := _course.(*courseT)
-	if !ok {
-		return errType
-	}
-	if course == nil {
-		return fmt.Errorf("%w: %d", errNoSuchCourse, courseID)
-	}
-	selected := atomic.LoadUint32(&course.Selected)
-	err := writeText(ctx, conn, fmt.Sprintf("M %d %d", courseID, selected))
-	if err != nil {
-		return fmt.Errorf(
-			"error sending to websocket for course selected update: %w",
-			err,
-		)
-	}
-	return nil
-}
+/*
+ * The number of messages propagate could not queue because the send queue of
+ * the connection was full, since startup.
+ */
+var sendqDropped atomic.Uint64
 
 func propagate(yeargroup string, msg string) error {
 	chanSubPool, ok := chanPool[yeargroup]
@@ -122,6 +95,7 @@ func propagate(yeargroup string, msg string) error {
 		select {
 		case *ch <- msg:
 		default:
+			sendqDropped.Add(1)
 			userID, ok := _userID.(string)
 			if !ok {
 				err = errType
@@ -9,15 +9,10 @@ package main
 
 import (
 	"context"
-	"errors"
-	"log/slog"
 	"strconv"
 	"sync/atomic"
-	"time"
 
 	"github.com/coder/websocket"
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgconn"
 )
 
 func messageChooseCourse(
@@ -26,15 +21,21 @@ func messageChooseCourse(
 	mar []string,
 	userID string,
 	yeargroup string,
+	studentID int64,
+	legalSex string,
 	userCourseGroups *userCourseGroupsT,
-	userCourseTypes *userCourseTypesT,
 ) error {
 	_state, ok := states[yeargroup]
 	if !ok {
 		return errNoSuchYearGroup
 	}
 	if atomic.LoadUint32(_state) != 2 {
-		err := writeText(ctx, c, "E :Course selections are not open")
+		countRejection(rejectNotOpen)
+		err := auditSelf(ctx, userID, auditChoose, 0, auditRejected, "Course selections are not open")
+		if err != nil {
+			return err
+		}
+		err = writeText(ctx, c, "E :Course selections are not open")
 		if err != nil {
 			return wrapError(
 				errCannotSend,
@@ -74,11 +75,21 @@ func messageChooseCourse(
 		return errNoSuchCourse
 	}
 	if course.YearGroups&yearGroupsNumberBits[yeargroup] == 0 {
+		countRejection(rejectYearGroup)
+		err := auditSelf(ctx, userID, auditChoose, courseID, auditRejected, "Not for your year group")
+		if err != nil {
+			return err
+		}
 		return errNotForYourYearGroup
 	}
 
 	if _, ok := (*userCourseGroups)[course.Group]; ok {
-		err := writeText(ctx, c, "R "+mar[1]+" :Group conflict")
+		countRejection(rejectGroupConflict)
+		err := auditSelf(ctx, userID, auditChoose, courseID, auditRejected, "Group conflict")
+		if err != nil {
+			return err
+		}
+		err = writeText(ctx, c, "R "+mar[1]+" :Group conflict")
 		if err != nil {
 			return wrapError(
 				errCannotSend,
@@ -88,123 +99,157 @@ func messageChooseCourse(
 		return nil
 	}
 
-	err = func() (returnedError error) {
-		tx, err := db.Begin(ctx)
+	req, err := getYearGroupReq(yeargroup)
+	if err != nil {
+		return wrapError(errInvalidYearGroupOrCourseType, err)
+	}
+
+	/*
+	 * What the user has chosen is read afresh where it matters, as they
+	 * may have chosen more from another connection since this one read
+	 * it. Choices made at the same time are caught when confirming.
+	 */
+	var chosen []*courseT
+	if course.dependsOnChoices() || req.hasMaximums() {
+		chosen, err = getUserChosenCourses(ctx, userID)
 		if err != nil {
-			return wrapError(errUnexpectedDBError, err)
+			return err
 		}
-		defer func() {
-			err := tx.Rollback(ctx)
-			if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
-				returnedError = wrapError(errUnexpectedDBError, err)
-				return
-			}
-		}()
+	}
 
-		_, err = tx.Exec(
-			ctx,
-			"INSERT INTO choices (seltime, userid, courseid) VALUES ($1, $2, $3)",
-			time.Now().UnixMicro(),
-			userID,
-			courseID,
-		)
+	rejection, reason, err := checkMaximums(yeargroup, course.Type, countCourseTypes(chosen))
+	if err != nil {
+		return wrapError(errInvalidYearGroupOrCourseType, err)
+	}
+	if reason != "" {
+		countRejection(rejection)
+		err := auditSelf(ctx, userID, auditChoose, courseID, auditRejected, reason)
 		if err != nil {
-			var pgErr *pgconn.PgError
-			if errors.As(err, &pgErr) &&
-				pgErr.Code == pgErrUniqueViolation {
-				err2 := writeText(ctx, c, "Y "+mar[1])
-				if err2 != nil {
-					return wrapError(
-						err2,
-						wrapError(errUnexpectedDBError, err),
-					)
-				}
-				return nil
-			}
-			return wrapError(errUnexpectedDBError, err)
-		}
-
-		ok := func() bool {
-			course.SelectedLock.Lock()
-			defer course.SelectedLock.Unlock()
-			/*
-			 * The read here doesn't have to be atomic because the
-			 * lock guarantees that no other goroutine is writing to
-			 * it.
-			 */
-			if course.Selected < course.Max {
-				atomic.AddUint32(&course.Selected, 1)
-				/*
-				 * This write must be atomic because there
-				 * could be other atomic readers.
-				 */
-				return true
-			}
-			return false
-		}()
-
-		if ok {
-			go func() {
-				defer func() {
-					if e := recover(); e != nil {
-						slog.Error("panic", "arg", e)
-					}
-				}()
-				propagateSelectedUpdate(course)
-			}()
-			err := tx.Commit(ctx)
-			if err != nil {
-				err := course.decrementSelectedAndPropagate(ctx, c)
-				if err != nil {
-					return wrapError(
-						errCannotSend,
-						err,
-					)
-				}
-				return wrapError(errUnexpectedDBError, err)
-			}
-
-			/*
-			 * This would race if message handlers could run
-			 * concurrently for one connection.
-			 */
-			(*userCourseGroups)[course.Group] = struct{}{}
-			(*userCourseTypes)[course.Type]++
-
-			err = writeText(ctx, c, "Y "+mar[1])
-			if err != nil {
-				return wrapError(
-					errCannotSend,
-					err,
-				)
-			}
-
-			if config.Perf.PropagateImmediate {
-				err = sendSelectedUpdate(ctx, c, courseID)
-				if err != nil {
-					return wrapError(
-						errCannotSend,
-						err,
-					)
-				}
-			}
-		} else {
-			err := tx.Rollback(ctx)
-			if err != nil {
-				return wrapError(errUnexpectedDBError, err)
-			}
-			err = writeText(ctx, c, "R "+mar[1]+" :Full")
-			if err != nil {
-				return wrapError(
-					errCannotSend,
-					err,
-				)
-			}
+			return err
+		}
+		err = writeText(ctx, c, "R "+mar[1]+" :"+reason)
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
 		}
 		return nil
-	}()
+	}
+
+	if rejection, reason := checkEligibility(course, studentID, chosen); reason != "" {
+		countRejection(rejection)
+		err := auditSelf(ctx, userID, auditChoose, courseID, auditRejected, reason)
+		if err != nil {
+			return err
+		}
+		err = writeText(ctx, c, "R "+mar[1]+" :"+reason)
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	}
+
+	result, seats, err := db.Choose(ctx, userID, courseID, legalSex, yeargroup)
 	if err != nil {
 		return err
 	}
+	switch result {
+	case chooseFull:
+		countRejection(rejectFull)
+		err = writeText(ctx, c, "R "+mar[1]+" :Full")
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	case chooseSexFull:
+		countRejection(rejectSexFull)
+		err = writeText(ctx, c, "R "+mar[1]+" :Full for "+legalSexNouns[legalSex])
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	case chooseSexUnknown:
+		countRejection(rejectSexUnknown)
+		err = writeText(ctx, c, "R "+mar[1]+" :Seats are set aside by legal sex, but yours is not on record")
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	case chooseQuotaFull:
+		countRejection(rejectQuotaFull)
+		err = writeText(ctx, c, "R "+mar[1]+" :Full for "+yeargroup)
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	case chooseSeatsHeld:
+		countRejection(rejectSeatsHeld)
+		reason := "The seats left are held for other year groups"
+		if !course.QuotaRelease.IsZero() {
+			reason += " until " + course.QuotaRelease.In(loc).Format("2006-01-02 15:04")
+		}
+		err = writeText(ctx, c, "R "+mar[1]+" :"+reason)
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	case chooseAlready:
+		err = writeText(ctx, c, "Y "+mar[1])
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	case chooseOK:
+	}
+
+	/*
+	 * This would race if message handlers could run concurrently for one
+	 * connection.
+	 */
+	(*userCourseGroups)[course.Group] = struct{}{}
+
+	err = writeText(ctx, c, "Y "+mar[1])
+	if err != nil {
+		return wrapError(
+			errCannotSend,
+			err,
+		)
+	}
+
+	if config().Perf.PropagateImmediate {
+		/*
+		 * The cached count is only updated once the notification
+		 * arrives, so send the count we just got instead.
+		 */
+		err = writeSeats(ctx, c, []*courseT{course}, []seatsT{seats})
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+	}
 	return nil
 }
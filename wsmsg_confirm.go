@@ -21,7 +21,7 @@ func messageConfirm(
 	mar []string,
 	userID string,
 	department string,
-	userCourseTypes *userCourseTypesT,
+	studentID int64,
 ) error {
 	_ = mar
 
@@ -30,7 +30,12 @@ func messageConfirm(
 		return errNoSuchYearGroup
 	}
 	if atomic.LoadUint32(_state) != 2 {
-		err := writeText(ctx, c, "E :Course selections are not open")
+		countRejection(rejectNotOpen)
+		err := auditSelf(ctx, userID, auditConfirm, 0, auditRejected, "Course selections are not open")
+		if err != nil {
+			return err
+		}
+		err = writeText(ctx, c, "E :Course selections are not open")
 		if err != nil {
 			return wrapError(
 				errCannotSend,
@@ -49,6 +54,17 @@ func messageConfirm(
 	default:
 	}
 
+	/*
+	 * Choices made at the same time from two connections are each checked
+	 * without knowing of the other, so we check them all together again
+	 * here, as they are in the database.
+	 */
+	chosen, err := getUserChosenCourses(ctx, userID)
+	if err != nil {
+		return err
+	}
+	userCourseTypes := countCourseTypes(chosen)
+
 	for courseType := range courseTypes {
 		minimum, err := getCourseTypeMinimumForYearGroup(
 			department,
@@ -57,27 +73,105 @@ func messageConfirm(
 		if err != nil {
 			return wrapError(errInvalidYearGroupOrCourseType, err)
 		}
-		if (*userCourseTypes)[courseType] < minimum {
+		if userCourseTypes[courseType] < minimum {
+			reason := fmt.Sprintf(
+				"You chose %d out of required %d of type %s",
+				userCourseTypes[courseType],
+				minimum,
+				courseType,
+			)
+			countRejection(rejectRequirements)
+			err := auditSelf(ctx, userID, auditConfirm, 0, auditRejected, reason)
+			if err != nil {
+				return err
+			}
+			return writeText(
+				ctx,
+				c,
+				"RC :Cannot confirm choices: "+reason,
+			)
+		}
+		/* The maximums may have been lowered since they chose */
+		maximum, err := getCourseTypeMaximumForYearGroup(
+			department,
+			courseType,
+		)
+		if err != nil {
+			return wrapError(errInvalidYearGroupOrCourseType, err)
+		}
+		if maximum != 0 && userCourseTypes[courseType] > maximum {
+			reason := fmt.Sprintf(
+				"You chose %d out of at most %d of type %s",
+				userCourseTypes[courseType],
+				maximum,
+				courseType,
+			)
+			countRejection(rejectRequirements)
+			err := auditSelf(ctx, userID, auditConfirm, 0, auditRejected, reason)
+			if err != nil {
+				return err
+			}
 			return writeText(
 				ctx,
 				c,
-				fmt.Sprintf(
-					"RC :Cannot confirm choices: You chose %d out of required %d of type %s",
-					(*userCourseTypes)[courseType],
-					minimum,
-					courseType,
-				),
+				"RC :Cannot confirm choices: "+reason,
 			)
 		}
 	}
 
-	_, err := db.Exec(
+	req, err := getYearGroupReq(department)
+	if err != nil {
+		return wrapError(errInvalidYearGroupOrCourseType, err)
+	}
+	total := 0
+	for _, n := range userCourseTypes {
+		total += n
+	}
+	if req.MaxTotal != 0 && total > req.MaxTotal {
+		reason := fmt.Sprintf("You chose %d out of at most %d courses", total, req.MaxTotal)
+		countRejection(rejectRequirements)
+		err := auditSelf(ctx, userID, auditConfirm, 0, auditRejected, reason)
+		if err != nil {
+			return err
+		}
+		return writeText(
+			ctx,
+			c,
+			"RC :Cannot confirm choices: "+reason,
+		)
+	}
+
+	for _, course := range chosen {
+		rejection, reason := checkEligibility(course, studentID, chosen)
+		if reason == "" {
+			continue
+		}
+		reason = course.Title + ": " + reason
+		countRejection(rejection)
+		err := auditSelf(ctx, userID, auditConfirm, course.ID, auditRejected, reason)
+		if err != nil {
+			return err
+		}
+		return writeText(
+			ctx,
+			c,
+			"RC :Cannot confirm choices: "+reason,
+		)
+	}
+
+	err = db.SetConfirmed(
 		ctx,
-		"UPDATE users SET confirmed = true WHERE id = $1",
 		userID,
+		true,
+		auditEntryT{
+			Actor:   userID,
+			Target:  userID,
+			Action:  auditConfirm,
+			Outcome: auditOK,
+		}, //exhaustruct:ignore
 	)
 	if err != nil {
-		return wrapError(errUnexpectedDBError, err)
+		return err
 	}
 
 	return writeText(
@@ -9,11 +9,11 @@ package main
 
 import (
 	"context"
+	"strconv"
 	"strings"
 	"sync/atomic"
 
 	"github.com/coder/websocket"
-	"github.com/jackc/pgx/v5"
 )
 
 func messageHello(
@@ -34,17 +34,13 @@ func messageHello(
 	default:
 	}
 
-	rows, err := db.Query(
-		ctx,
-		"SELECT courseid FROM choices WHERE userid = $1",
-		userID,
-	)
+	choices, err := db.GetUserChoices(ctx, userID)
 	if err != nil {
-		return wrapError(errUnexpectedDBError, err)
+		return err
 	}
-	courseIDs, err := pgx.CollectRows(rows, pgx.RowTo[string])
-	if err != nil {
-		return wrapError(errUnexpectedDBError, err)
+	courseIDs := make([]string, 0, len(choices))
+	for _, courseID := range choices {
+		courseIDs = append(courseIDs, strconv.Itoa(courseID))
 	}
 
 	_state, ok := states[yeargroup]
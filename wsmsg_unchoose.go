@@ -22,14 +22,18 @@ func messageUnchooseCourse(
 	userID string,
 	yeargroup string,
 	userCourseGroups *userCourseGroupsT,
-	userCourseTypes *userCourseTypesT,
 ) error {
 	_state, ok := states[yeargroup]
 	if !ok {
 		return errNoSuchYearGroup
 	}
 	if atomic.LoadUint32(_state) != 2 {
-		err := writeText(ctx, c, "E :Course selections are not open")
+		countRejection(rejectNotOpen)
+		err := auditSelf(ctx, userID, auditUnchoose, 0, auditRejected, "Course selections are not open")
+		if err != nil {
+			return err
+		}
+		err = writeText(ctx, c, "E :Course selections are not open")
 		if err != nil {
 			return wrapError(
 				errCannotSend,
@@ -69,42 +73,43 @@ func messageUnchooseCourse(
 		return errNoSuchCourse
 	}
 
-	ct, err := db.Exec(
-		ctx,
-		"DELETE FROM choices WHERE userid = $1 AND courseid = $2",
-		userID,
-		courseID,
-	)
+	if course.required() {
+		chosen, err := getUserChosenCourses(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if other := requiredBy(course, chosen); other != nil {
+			countRejection(rejectRequired)
+			reason := other.Title + " requires this"
+			err := auditSelf(ctx, userID, auditUnchoose, courseID, auditRejected, reason)
+			if err != nil {
+				return err
+			}
+			err = writeText(ctx, c, "RN "+mar[1]+" :"+reason)
+			if err != nil {
+				return wrapError(
+					errCannotSend,
+					err,
+				)
+			}
+			return nil
+		}
+	}
+
+	deleted, seats, err := db.Unchoose(ctx, userID, courseID)
 	if err != nil {
-		return wrapError(errUnexpectedDBError, err)
+		return err
 	}
 
-	if ct.RowsAffected() != 0 {
-		err := course.decrementSelectedAndPropagate(ctx, c)
+	if deleted {
+		err = writeSeats(ctx, c, []*courseT{course}, []seatsT{seats})
 		if err != nil {
-			return wrapError(
-				errCannotSend,
-				err,
-			)
-		}
-
-		_course, ok := courses.Load(courseID)
-		if !ok {
-			return errNoSuchCourse
-		}
-		course, ok := _course.(*courseT)
-		if !ok {
-			return errType
+			return wrapError(errCannotSend, err)
 		}
-		if course == nil {
-			return errNoSuchCourse
-		}
-
 		if _, ok := (*userCourseGroups)[course.Group]; !ok {
 			return errCourseGroupHandlingError
 		}
 		delete(*userCourseGroups, course.Group)
-		(*userCourseTypes)[course.Type]--
 	}
 
 	err = writeText(ctx, c, "N "+mar[1])
@@ -28,7 +28,12 @@ func messageUnconfirm(
 		return errNoSuchYearGroup
 	}
 	if atomic.LoadUint32(_state) != 2 {
-		err := writeText(ctx, c, "E :Course selections are not open")
+		countRejection(rejectNotOpen)
+		err := auditSelf(ctx, userID, auditUnconfirm, 0, auditRejected, "Course selections are not open")
+		if err != nil {
+			return err
+		}
+		err = writeText(ctx, c, "E :Course selections are not open")
 		if err != nil {
 			return wrapError(
 				errCannotSend,
@@ -47,13 +52,19 @@ func messageUnconfirm(
 	default:
 	}
 
-	_, err := db.Exec(
+	err := db.SetConfirmed(
 		ctx,
-		"UPDATE users SET confirmed = false WHERE id = $1",
 		userID,
+		false,
+		auditEntryT{
+			Actor:   userID,
+			Target:  userID,
+			Action:  auditUnconfirm,
+			Outcome: auditOK,
+		}, //exhaustruct:ignore
 	)
 	if err != nil {
-		return wrapError(errUnexpectedDBError, err)
+		return err
 	}
 
 	return writeText(
@@ -0,0 +1,555 @@
+/*
+ * Reading and writing spreadsheets in the Office Open XML format
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * We only need to read and write plain tables, which is little enough of the
+ * format that we handle it ourselves rather than pulling in a library for it.
+ *
+ * Each row is a slice of cells, each of which may be a string, an integer,
+ * a float64, a bool, a time.Time, which is shown in school time, or nil for
+ * an empty cell.
+ */
+type xlsxSheetT struct {
+	Name string
+	Rows [][]any
+}
+
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+/* Excel limits sheet names to 31 characters, which may not include these */
+const (
+	xlsxSheetNameMax      = 31
+	xlsxSheetNameReserved = `[]:*?/\`
+)
+
+/*
+ * Excel's own limits on the size of a sheet, up to column XFD, which we
+ * also apply when reading so that a small file that claims a cell far away
+ * cannot make us fill in every cell before it. A part of the file may not
+ * decompress to more than xlsxPartMax bytes, nor may the cells we fill in
+ * number more than xlsxCellsMax.
+ */
+const (
+	xlsxColumnsMax = 16384
+	xlsxRowsMax    = 1048576
+	xlsxCellsMax   = 1 << 22
+	xlsxPartMax    = 64 << 20
+)
+
+/*
+ * Turn a string into a valid sheet name.
+ */
+func xlsxSheetName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(xlsxSheetNameReserved, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	s = strings.Trim(s, "'")
+	if r := []rune(s); len(r) > xlsxSheetNameMax {
+		s = string(r[:xlsxSheetNameMax])
+	}
+	if s == "" {
+		s = "_"
+	}
+	return s
+}
+
+func writeXLSX(w io.Writer, sheets []xlsxSheetT) error {
+	z := zip.NewWriter(w)
+
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">`)
+	b.WriteString(`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>`)
+	b.WriteString(`<Default Extension="xml" ContentType="application/xml"/>`)
+	b.WriteString(`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>`)
+	b.WriteString(`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	for i := range sheets {
+		fmt.Fprintf(&b, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i+1)
+	}
+	b.WriteString(`</Types>`)
+	err := xlsxWriteFile(z, "[Content_Types].xml", b.String())
+	if err != nil {
+		return err
+	}
+
+	err = xlsxWriteFile(z, "_rels/.rels", xml.Header+
+		`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`+
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>`+
+		`</Relationships>`)
+	if err != nil {
+		return err
+	}
+
+	b.Reset()
+	b.WriteString(xml.Header)
+	b.WriteString(`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	for i, sheet := range sheets {
+		fmt.Fprintf(&b, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xlsxEscape(xlsxSheetName(sheet.Name)), i+1, i+1)
+	}
+	b.WriteString(`</sheets></workbook>`)
+	err = xlsxWriteFile(z, "xl/workbook.xml", b.String())
+	if err != nil {
+		return err
+	}
+
+	b.Reset()
+	b.WriteString(xml.Header)
+	b.WriteString(`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i := range sheets {
+		fmt.Fprintf(&b, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, i+1, i+1)
+	}
+	fmt.Fprintf(&b, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`, len(sheets)+1)
+	b.WriteString(`</Relationships>`)
+	err = xlsxWriteFile(z, "xl/_rels/workbook.xml.rels", b.String())
+	if err != nil {
+		return err
+	}
+
+	/* Style 1 is for dates and times, with the built-in format 22 */
+	err = xlsxWriteFile(z, "xl/styles.xml", xml.Header+
+		`<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`+
+		`<fonts count="1"><font><sz val="11"/><name val="Calibri"/></font></fonts>`+
+		`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>`+
+		`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>`+
+		`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>`+
+		`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>`+
+		`<xf numFmtId="22" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/></cellXfs>`+
+		`</styleSheet>`)
+	if err != nil {
+		return err
+	}
+
+	for i, sheet := range sheets {
+		err = xlsxWriteSheet(z, fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1), sheet.Rows)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = z.Close()
+	if err != nil {
+		return wrapError(errXLSXWrite, err)
+	}
+	return nil
+}
+
+func xlsxCreate(z *zip.Writer, name string) (io.Writer, error) {
+	return z.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	}) //exhaustruct:ignore
+}
+
+func xlsxWriteFile(z *zip.Writer, name, content string) error {
+	f, err := xlsxCreate(z, name)
+	if err != nil {
+		return wrapError(errXLSXWrite, err)
+	}
+	_, err = io.WriteString(f, content)
+	if err != nil {
+		return wrapError(errXLSXWrite, err)
+	}
+	return nil
+}
+
+func xlsxWriteSheet(z *zip.Writer, name string, rows [][]any) error {
+	f, err := xlsxCreate(z, name)
+	if err != nil {
+		return wrapError(errXLSXWrite, err)
+	}
+	w := bufio.NewWriter(f)
+	_, _ = w.WriteString(xml.Header)
+	_, _ = w.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	for i, row := range rows {
+		fmt.Fprintf(w, `<row r="%d">`, i+1)
+		for j, cell := range row {
+			ref := xlsxColumnName(j) + strconv.Itoa(i+1)
+			switch v := cell.(type) {
+			case nil:
+			case string:
+				if v != "" {
+					fmt.Fprintf(w, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, xlsxEscape(v))
+				}
+			case bool:
+				n := 0
+				if v {
+					n = 1
+				}
+				fmt.Fprintf(w, `<c r="%s" t="b"><v>%d</v></c>`, ref, n)
+			case int:
+				fmt.Fprintf(w, `<c r="%s"><v>%d</v></c>`, ref, v)
+			case int64:
+				fmt.Fprintf(w, `<c r="%s"><v>%d</v></c>`, ref, v)
+			case uint32:
+				fmt.Fprintf(w, `<c r="%s"><v>%d</v></c>`, ref, v)
+			case float64:
+				fmt.Fprintf(w, `<c r="%s"><v>%s</v></c>`, ref, strconv.FormatFloat(v, 'g', -1, 64))
+			case time.Time:
+				if !v.IsZero() {
+					fmt.Fprintf(w, `<c r="%s" s="1"><v>%s</v></c>`, ref, strconv.FormatFloat(xlsxSerialTime(v), 'f', -1, 64))
+				}
+			default:
+				return wrapAny(errXLSXWrite, fmt.Sprintf("cannot write %T", cell))
+			}
+		}
+		_, _ = w.WriteString(`</row>`)
+	}
+	_, _ = w.WriteString(`</sheetData></worksheet>`)
+	err = w.Flush()
+	if err != nil {
+		return wrapError(errXLSXWrite, err)
+	}
+	return nil
+}
+
+/*
+ * The column letters for a zero-based column number: A, ..., Z, AA, ...
+ */
+func xlsxColumnName(n int) string {
+	var s []byte
+	for n++; n > 0; n = (n - 1) / 26 {
+		s = append([]byte{byte('A' + (n-1)%26)}, s...)
+	}
+	return string(s)
+}
+
+/*
+ * Spreadsheets count days, in local time, since the end of 1899.
+ */
+var xlsxEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+func xlsxSerialTime(t time.Time) float64 {
+	t = t.In(loc)
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	return wall.Sub(xlsxEpoch).Hours() / 24
+}
+
+/*
+ * Escape text for XML, dropping characters that XML cannot represent at
+ * all.
+ */
+func xlsxEscape(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+			return -1
+		}
+		return r
+	}, s)
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+/*
+ * Spreadsheets, like any other zip file, start with a local file header.
+ */
+func isXLSX(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("PK\x03\x04"))
+}
+
+/*
+ * Read the first sheet of a spreadsheet as rows of text, as a CSV file would
+ * have them. Numbers are as they are stored, except those formatted as dates,
+ * which are given as 2006-01-02T15:04 as they would be typed into a CSV file,
+ * and rows with nothing in them are skipped. Cells missing from the end of a
+ * row, as empty cells are, are filled in up to the width of the first row.
+ */
+func readXLSX(data []byte) ([][]string, error) {
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, wrapError(errCannotReadXLSX, err)
+	}
+
+	var workbook struct {
+		Sheets []struct {
+			ID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	err = xlsxReadFile(z, "xl/workbook.xml", &workbook)
+	if err != nil {
+		return nil, err
+	}
+	if len(workbook.Sheets) == 0 {
+		return nil, wrapAny(errCannotReadXLSX, "no sheets")
+	}
+
+	var rels struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	err = xlsxReadFile(z, "xl/_rels/workbook.xml.rels", &rels)
+	if err != nil {
+		return nil, err
+	}
+	var sheetPath string
+	for _, rel := range rels.Relationships {
+		if rel.ID == workbook.Sheets[0].ID {
+			if strings.HasPrefix(rel.Target, "/") {
+				sheetPath = strings.TrimPrefix(rel.Target, "/")
+			} else {
+				sheetPath = path.Join("xl", rel.Target)
+			}
+		}
+	}
+	if sheetPath == "" {
+		return nil, wrapAny(errCannotReadXLSX, "first sheet not found")
+	}
+
+	/* Strings are usually stored once, and referred to by index */
+	var sst struct {
+		Items []xlsxRichTextT `xml:"si"`
+	}
+	err = xlsxReadFile(z, "xl/sharedStrings.xml", &sst)
+	if err != nil && !errors.Is(err, errXLSXMissingPart) {
+		return nil, err
+	}
+
+	dateStyles, err := xlsxReadDateStyles(z)
+	if err != nil {
+		return nil, err
+	}
+
+	var sheet struct {
+		Rows []struct {
+			Cells []struct {
+				Ref    string        `xml:"r,attr"`
+				Type   string        `xml:"t,attr"`
+				Style  int           `xml:"s,attr"`
+				Value  string        `xml:"v"`
+				Inline xlsxRichTextT `xml:"is"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	err = xlsxReadFile(z, sheetPath, &sheet)
+	if err != nil {
+		return nil, err
+	}
+	if len(sheet.Rows) > xlsxRowsMax {
+		return nil, wrapAny(errCannotReadXLSX, "too many rows")
+	}
+
+	rows := make([][]string, 0, len(sheet.Rows))
+	cells := 0
+	for _, row := range sheet.Rows {
+		var values []string
+		empty := true
+		for i, cell := range row.Cells {
+			column := i
+			if cell.Ref != "" {
+				column, err = xlsxColumnNumber(cell.Ref)
+				if err != nil {
+					return nil, err
+				}
+			}
+			var value string
+			switch cell.Type {
+			case "s":
+				n, err := strconv.Atoi(cell.Value)
+				if err != nil || n < 0 || n >= len(sst.Items) {
+					return nil, wrapAny(errCannotReadXLSX, "bad shared string in "+cell.Ref)
+				}
+				value = sst.Items[n].String()
+			case "inlineStr":
+				value = cell.Inline.String()
+			case "b":
+				value = strconv.FormatBool(cell.Value == "1")
+			case "", "n":
+				value = cell.Value
+				if _, ok := dateStyles[cell.Style]; ok && value != "" {
+					value, err = xlsxSerialText(value)
+					if err != nil {
+						return nil, wrapAny(errCannotReadXLSX, "bad date in "+cell.Ref)
+					}
+				}
+			default:
+				value = cell.Value
+			}
+			if value == "" {
+				continue
+			}
+			empty = false
+			for len(values) <= column {
+				values = append(values, "")
+			}
+			values[column] = value
+		}
+		if empty {
+			continue
+		}
+		if len(rows) > 0 {
+			for len(values) < len(rows[0]) {
+				values = append(values, "")
+			}
+		}
+		cells += len(values)
+		if cells > xlsxCellsMax {
+			return nil, wrapAny(errCannotReadXLSX, "too many cells")
+		}
+		rows = append(rows, values)
+	}
+	return rows, nil
+}
+
+/*
+ * Text is either in one piece or in several runs of differently formatted
+ * text, which we join.
+ */
+type xlsxRichTextT struct {
+	Text string `xml:"t"`
+	Runs []struct {
+		Text string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxRichTextT) String() string {
+	if len(t.Runs) == 0 {
+		return t.Text
+	}
+	var b strings.Builder
+	for _, run := range t.Runs {
+		b.WriteString(run.Text)
+	}
+	return b.String()
+}
+
+func xlsxReadFile(z *zip.Reader, name string, v any) error {
+	f, err := z.Open(name)
+	if err != nil {
+		return wrapAny(errXLSXMissingPart, name)
+	}
+	defer f.Close()
+	r := &io.LimitedReader{R: f, N: xlsxPartMax + 1}
+	err = xml.NewDecoder(r).Decode(v)
+	if r.N == 0 {
+		return wrapAny(errCannotReadXLSX, name+" is too large")
+	}
+	if err != nil {
+		return wrapError(errCannotReadXLSX, err)
+	}
+	return nil
+}
+
+/*
+ * Dates are numbers like any other, which are only shown as dates because
+ * of the number format of their style. The formats built into Excel that
+ * are dates are numbered 14 to 22 and 45 to 47, and the rest, such as the
+ * ones for other locales, are written out in the styles.
+ */
+func xlsxReadDateStyles(z *zip.Reader) (map[int]struct{}, error) {
+	var styles struct {
+		NumFmts []struct {
+			ID   int    `xml:"numFmtId,attr"`
+			Code string `xml:"formatCode,attr"`
+		} `xml:"numFmts>numFmt"`
+		CellXfs []struct {
+			NumFmtID int `xml:"numFmtId,attr"`
+		} `xml:"cellXfs>xf"`
+	}
+	err := xlsxReadFile(z, "xl/styles.xml", &styles)
+	if errors.Is(err, errXLSXMissingPart) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	dateFormats := make(map[int]struct{})
+	for _, id := range []int{14, 15, 16, 17, 18, 19, 20, 21, 22, 45, 46, 47} {
+		dateFormats[id] = struct{}{}
+	}
+	for _, numFmt := range styles.NumFmts {
+		if xlsxIsDateFormat(numFmt.Code) {
+			dateFormats[numFmt.ID] = struct{}{}
+		} else {
+			delete(dateFormats, numFmt.ID)
+		}
+	}
+
+	result := make(map[int]struct{})
+	for i, xf := range styles.CellXfs {
+		if _, ok := dateFormats[xf.NumFmtID]; ok {
+			result[i] = struct{}{}
+		}
+	}
+	return result, nil
+}
+
+/*
+ * Whether a number format shows a date or a time, which is whether it has
+ * any of their letters outside of quoted text, escaped characters and
+ * brackets, which hold colours, conditions and locales.
+ */
+func xlsxIsDateFormat(code string) bool {
+	for i := 0; i < len(code); i++ {
+		switch code[i] {
+		case '"':
+			for i++; i < len(code) && code[i] != '"'; i++ {
+			}
+		case '\\', '_', '*':
+			i++
+		case '[':
+			for i++; i < len(code) && code[i] != ']'; i++ {
+			}
+		case 'd', 'D', 'm', 'M', 'y', 'Y', 'h', 'H', 's', 'S':
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * The inverse of xlsxSerialTime, as text in the form 2006-01-02T15:04, to
+ * the nearest minute.
+ */
+func xlsxSerialText(value string) (string, error) {
+	days, err := strconv.ParseFloat(value, 64)
+	if err != nil || days < 0 || days >= 2958466 {
+		return "", errCannotReadXLSX
+	}
+	minutes := int64(days*24*60 + 0.5)
+	return xlsxEpoch.Add(time.Duration(minutes) * time.Minute).Format("2006-01-02T15:04"), nil
+}
+
+/*
+ * The zero-based column number of a cell reference such as "AB12", which
+ * may be no further than column XFD.
+ */
+func xlsxColumnNumber(ref string) (int, error) {
+	n := 0
+	i := 0
+	for ; i < len(ref) && ref[i] >= 'A' && ref[i] <= 'Z'; i++ {
+		n = n*26 + int(ref[i]-'A') + 1
+		if n > xlsxColumnsMax {
+			return 0, wrapAny(errCannotReadXLSX, "cell reference past column XFD "+ref)
+		}
+	}
+	if i == 0 {
+		return 0, wrapAny(errCannotReadXLSX, "bad cell reference "+ref)
+	}
+	return n - 1, nil
+}
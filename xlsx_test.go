@@ -0,0 +1,137 @@
+/*
+ * Tests of reading spreadsheets
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * A spreadsheet with one sheet holding the given sheetData, and the given
+ * styles if there are any.
+ */
+func testXLSX(t *testing.T, sheetData, styles string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	parts := map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Target="worksheets/sheet1.xml"/></Relationships>`,
+		"xl/worksheets/sheet1.xml": `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			`<sheetData>` + sheetData + `</sheetData></worksheet>`,
+	}
+	if styles != "" {
+		parts["xl/styles.xml"] = `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			styles + `</styleSheet>`
+	}
+	for name, content := range parts {
+		err := xlsxWriteFile(z, name, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := z.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestXLSXColumnNumber(t *testing.T) {
+	for _, tc := range []struct {
+		ref  string
+		want int
+		ok   bool
+	}{
+		{"A1", 0, true},
+		{"Z9", 25, true},
+		{"AA1", 26, true},
+		{"XFD1", 16383, true},
+		{"XFE1", 0, false},
+		{"ZZZZZZZZZZZZZZ1", 0, false},
+		{"1", 0, false},
+	} {
+		got, err := xlsxColumnNumber(tc.ref)
+		switch {
+		case tc.ok && (err != nil || got != tc.want):
+			t.Errorf("%s: got %d, %v, want %d", tc.ref, got, err, tc.want)
+		case !tc.ok && !errors.Is(err, errCannotReadXLSX):
+			t.Errorf("%s: got %d, %v, want an error", tc.ref, got, err)
+		}
+	}
+}
+
+func TestReadXLSXLimits(t *testing.T) {
+	_, err := readXLSX(testXLSX(t, `<row r="1"><c r="XFE1" t="inlineStr"><is><t>x</t></is></c></row>`, ""))
+	if !errors.Is(err, errCannotReadXLSX) {
+		t.Errorf("cell past XFD: got %v", err)
+	}
+
+	/* Each row is filled in up to the width of the first */
+	var b strings.Builder
+	b.WriteString(`<row r="1"><c r="XFD1"><v>1</v></c></row>`)
+	for i := 2; i <= xlsxCellsMax/xlsxColumnsMax+1; i++ {
+		fmt.Fprintf(&b, `<row r="%d"><c r="A%d"><v>1</v></c></row>`, i, i)
+	}
+	_, err = readXLSX(testXLSX(t, b.String(), ""))
+	if !errors.Is(err, errCannotReadXLSX) {
+		t.Errorf("too many cells: got %v", err)
+	}
+}
+
+func TestReadXLSXDates(t *testing.T) {
+	styles := `<numFmts count="2"><numFmt numFmtId="164" formatCode="yyyy/mm/dd\ hh:mm"/>` +
+		`<numFmt numFmtId="165" formatCode="[Red]&quot;days&quot;\ 0.00"/></numFmts>` +
+		`<cellXfs count="4"><xf numFmtId="0"/><xf numFmtId="22"/><xf numFmtId="164"/><xf numFmtId="165"/></cellXfs>`
+	rows, err := readXLSX(testXLSX(t, `<row r="1">`+
+		`<c r="A1"><v>45536.5</v></c>`+
+		`<c r="B1" s="1"><v>45536.5</v></c>`+
+		`<c r="C1" s="2"><v>45536.75</v></c>`+
+		`<c r="D1" s="3"><v>45536.5</v></c>`+
+		`<c r="E1" s="1" t="inlineStr"><is><t>2024-09-01T08:00</t></is></c>`+
+		`</row>`, styles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"45536.5", "2024-09-01T12:00", "2024-09-01T18:00", "45536.5", "2024-09-01T08:00"}
+	if len(rows) != 1 || !slices.Equal(rows[0], want) {
+		t.Errorf("got %q, want %q", rows, want)
+	}
+}
+
+/*
+ * A spreadsheet exported with a time in it reads back as the same time, as
+ * it would be typed into a CSV file.
+ */
+func TestXLSXTimeRoundTrip(t *testing.T) {
+	when := time.Date(2024, 9, 1, 8, 30, 0, 0, loc)
+	var buf bytes.Buffer
+	err := writeXLSX(&buf, []xlsxSheetT{{Name: "Courses", Rows: [][]any{
+		{"Quota Release"},
+		{when},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := readXLSX(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[1][0] != "2024-09-01T08:30" {
+		t.Errorf("got %q", rows)
+	}
+}